@@ -3,7 +3,9 @@ package conf
 import (
 	"fmt"
 	"log"
+	"sync"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/viper"
 )
 
@@ -28,6 +30,17 @@ import (
 
 var Configuration Config
 
+// configMu guards the layers of Configuration once the server is started,
+// and the layers added and removed while it runs
+var configMu sync.RWMutex
+
+// added and removed are the layers added and removed while the server runs,
+// which are kept over the config file when it's reloaded
+var (
+	added   []Layer
+	removed = make(map[string]bool)
+)
+
 func setDefaultConfig() {
 	viper.SetDefault("Server.Host", "0.0.0.0")
 	viper.SetDefault("Server.Port", 5500)
@@ -35,8 +48,15 @@ func setDefaultConfig() {
 	viper.SetDefault("Server.ReadTimeoutSec", 5)
 	viper.SetDefault("Server.WriteTimeoutSec", 30)
 	viper.SetDefault("Server.ThrottleLimit", 1000)
-	viper.SetDefault("Server.Debug", false)
-	viper.SetDefault("Server.Logs", false)
+	viper.SetDefault("Server.ThrottleBacklog", 1000)
+	viper.SetDefault("Server.ThrottleBacklogTimeoutSec", 10)
+	viper.SetDefault("Server.RateLimit", 0)
+	viper.SetDefault("Server.RateBurst", 0)
+	viper.SetDefault("Server.RealIP", false)
+	viper.SetDefault("Server.LogLevel", "info")
+	viper.SetDefault("Server.SlowRequestMs", 1000)
+	viper.SetDefault("Server.AdminKey", "")
+	viper.SetDefault("Server.Metrics", true)
 }
 
 type Config struct {
@@ -45,32 +65,83 @@ type Config struct {
 }
 
 type Server struct {
-	Host            string
-	Port            int
-	CORSOrigin      string
-	ReadTimeoutSec  int
-	WriteTimeoutSec int
-	ThrottleLimit   int
-	Debug           bool
-	Logs            bool
+	Host                      string
+	Port                      int
+	CORSOrigin                string
+	ReadTimeoutSec            int
+	WriteTimeoutSec           int
+	ThrottleLimit             int
+	ThrottleBacklog           int
+	ThrottleBacklogTimeoutSec int
+	RateLimit                 float64
+	RateBurst                 int
+	RealIP                    bool
+	LogLevel                  string
+	SlowRequestMs             int
+	AdminKey                  string
+	Metrics                   bool
+	Auth                      Auth
+	TLSCert                   string
+	TLSKey                    string
+	TLSClientCA               string
+	HTTPRedirectPort          int
+}
+
+type Auth struct {
+	Keys        []AuthKey
+	JWKSFile    string
+	Issuer      string
+	Audience    string
+	LayersClaim string
+	// WriteLayersClaim lists the layers a JWT may also write to
+	WriteLayersClaim string
+	Claims           []AuthClaim
+}
+
+// AuthKey gives access to layers, and with Write, to write to them
+type AuthKey struct {
+	Key    string
+	Layers []string
+	Write  bool
+}
+
+// AuthClaim gives access to layers to JWTs with a claim value, and with Write, to write to them
+type AuthClaim struct {
+	Claim  string
+	Value  string
+	Layers []string
+	Write  bool
 }
 
 type Layer struct {
-	Name      string
-	Data      LayerData
-	Database  LayerDatabase
-	ZoomLimit int
+	Name                string
+	Data                LayerData
+	Database            LayerDatabase
+	ZoomLimit           int
+	Writable            bool
+	Optional            bool
+	ConcurrencyLimit    int
+	Public              bool
+	CacheMaxAgeSec      int
+	CacheSizeMB         int
+	FeatureCacheMB      int
+	FeatureCachePreload bool
+	QueryTimeoutMs      int
+	PartialResults      bool
+	Search              []string
 }
 
 type LayerData struct {
 	Dir string
 	Ext string
 	ID  string
+	CRS string
 }
 
 type LayerDatabase struct {
 	Filepath string
 	Index    string
+	Backend  string
 }
 
 func InitConfig(configFilename string) {
@@ -107,3 +178,110 @@ func InitConfig(configFilename string) {
 		log.Fatalf(err.Error())
 	}
 }
+
+// ReloadConfig re-reads the layers of the config file into Configuration, keeping the
+// current config if the file can't be read. Layers added or removed while the server runs
+// stay added or removed. Server settings only apply at start, so they aren't reloaded.
+func ReloadConfig() error {
+
+	if viper.ConfigFileUsed() == "" {
+		return nil
+	}
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+
+	var config Config
+	if err := viper.Unmarshal(&config); err != nil {
+		return err
+	}
+
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	layers := []Layer{}
+	for _, l := range config.Layers {
+		if removed[l.Name] || isAdded(l.Name) {
+			continue
+		}
+		layers = append(layers, l)
+	}
+	Configuration.Layers = append(layers, added...)
+
+	return nil
+}
+
+func isAdded(name string) bool {
+	for _, l := range added {
+		if l.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// WatchConfig calls onChange whenever the config file is written
+func WatchConfig(onChange func()) {
+	if viper.ConfigFileUsed() == "" {
+		return
+	}
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		onChange()
+	})
+	viper.WatchConfig()
+}
+
+// Layers returns a copy of the configured layers
+func Layers() []Layer {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return append([]Layer{}, Configuration.Layers...)
+}
+
+// GetLayer returns the config of a layer
+func GetLayer(name string) (Layer, bool) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	for _, l := range Configuration.Layers {
+		if l.Name == name {
+			return l, true
+		}
+	}
+	return Layer{}, false
+}
+
+// AddLayer adds a layer to the running config, without writing it to the config file.
+// It returns false if a layer of the same name is already configured.
+func AddLayer(layer Layer) bool {
+	configMu.Lock()
+	defer configMu.Unlock()
+	for _, l := range Configuration.Layers {
+		if l.Name == layer.Name {
+			return false
+		}
+	}
+	Configuration.Layers = append(Configuration.Layers, layer)
+	added = append(added, layer)
+	delete(removed, layer.Name)
+	return true
+}
+
+// RemoveLayer removes a layer from the running config
+func RemoveLayer(name string) bool {
+	configMu.Lock()
+	defer configMu.Unlock()
+	for i, l := range added {
+		if l.Name == name {
+			added = append(added[:i:i], added[i+1:]...)
+			break
+		}
+	}
+	for i, l := range Configuration.Layers {
+		if l.Name == name {
+			Configuration.Layers = append(Configuration.Layers[:i:i], Configuration.Layers[i+1:]...)
+			removed[name] = true
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,77 @@
+package conf
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, path, config string) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func layerNames() []string {
+	names := []string{}
+	for _, l := range Layers() {
+		names = append(names, l.Name)
+	}
+	return names
+}
+
+func TestReloadConfigKeepsRuntimeLayers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeTestConfig(t, path, `{"server":{"port":5501,"adminkey":"a"},"layers":[{"name":"one"},{"name":"two"}]}`)
+	InitConfig(path)
+
+	if !AddLayer(Layer{Name: "three"}) {
+		t.Fatal("unable to add layer three")
+	}
+	if AddLayer(Layer{Name: "one"}) {
+		t.Fatal("added layer one twice")
+	}
+	if !RemoveLayer("two") {
+		t.Fatal("unable to remove layer two")
+	}
+
+	// the file changes, but not the layers added and removed meanwhile
+	writeTestConfig(t, path, `{"server":{"port":5502,"adminkey":"b"},"layers":[{"name":"one","zoomlimit":3},{"name":"two"},{"name":"four"}]}`)
+	if err := ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"one", "four", "three"}
+	got := layerNames()
+	if len(got) != len(want) {
+		t.Fatalf("layers after reload: %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("layers after reload: %v, want %v", got, want)
+		}
+	}
+
+	one, _ := GetLayer("one")
+	if one.ZoomLimit != 3 {
+		t.Errorf("layer one wasn't reloaded")
+	}
+	if Configuration.Server.Port != 5501 || Configuration.Server.AdminKey != "a" {
+		t.Errorf("server settings were reloaded: %+v", Configuration.Server)
+	}
+
+	// an added layer that's removed stays removed
+	if !RemoveLayer("three") {
+		t.Fatal("unable to remove layer three")
+	}
+	if err := ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := GetLayer("three"); ok {
+		t.Error("removed layer three is back after reload")
+	}
+	if _, ok := GetLayer("two"); ok {
+		t.Error("removed layer two is back after reload")
+	}
+}
@@ -0,0 +1,120 @@
+package data
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/engelsjk/rtyq/logger"
+	"github.com/paulmach/orb/geojson"
+)
+
+// featureCache keeps the decoded features of a layer in memory, so that queries
+// don't read and parse their data files every time. It evicts the least recently
+// used features once the size of their data files exceeds maxBytes (if set).
+// Cached features are shared between queries and must not be modified.
+type featureCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	// gen changes whenever a feature is removed, so that a feature read
+	// before it was written isn't cached afterwards
+	gen     uint64
+	entries *list.List
+	items   map[string]*list.Element
+}
+
+type cachedFeature struct {
+	id   string
+	f    *geojson.Feature
+	size int64
+}
+
+func newFeatureCache(maxBytes int64) *featureCache {
+	return &featureCache{
+		maxBytes: maxBytes,
+		entries:  list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// get returns a cached feature, or the generation to put it with
+func (c *featureCache) get(id string) (*geojson.Feature, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[id]
+	if !ok {
+		return nil, c.gen, false
+	}
+	c.entries.MoveToFront(e)
+	return e.Value.(*cachedFeature).f, c.gen, true
+}
+
+// put caches a feature unless it was removed since gen, and reports
+// whether it fits in the cache
+func (c *featureCache) put(id string, f *geojson.Feature, size int64, gen uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return true
+	}
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return false
+	}
+	if e, ok := c.items[id]; ok {
+		c.size -= e.Value.(*cachedFeature).size
+		c.entries.Remove(e)
+	}
+
+	c.items[id] = c.entries.PushFront(&cachedFeature{id: id, f: f, size: size})
+	c.size += size
+
+	full := false
+	for c.maxBytes > 0 && c.size > c.maxBytes {
+		c.evict(c.entries.Back())
+		full = true
+	}
+	return !full
+}
+
+func (c *featureCache) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	if e, ok := c.items[id]; ok {
+		c.evict(e)
+	}
+}
+
+func (c *featureCache) evict(e *list.Element) {
+	cf := e.Value.(*cachedFeature)
+	c.entries.Remove(e)
+	delete(c.items, cf.id)
+	c.size -= cf.size
+}
+
+// preload reads every feature of a layer into its cache, until it's full
+func (l *Layer) preload() error {
+
+	ids, err := l.ids()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		file, err := l.store.Get(id)
+		if err != nil {
+			return err
+		}
+		f, size, err := l.readFeature(id, file)
+		if err != nil {
+			logger.Warn("unable to preload feature", logger.Fields{"layer": l.Name, "id": id, "error": err})
+			continue
+		}
+		if !l.features.put(id, f, size, 0) {
+			break
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+package data
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestFeatureCache(t *testing.T) {
+	c := newFeatureCache(100)
+	f := geojson.NewFeature(nil)
+
+	if !c.put("a", f, 40, 0) || !c.put("b", f, 40, 0) {
+		t.Fatal("features that fit weren't cached")
+	}
+	c.get("a") // a is used, so b is evicted first
+	if c.put("c", f, 40, 0) {
+		t.Error("put that evicted a feature reported that it fit")
+	}
+	for id, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, _, ok := c.get(id); ok != want {
+			t.Errorf("feature %s cached: %v, want %v", id, ok, want)
+		}
+	}
+	if c.size != 80 {
+		t.Errorf("cache size %d, want 80", c.size)
+	}
+
+	if c.put("big", f, 101, 0) {
+		t.Error("feature larger than the cache fit")
+	}
+	if _, _, ok := c.get("big"); ok {
+		t.Error("feature larger than the cache was cached")
+	}
+
+	// a feature read before a removal isn't cached after it
+	_, gen, _ := c.get("d")
+	c.remove("a")
+	if _, _, ok := c.get("a"); ok {
+		t.Error("removed feature still cached")
+	}
+	c.put("d", f, 10, gen)
+	if _, _, ok := c.get("d"); ok {
+		t.Error("feature read before a removal was cached")
+	}
+	if c.size != 40 {
+		t.Errorf("cache size %d, want 40", c.size)
+	}
+
+	// without a size, the cache isn't bounded
+	c = newFeatureCache(0)
+	for _, id := range []string{"a", "b", "c"} {
+		if !c.put(id, f, 1<<30, 0) {
+			t.Errorf("feature %s didn't fit in an unbounded cache", id)
+		}
+	}
+}
+
+// featureVersion returns the v property of a feature, to tell apart
+// a cached feature from its data file
+func featureVersion(t *testing.T, q *Query, id string) interface{} {
+	t.Helper()
+	features, err := q.ID(context.Background(), "test", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return (*features)[0].Properties["v"]
+}
+
+func versionedFeature(id, v string) string {
+	return `{"type":"Feature","properties":{"ID":"` + id + `","v":` + v + `},"geometry":{"type":"Polygon","coordinates":[` + square0 + `]}}`
+}
+
+func TestLayerFeatureCache(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			for _, preload := range []bool{false, true} {
+				q := newTestQuery()
+				confLayer := testConfLayer(t, backend, map[string]string{
+					"a": versionedFeature("a", "1"),
+				})
+				confLayer.FeatureCacheMB = 1
+				confLayer.FeatureCachePreload = preload
+				l := loadTestLayer(t, q, confLayer)
+
+				if preload && len(l.features.items) != 1 {
+					t.Errorf("%d features preloaded, want 1", len(l.features.items))
+				}
+				if v := featureVersion(t, q, "a"); v != 1.0 {
+					t.Fatalf("feature version %v, want 1", v)
+				}
+
+				// the data file changes behind the layer's back, but the cached feature is served
+				if err := ioutil.WriteFile(filepath.Join(l.DataDir, "a.geojson"), []byte(versionedFeature("a", "2")), 0644); err != nil {
+					t.Fatal(err)
+				}
+				if v := featureVersion(t, q, "a"); v != 1.0 {
+					t.Errorf("preload %v: feature version %v, want the cached 1", preload, v)
+				}
+
+				// a write drops it from the cache
+				if _, _, err := q.Put("test", "a", parseTestFeature(t, versionedFeature("a", "3"))); err != nil {
+					t.Fatal(err)
+				}
+				if v := featureVersion(t, q, "a"); v != 3.0 {
+					t.Errorf("preload %v: feature version %v after a write, want 3", preload, v)
+				}
+				if err := q.Delete("test", "a"); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := q.ID(context.Background(), "test", "a"); err != ErrQueryNotFound {
+					t.Errorf("preload %v: id query of a deleted feature returned %v", preload, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package data
+
+import (
+	"sync"
+
+	"github.com/paulmach/orb"
+)
+
+const (
+	ChangeInsert = "insert"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// changeBuffer is the number of changes a subscriber can fall behind
+// before its subscription is closed
+const changeBuffer = 256
+
+// Change is a feature written to or deleted from a layer. BBoxes are the rects
+// of the feature before and after the change, so that clients can invalidate both.
+type Change struct {
+	Seq    uint64       `json:"seq"`
+	Layer  string       `json:"layer"`
+	Op     string       `json:"op"`
+	ID     string       `json:"id"`
+	BBoxes [][4]float64 `json:"bboxes"`
+	rects  []orb.Bound
+}
+
+type subscription struct {
+	layer  string
+	rects  []orb.Bound
+	ch     chan Change
+	closed bool
+}
+
+// changes fans the changes of every layer out to subscribers.
+// Subscriptions are kept by layer name, so they outlive reloads.
+type changes struct {
+	mu   sync.Mutex
+	seq  uint64
+	subs map[*subscription]bool
+}
+
+// Subscribe returns the changes made to a layer from now on, optionally only those
+// intersecting bbox, and a func to end the subscription. The channel is closed if the
+// subscriber falls too far behind, so a client should then reload what it needs.
+func (q *Query) Subscribe(layer string, bbox *orb.Bound) (<-chan Change, func(), error) {
+
+	if layer == "" {
+		return nil, nil, ErrQueryMissingLayer
+	}
+	if !q.HasLayer(layer) {
+		return nil, nil, ErrQueryInvalidLayer
+	}
+
+	s := &subscription{
+		layer: layer,
+		ch:    make(chan Change, changeBuffer),
+	}
+	if bbox != nil {
+		s.rects = queryBounds(*bbox)
+	}
+
+	q.changes.mu.Lock()
+	if q.changes.subs == nil {
+		q.changes.subs = make(map[*subscription]bool)
+	}
+	q.changes.subs[s] = true
+	q.changes.mu.Unlock()
+
+	cancel := func() {
+		q.changes.mu.Lock()
+		defer q.changes.mu.Unlock()
+		q.changes.unsubscribe(s)
+	}
+
+	return s.ch, cancel, nil
+}
+
+// ParseBBox parses a bbox of the form minX,minY,maxX,maxY
+func ParseBBox(bb string) (*orb.Bound, error) {
+	bbox := parseBBox(bb)
+	if bbox == nil || bbox.Min.Lat() > bbox.Max.Lat() {
+		return nil, ErrQueryInvalidBBox
+	}
+	return bbox, nil
+}
+
+func (q *Query) publish(layer, op, id string, rects ...[]orb.Bound) {
+
+	c := Change{Layer: layer, Op: op, ID: id, BBoxes: [][4]float64{}}
+	for _, rs := range rects {
+		for _, r := range rs {
+			c.rects = append(c.rects, r)
+			c.BBoxes = append(c.BBoxes, [4]float64{r.Min[0], r.Min[1], r.Max[0], r.Max[1]})
+		}
+	}
+
+	q.changes.mu.Lock()
+	defer q.changes.mu.Unlock()
+
+	q.changes.seq++
+	c.Seq = q.changes.seq
+
+	for s := range q.changes.subs {
+		if s.layer != layer || !s.matches(c) {
+			continue
+		}
+		select {
+		case s.ch <- c:
+		default:
+			q.changes.unsubscribe(s)
+		}
+	}
+}
+
+func (cs *changes) unsubscribe(s *subscription) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	delete(cs.subs, s)
+	close(s.ch)
+}
+
+func (s *subscription) matches(c Change) bool {
+	if s.rects == nil {
+		return true
+	}
+	for _, a := range s.rects {
+		for _, b := range c.rects {
+			if a.Intersects(b) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,204 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/paulmach/orb"
+)
+
+func subscribe(t *testing.T, q *Query, bbox string) <-chan Change {
+	t.Helper()
+	var b *orb.Bound
+	if bbox != "" {
+		var err error
+		if b, err = ParseBBox(bbox); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ch, cancel, err := q.Subscribe("test", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cancel)
+	return ch
+}
+
+// received returns the ops of the changes sent to a subscription so far
+func received(ch <-chan Change) []string {
+	ops := []string{}
+	for {
+		select {
+		case c := <-ch:
+			ops = append(ops, c.Op+" "+c.ID)
+		default:
+			return ops
+		}
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	q := newTestQuery()
+	loadTestLayer(t, q, testConfLayer(t, BackendMemory, map[string]string{
+		"a": testFeature("a", square0),
+	}))
+
+	all := subscribe(t, q, "")
+	near0 := subscribe(t, q, "-1,-1,2,2")
+	near5 := subscribe(t, q, "4,4,7,7")
+	across := subscribe(t, q, "170,-20,-170,-10")
+
+	if _, _, err := q.Put("test", "c", parseTestFeature(t, testFeature("c", square5))); err != nil {
+		t.Fatal(err)
+	}
+	// a moves from near 0 to near 5, so both see it
+	if _, _, err := q.Put("test", "a", parseTestFeature(t, testFeature("a", square5))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := q.Put("test", "w", parseTestFeature(t, testFeature("w", `[[-172,-19],[-171,-19],[-171,-18],[-172,-19]]`))); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Delete("test", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ch   <-chan Change
+		want []string
+	}{
+		{"all", all, []string{"insert c", "update a", "insert w", "delete c"}},
+		{"near 0", near0, []string{"update a"}},
+		{"near 5", near5, []string{"insert c", "update a", "delete c"}},
+		{"across 180", across, []string{"insert w"}},
+	}
+	for _, tt := range tests {
+		if got := received(tt.ch); !equalStrings(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestChangeRects(t *testing.T) {
+	q := newTestQuery()
+	loadTestLayer(t, q, testConfLayer(t, BackendMemory, map[string]string{
+		"a": testFeature("a", square0),
+	}))
+	ch := subscribe(t, q, "")
+
+	if _, _, err := q.Put("test", "a", parseTestFeature(t, testFeature("a", square5))); err != nil {
+		t.Fatal(err)
+	}
+	c := <-ch
+	want := [][4]float64{{0, 0, 1, 1}, {5, 5, 6, 6}}
+	if c.Op != ChangeUpdate || c.Layer != "test" || len(c.BBoxes) != 2 || c.BBoxes[0] != want[0] || c.BBoxes[1] != want[1] {
+		t.Errorf("change %+v, want the bboxes %v", c, want)
+	}
+
+	if err := q.Delete("test", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if next := <-ch; next.Seq <= c.Seq || next.Op != ChangeDelete {
+		t.Errorf("change %+v after %+v", next, c)
+	}
+}
+
+func TestSubscriberFallsBehind(t *testing.T) {
+	q := newTestQuery()
+	loadTestLayer(t, q, testConfLayer(t, BackendMemory, nil))
+	ch := subscribe(t, q, "")
+
+	for i := 0; i <= changeBuffer; i++ {
+		q.publish("test", ChangeInsert, "a", []orb.Bound{bound(0, 0, 1, 1)})
+	}
+
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != changeBuffer {
+		t.Errorf("%d changes before the channel was closed, want %d", n, changeBuffer)
+	}
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	q := newTestQuery()
+	loadTestLayer(t, q, testConfLayer(t, BackendMemory, nil))
+
+	ch, cancel, err := q.Subscribe("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Error("channel of a canceled subscription isn't closed")
+	}
+	q.publish("test", ChangeInsert, "a", []orb.Bound{bound(0, 0, 1, 1)})
+
+	if _, _, err := q.Subscribe("", nil); err != ErrQueryMissingLayer {
+		t.Errorf("subscribe without a layer returned %v, want %v", err, ErrQueryMissingLayer)
+	}
+	if _, _, err := q.Subscribe("missing", nil); err != ErrQueryInvalidLayer {
+		t.Errorf("subscribe to a missing layer returned %v, want %v", err, ErrQueryInvalidLayer)
+	}
+}
+
+func TestParseBBox(t *testing.T) {
+	for bb, valid := range map[string]bool{
+		"0,0,1,1":          true,
+		"170,-20,-170,-10": true,
+		"0,1,1,0":          false,
+		"0,0,1":            false,
+		"a,0,1,1":          false,
+	} {
+		if _, err := ParseBBox(bb); (err == nil) != valid {
+			t.Errorf("bbox %s: %v", bb, err)
+		}
+	}
+}
+
+func TestChangesInWriteOrder(t *testing.T) {
+	q := newTestQuery()
+	loadTestLayer(t, q, testConfLayer(t, BackendMemory, map[string]string{
+		"a": testFeature("a", square0),
+	}))
+	ch := subscribe(t, q, "")
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				x := float64(g*25+i) / 2
+				coords := fmt.Sprintf("[[%g,0],[%g,0],[%g,0.25],[%g,0]]", x, x+0.25, x+0.25, x)
+				if _, _, err := q.Put("test", "a", parseTestFeature(t, testFeature("a", coords))); err != nil {
+					t.Error(err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	// each update replaces the feature of the change before it
+	last := [4]float64{0, 0, 1, 1}
+	for n := 0; n < 200; n++ {
+		c := <-ch
+		if c.Op != ChangeUpdate || len(c.BBoxes) != 2 || c.BBoxes[0] != last {
+			t.Fatalf("change %d replaced %v, want %v", n, c.BBoxes, last)
+		}
+		last = c.BBoxes[1]
+	}
+
+	features, err := q.ID(context.Background(), "test", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := (*features)[0].Geometry.Bound()
+	if got := [4]float64{b.Min[0], b.Min[1], b.Max[0], b.Max[1]}; got != last {
+		t.Errorf("last change %v, feature is at %v", last, got)
+	}
+}
@@ -0,0 +1,471 @@
+package data
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"github.com/paulmach/orb/project"
+)
+
+// crs transforms coordinates between a coordinate reference system and WGS84 (lon/lat).
+// Datum shifts are not applied, so NAD83 and ETRS89 are treated as WGS84 (< 2m).
+type crs struct {
+	name      string
+	toWGS84   orb.Projection
+	fromWGS84 orb.Projection
+}
+
+// epsg maps supported EPSG codes to proj definitions
+var epsg = map[int]string{
+	4326:   "+proj=longlat +ellps=WGS84",
+	4269:   "+proj=longlat +ellps=GRS80",
+	4258:   "+proj=longlat +ellps=GRS80",
+	3857:   "+proj=webmerc",
+	3785:   "+proj=webmerc",
+	900913: "+proj=webmerc",
+	102100: "+proj=webmerc",
+	// state planes (NAD83)
+	2227:  "+proj=lcc +lat_1=38.43333333333333 +lat_2=37.06666666666667 +lat_0=36.5 +lon_0=-120.5 +x_0=2000000.0001016 +y_0=500000.0001016001 +ellps=GRS80 +units=us-ft",
+	2229:  "+proj=lcc +lat_1=35.46666666666667 +lat_2=34.03333333333333 +lat_0=33.5 +lon_0=-118 +x_0=2000000.0001016 +y_0=500000.0001016001 +ellps=GRS80 +units=us-ft",
+	2230:  "+proj=lcc +lat_1=33.88333333333333 +lat_2=32.78333333333333 +lat_0=32.16666666666666 +lon_0=-116.25 +x_0=2000000.0001016 +y_0=500000.0001016001 +ellps=GRS80 +units=us-ft",
+	2236:  "+proj=tmerc +lat_0=24.33333333333333 +lon_0=-81 +k=0.999941177 +x_0=200000.0001016002 +y_0=0 +ellps=GRS80 +units=us-ft",
+	2249:  "+proj=lcc +lat_1=42.68333333333333 +lat_2=41.71666666666667 +lat_0=41 +lon_0=-71.5 +x_0=200000.0001016002 +y_0=750000 +ellps=GRS80 +units=us-ft",
+	2263:  "+proj=lcc +lat_1=41.03333333333333 +lat_2=40.66666666666666 +lat_0=40.16666666666666 +lon_0=-74 +x_0=300000.0000000001 +y_0=0 +ellps=GRS80 +units=us-ft",
+	2272:  "+proj=lcc +lat_1=40.96666666666667 +lat_2=39.93333333333333 +lat_0=39.33333333333334 +lon_0=-77.75 +x_0=600000 +y_0=0 +ellps=GRS80 +units=us-ft",
+	2278:  "+proj=lcc +lat_1=30.28333333333333 +lat_2=28.38333333333333 +lat_0=27.83333333333333 +lon_0=-99 +x_0=600000 +y_0=3999999.9998984 +ellps=GRS80 +units=us-ft",
+	3435:  "+proj=tmerc +lat_0=36.66666666666666 +lon_0=-88.33333333333333 +k=0.9999749999999999 +x_0=300000.0000000001 +y_0=0 +ellps=GRS80 +units=us-ft",
+	32118: "+proj=lcc +lat_1=41.03333333333333 +lat_2=40.66666666666666 +lat_0=40.16666666666666 +lon_0=-74 +x_0=300000 +y_0=0 +ellps=GRS80",
+	// RGF93 / Lambert-93
+	2154: "+proj=lcc +lat_1=49 +lat_2=44 +lat_0=46.5 +lon_0=3 +x_0=700000 +y_0=6600000 +ellps=GRS80",
+}
+
+// parseCRS accepts an EPSG code (EPSG:2263, urn:ogc:def:crs:EPSG::2263)
+// or a proj definition (+proj=lcc +lat_1=... ) of a supported projection.
+// UTM zones are supported for WGS84 (326xx, 327xx), NAD83 (269xx) and ETRS89 (258xx).
+func parseCRS(s string) (*crs, error) {
+
+	s = strings.TrimSpace(s)
+
+	if s == "" {
+		return nil, fmt.Errorf("missing crs")
+	}
+
+	if strings.HasPrefix(s, "+") {
+		return parseProj(s, s)
+	}
+
+	upper := strings.ToUpper(s)
+	if upper == "CRS84" || upper == "OGC:CRS84" || upper == "URN:OGC:DEF:CRS:OGC:1.3:CRS84" {
+		return parseProj(s, epsg[4326])
+	}
+
+	i := strings.LastIndex(upper, "EPSG:")
+	if i < 0 {
+		return nil, fmt.Errorf("unsupported crs %s", s)
+	}
+	code, err := strconv.Atoi(strings.TrimLeft(upper[i+len("EPSG:"):], ":"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid crs %s", s)
+	}
+
+	if def, ok := epsg[code]; ok {
+		return parseProj(s, def)
+	}
+
+	zone := code % 100
+	switch {
+	case code > 32600 && code <= 32660:
+		return parseProj(s, fmt.Sprintf("+proj=utm +zone=%d +ellps=WGS84", zone))
+	case code > 32700 && code <= 32760:
+		return parseProj(s, fmt.Sprintf("+proj=utm +zone=%d +south +ellps=WGS84", zone))
+	case code >= 26903 && code <= 26923:
+		return parseProj(s, fmt.Sprintf("+proj=utm +zone=%d +ellps=GRS80", zone))
+	case code >= 25828 && code <= 25838:
+		return parseProj(s, fmt.Sprintf("+proj=utm +zone=%d +ellps=GRS80", zone))
+	}
+
+	return nil, fmt.Errorf("unsupported crs %s", s)
+}
+
+func parseProj(name, def string) (*crs, error) {
+
+	params := make(map[string]string)
+	for _, p := range strings.Fields(def) {
+		kv := strings.SplitN(strings.TrimPrefix(p, "+"), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = kv[1]
+		} else {
+			params[kv[0]] = ""
+		}
+	}
+
+	num := func(key string, dflt float64) (float64, error) {
+		v, ok := params[key]
+		if !ok {
+			return dflt, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid crs parameter %s=%s", key, v)
+		}
+		return f, nil
+	}
+
+	e := ellipsoid{a: 6378137, f: 1 / 298.257223563}
+	switch params["ellps"] {
+	case "", "WGS84":
+	case "GRS80":
+		e.f = 1 / 298.257222101
+	default:
+		return nil, fmt.Errorf("unsupported ellipsoid %s", params["ellps"])
+	}
+
+	toMeter := 1.0
+	switch params["units"] {
+	case "", "m":
+	case "us-ft":
+		toMeter = 1200.0 / 3937.0
+	case "ft":
+		toMeter = 0.3048
+	default:
+		return nil, fmt.Errorf("unsupported units %s", params["units"])
+	}
+
+	var err error
+	if toMeter, err = num("to_meter", toMeter); err != nil {
+		return nil, err
+	}
+
+	var p projector
+
+	switch params["proj"] {
+	case "longlat", "latlong":
+		return &crs{
+			name:      name,
+			toWGS84:   func(pt orb.Point) orb.Point { return pt },
+			fromWGS84: func(pt orb.Point) orb.Point { return pt },
+		}, nil
+	case "webmerc":
+		return &crs{
+			name:      name,
+			toWGS84:   project.Mercator.ToWGS84,
+			fromWGS84: project.WGS84.ToMercator,
+		}, nil
+	case "utm":
+		zone, err := num("zone", 0)
+		if err != nil {
+			return nil, err
+		}
+		if zone < 1 || zone > 60 {
+			return nil, fmt.Errorf("invalid utm zone")
+		}
+		falseNorthing := 0.0
+		if _, ok := params["south"]; ok {
+			falseNorthing = 10000000
+		}
+		p = newTransverseMercator(e, 0, zone*6-183, 0.9996)
+		return newCRS(name, p, 500000, falseNorthing, toMeter), nil
+	case "tmerc":
+		vals, err := nums(num, "lat_0", "lon_0", "k", "x_0", "y_0")
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := params["k"]; !ok {
+			if vals[2], err = num("k_0", 1); err != nil {
+				return nil, err
+			}
+		}
+		p = newTransverseMercator(e, vals[0], vals[1], vals[2])
+		return newCRS(name, p, vals[3], vals[4], toMeter), nil
+	case "lcc":
+		vals, err := nums(num, "lat_0", "lon_0", "lat_1", "lat_2", "x_0", "y_0")
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := params["lat_1"]; !ok {
+			vals[2] = vals[0]
+		}
+		if _, ok := params["lat_2"]; !ok {
+			vals[3] = vals[2]
+		}
+		k0, err := num("k_0", 1)
+		if err != nil {
+			return nil, err
+		}
+		p = newLambertConformalConic(e, vals[0], vals[1], vals[2], vals[3], k0)
+		return newCRS(name, p, vals[4], vals[5], toMeter), nil
+	default:
+		return nil, fmt.Errorf("unsupported projection %s", params["proj"])
+	}
+}
+
+func nums(num func(string, float64) (float64, error), keys ...string) ([]float64, error) {
+	vals := make([]float64, len(keys))
+	for i, k := range keys {
+		v, err := num(k, 0)
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+// newCRS wraps a projector, which works in meters relative to
+// its origin, with false easting/northing and linear units
+func newCRS(name string, p projector, x0, y0, toMeter float64) *crs {
+	return &crs{
+		name: name,
+		toWGS84: func(pt orb.Point) orb.Point {
+			lon, lat := p.inverse(pt[0]*toMeter-x0, pt[1]*toMeter-y0)
+			return orb.Point{lon, lat}
+		},
+		fromWGS84: func(pt orb.Point) orb.Point {
+			x, y := p.forward(pt[0], pt[1])
+			return orb.Point{(x + x0) / toMeter, (y + y0) / toMeter}
+		},
+	}
+}
+
+// toWGS84Feature transforms the geometry of a feature read from the data dir in place
+func (c *crs) toWGS84Feature(f *geojson.Feature) {
+	if c == nil || f.Geometry == nil {
+		return
+	}
+	f.Geometry = project.Geometry(f.Geometry, c.toWGS84)
+}
+
+// fromWGS84Feature returns a copy of a WGS84 feature transformed
+// to the crs, to be written to the data dir
+func (c *crs) fromWGS84Feature(f *geojson.Feature) *geojson.Feature {
+	if c == nil || f.Geometry == nil {
+		return f
+	}
+	cf := *f
+	cf.Geometry = project.Geometry(orb.Clone(f.Geometry), c.fromWGS84)
+	cf.BBox = nil
+	return &cf
+}
+
+// ProjectFeatures transforms WGS84 features to the given crs.
+// Geometries are cloned so that features shared with the layer are left untouched.
+func ProjectFeatures(features *[]geojson.Feature, s string) error {
+
+	proj, err := FeatureProjection(s)
+	if err != nil {
+		return err
+	}
+
+	for i, f := range *features {
+		(*features)[i] = proj(f)
+	}
+
+	return nil
+}
+
+// FeatureProjection returns a func that transforms a WGS84 feature to the given crs,
+// or leaves it as is if the crs is empty
+func FeatureProjection(s string) (func(f geojson.Feature) geojson.Feature, error) {
+
+	if s == "" {
+		return func(f geojson.Feature) geojson.Feature { return f }, nil
+	}
+
+	c, err := parseCRS(s)
+	if err != nil {
+		return nil, ErrQueryInvalidCRS
+	}
+
+	return func(f geojson.Feature) geojson.Feature {
+		if f.Geometry == nil {
+			return f
+		}
+		f.Geometry = project.Geometry(orb.Clone(f.Geometry), c.fromWGS84)
+		f.BBox = nil
+		return f
+	}, nil
+}
+
+/////////////////////////////////////////////////////////////////////
+
+type projector interface {
+	forward(lon, lat float64) (x, y float64)
+	inverse(x, y float64) (lon, lat float64)
+}
+
+type ellipsoid struct {
+	a float64
+	f float64
+}
+
+func (e ellipsoid) e2() float64 {
+	return e.f * (2 - e.f)
+}
+
+func deg2rad(d float64) float64 {
+	return d * math.Pi / 180
+}
+
+func rad2deg(r float64) float64 {
+	return r * 180 / math.Pi
+}
+
+// transverseMercator follows Snyder, Map Projections - A Working Manual (1987), p. 60-64
+type transverseMercator struct {
+	a, e2, ep2, k0 float64
+	lat0, lon0     float64
+	m0             float64
+}
+
+func newTransverseMercator(e ellipsoid, lat0, lon0, k0 float64) *transverseMercator {
+	e2 := e.e2()
+	tm := &transverseMercator{
+		a:    e.a,
+		e2:   e2,
+		ep2:  e2 / (1 - e2),
+		k0:   k0,
+		lat0: deg2rad(lat0),
+		lon0: deg2rad(lon0),
+	}
+	tm.m0 = tm.meridian(tm.lat0)
+	return tm
+}
+
+func (tm *transverseMercator) meridian(phi float64) float64 {
+	e2, e4, e6 := tm.e2, tm.e2*tm.e2, tm.e2*tm.e2*tm.e2
+	return tm.a * ((1-e2/4-3*e4/64-5*e6/256)*phi -
+		(3*e2/8+3*e4/32+45*e6/1024)*math.Sin(2*phi) +
+		(15*e4/256+45*e6/1024)*math.Sin(4*phi) -
+		(35*e6/3072)*math.Sin(6*phi))
+}
+
+func (tm *transverseMercator) forward(lon, lat float64) (float64, float64) {
+
+	phi := deg2rad(lat)
+	sin, cos, tan := math.Sin(phi), math.Cos(phi), math.Tan(phi)
+
+	n := tm.a / math.Sqrt(1-tm.e2*sin*sin)
+	t := tan * tan
+	c := tm.ep2 * cos * cos
+	a := (deg2rad(lon) - tm.lon0) * cos
+	m := tm.meridian(phi)
+
+	x := tm.k0 * n * (a +
+		(1-t+c)*math.Pow(a, 3)/6 +
+		(5-18*t+t*t+72*c-58*tm.ep2)*math.Pow(a, 5)/120)
+
+	y := tm.k0 * (m - tm.m0 + n*tan*(a*a/2+
+		(5-t+9*c+4*c*c)*math.Pow(a, 4)/24+
+		(61-58*t+t*t+600*c-330*tm.ep2)*math.Pow(a, 6)/720))
+
+	return x, y
+}
+
+func (tm *transverseMercator) inverse(x, y float64) (float64, float64) {
+
+	e2, e4, e6 := tm.e2, tm.e2*tm.e2, tm.e2*tm.e2*tm.e2
+
+	m := tm.m0 + y/tm.k0
+	mu := m / (tm.a * (1 - e2/4 - 3*e4/64 - 5*e6/256))
+	e1 := (1 - math.Sqrt(1-e2)) / (1 + math.Sqrt(1-e2))
+
+	phi1 := mu +
+		(3*e1/2-27*math.Pow(e1, 3)/32)*math.Sin(2*mu) +
+		(21*e1*e1/16-55*math.Pow(e1, 4)/32)*math.Sin(4*mu) +
+		(151*math.Pow(e1, 3)/96)*math.Sin(6*mu) +
+		(1097*math.Pow(e1, 4)/512)*math.Sin(8*mu)
+
+	sin, cos, tan := math.Sin(phi1), math.Cos(phi1), math.Tan(phi1)
+
+	c1 := tm.ep2 * cos * cos
+	t1 := tan * tan
+	n1 := tm.a / math.Sqrt(1-e2*sin*sin)
+	r1 := tm.a * (1 - e2) / math.Pow(1-e2*sin*sin, 1.5)
+	d := x / (n1 * tm.k0)
+
+	phi := phi1 - (n1*tan/r1)*(d*d/2-
+		(5+3*t1+10*c1-4*c1*c1-9*tm.ep2)*math.Pow(d, 4)/24+
+		(61+90*t1+298*c1+45*t1*t1-252*tm.ep2-3*c1*c1)*math.Pow(d, 6)/720)
+
+	lambda := tm.lon0 + (d-
+		(1+2*t1+c1)*math.Pow(d, 3)/6+
+		(5-2*c1+28*t1-3*c1*c1+8*tm.ep2+24*t1*t1)*math.Pow(d, 5)/120)/cos
+
+	return rad2deg(lambda), rad2deg(phi)
+}
+
+// lambertConformalConic follows Snyder, Map Projections - A Working Manual (1987), p. 104-110
+type lambertConformalConic struct {
+	a, e       float64
+	n, f, rho0 float64
+	lon0       float64
+}
+
+func newLambertConformalConic(e ellipsoid, lat0, lon0, lat1, lat2, k0 float64) *lambertConformalConic {
+
+	lcc := &lambertConformalConic{
+		a:    e.a,
+		e:    math.Sqrt(e.e2()),
+		lon0: deg2rad(lon0),
+	}
+
+	phi0, phi1, phi2 := deg2rad(lat0), deg2rad(lat1), deg2rad(lat2)
+
+	m1, m2 := lcc.m(phi1), lcc.m(phi2)
+	t0, t1, t2 := lcc.t(phi0), lcc.t(phi1), lcc.t(phi2)
+
+	if phi1 == phi2 {
+		lcc.n = math.Sin(phi1)
+	} else {
+		lcc.n = (math.Log(m1) - math.Log(m2)) / (math.Log(t1) - math.Log(t2))
+	}
+	lcc.f = k0 * m1 / (lcc.n * math.Pow(t1, lcc.n))
+	lcc.rho0 = lcc.a * lcc.f * math.Pow(t0, lcc.n)
+
+	return lcc
+}
+
+func (lcc *lambertConformalConic) m(phi float64) float64 {
+	sin := math.Sin(phi)
+	return math.Cos(phi) / math.Sqrt(1-lcc.e*lcc.e*sin*sin)
+}
+
+func (lcc *lambertConformalConic) t(phi float64) float64 {
+	esin := lcc.e * math.Sin(phi)
+	return math.Tan(math.Pi/4-phi/2) / math.Pow((1-esin)/(1+esin), lcc.e/2)
+}
+
+func (lcc *lambertConformalConic) forward(lon, lat float64) (float64, float64) {
+	rho := lcc.a * lcc.f * math.Pow(lcc.t(deg2rad(lat)), lcc.n)
+	theta := lcc.n * (deg2rad(lon) - lcc.lon0)
+	return rho * math.Sin(theta), lcc.rho0 - rho*math.Cos(theta)
+}
+
+func (lcc *lambertConformalConic) inverse(x, y float64) (float64, float64) {
+
+	sign := 1.0
+	if lcc.n < 0 {
+		sign = -1.0
+	}
+
+	rho := sign * math.Sqrt(x*x+(lcc.rho0-y)*(lcc.rho0-y))
+	theta := math.Atan2(sign*x, sign*(lcc.rho0-y))
+	t := math.Pow(rho/(lcc.a*lcc.f), 1/lcc.n)
+
+	phi := math.Pi/2 - 2*math.Atan(t)
+	for i := 0; i < 15; i++ {
+		esin := lcc.e * math.Sin(phi)
+		next := math.Pi/2 - 2*math.Atan(t*math.Pow((1-esin)/(1+esin), lcc.e/2))
+		if math.Abs(next-phi) < 1e-12 {
+			phi = next
+			break
+		}
+		phi = next
+	}
+
+	return rad2deg(theta/lcc.n + lcc.lon0), rad2deg(phi)
+}
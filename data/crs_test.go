@@ -0,0 +1,145 @@
+package data
+
+import (
+	"math"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// lambert93 is the definition of EPSG:2154 (RGF93 / Lambert-93)
+const lambert93 = "+proj=lcc +lat_0=46.5 +lon_0=3 +lat_1=49 +lat_2=44 +x_0=700000 +y_0=6600000 +ellps=GRS80 +units=m"
+
+func TestParseCRS(t *testing.T) {
+	valid := []string{
+		"EPSG:4326",
+		"epsg:3857",
+		"urn:ogc:def:crs:EPSG::2263",
+		"urn:ogc:def:crs:OGC:1.3:CRS84",
+		"EPSG:32633",
+		"EPSG:32733",
+		"EPSG:26918",
+		"EPSG:25832",
+		"+proj=utm +zone=33 +ellps=WGS84",
+		"EPSG:2154",
+		lambert93,
+	}
+	for _, s := range valid {
+		if _, err := parseCRS(s); err != nil {
+			t.Errorf("%s: %v", s, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"EPSG:1",
+		"EPSG:abc",
+		"EPSG:32661",
+		"WGS84",
+		"+proj=merc +ellps=WGS84",
+		"+proj=utm +zone=61",
+		"+proj=utm +zone=33 +ellps=clrk66",
+		"+proj=tmerc +lon_0=3 +units=km",
+		"+proj=lcc +lat_1=x",
+	}
+	for _, s := range invalid {
+		if _, err := parseCRS(s); err == nil {
+			t.Errorf("%s was parsed", s)
+		}
+	}
+}
+
+func TestCRSKnownCoordinates(t *testing.T) {
+	tests := []struct {
+		crs      string
+		lon, lat float64
+		x, y     float64
+		tol      float64
+	}{
+		// projection origins, which are defined by their false easting and northing
+		{"EPSG:32633", 15, 0, 500000, 0, 1e-6},
+		{"EPSG:32733", 15, 0, 500000, 10000000, 1e-6},
+		{"EPSG:2154", 3, 46.5, 700000, 6600000, 1e-6},
+		{lambert93, 3, 46.5, 700000, 6600000, 1e-6},
+		{"EPSG:2263", -74, 40.16666666666666, 984250, 0, 1e-3},
+		// on the central meridian, y is the scaled length of the meridian arc (4984944.378m to 45°)
+		{"EPSG:32633", 15, 45, 500000, 0.9996 * 4984944.378, 0.01},
+		{"EPSG:32733", 15, -45, 500000, 10000000 - 0.9996*4984944.378, 0.01},
+		// the edge of the web mercator square
+		{"EPSG:3857", 180, 0, 20037508.342789244, 0, 1e-6},
+		{"EPSG:4326", 2.35, 48.85, 2.35, 48.85, 0},
+	}
+
+	for _, tt := range tests {
+		c, err := parseCRS(tt.crs)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.crs, err)
+		}
+		pt := c.fromWGS84(orb.Point{tt.lon, tt.lat})
+		if math.Abs(pt[0]-tt.x) > tt.tol || math.Abs(pt[1]-tt.y) > tt.tol {
+			t.Errorf("%s: %v,%v projected to %v, want %v,%v", tt.crs, tt.lon, tt.lat, pt, tt.x, tt.y)
+		}
+		back := c.toWGS84(orb.Point{tt.x, tt.y})
+		if math.Abs(back[0]-tt.lon) > 1e-7 || math.Abs(back[1]-tt.lat) > 1e-7 {
+			t.Errorf("%s: %v,%v unprojected to %v, want %v,%v", tt.crs, tt.x, tt.y, back, tt.lon, tt.lat)
+		}
+	}
+}
+
+func TestCRSRoundTrip(t *testing.T) {
+	tests := []struct {
+		crs    string
+		points []orb.Point
+	}{
+		{"EPSG:32633", []orb.Point{{12, 52.5}, {16.37, 48.21}, {17.9, 0.5}}},
+		{"EPSG:32733", []orb.Point{{13.23, -8.84}, {17, -33.9}}},
+		{"EPSG:26918", []orb.Point{{-74.006, 40.7128}, {-77.03, 38.9}}},
+		{"EPSG:25832", []orb.Point{{9.99, 53.55}, {7.1, 50.7}}},
+		{"EPSG:2154", []orb.Point{{2.3522, 48.8566}, {-1.68, 48.11}, {7.26, 43.7}}},
+		{"EPSG:2263", []orb.Point{{-73.9857, 40.7484}, {-73.7781, 40.6413}}},
+		{"EPSG:2236", []orb.Point{{-80.19, 25.76}, {-81.38, 28.54}}},
+		{"EPSG:3857", []orb.Point{{-122.42, 37.77}, {151.21, -33.87}}},
+	}
+
+	for _, tt := range tests {
+		c, err := parseCRS(tt.crs)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.crs, err)
+		}
+		for _, pt := range tt.points {
+			back := c.toWGS84(c.fromWGS84(pt))
+			if math.Abs(back[0]-pt[0]) > 1e-8 || math.Abs(back[1]-pt[1]) > 1e-8 {
+				t.Errorf("%s: %v round-tripped to %v", tt.crs, pt, back)
+			}
+		}
+	}
+}
+
+func TestCRSFeatures(t *testing.T) {
+	c, err := parseCRS("EPSG:32633")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := geojson.NewFeature(orb.Point{15, 45})
+	projected := c.fromWGS84Feature(f)
+	if projected == f || f.Geometry.(orb.Point) != (orb.Point{15, 45}) {
+		t.Fatal("feature was projected in place")
+	}
+	c.toWGS84Feature(projected)
+	if pt := projected.Geometry.(orb.Point); math.Abs(pt[0]-15) > 1e-8 || math.Abs(pt[1]-45) > 1e-8 {
+		t.Errorf("feature round-tripped to %v", pt)
+	}
+
+	features := []geojson.Feature{*geojson.NewFeature(orb.Point{3, 46.5})}
+	if err := ProjectFeatures(&features, "EPSG:1"); err != ErrQueryInvalidCRS {
+		t.Errorf("projection to an unsupported crs returned %v, want %v", err, ErrQueryInvalidCRS)
+	}
+	if err := ProjectFeatures(&features, "EPSG:2154"); err != nil {
+		t.Fatal(err)
+	}
+	if pt := features[0].Geometry.(orb.Point); math.Abs(pt[0]-700000) > 1e-6 || math.Abs(pt[1]-6600000) > 1e-6 {
+		t.Errorf("feature projected to %v", pt)
+	}
+}
@@ -1,11 +1,12 @@
 package data
 
 import (
+	"fmt"
+	"net/url"
 	"strconv"
 	"strings"
 
 	"github.com/paulmach/orb"
-	"github.com/tidwall/buntdb"
 )
 
 func dbPointBounds(p orb.Point) string {
@@ -50,13 +51,33 @@ func dbPolyBounds(b orb.Bound) string {
 	return bounds
 }
 
-func dbUpdate(db *buntdb.DB, index, id, bounds string) error {
-	return db.Update(func(tx *buntdb.Tx) error {
-		k := dbKey(index, id)
-		v := bounds
-		tx.Set(k, v, nil)
-		return nil
-	})
+func dbBounds(b orb.Bound) string {
+	if b.Min == b.Max {
+		return dbPointBounds(b.Min)
+	}
+	return dbPolyBounds(b)
+}
+
+// dbParseBounds parses a rect written by dbPointBounds or dbPolyBounds
+func dbParseBounds(v string) (orb.Bound, error) {
+	var nums []float64
+	for _, f := range strings.FieldsFunc(v, func(r rune) bool {
+		return r == '[' || r == ']' || r == ',' || r == ' '
+	}) {
+		n, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return orb.Bound{}, err
+		}
+		nums = append(nums, n)
+	}
+	switch len(nums) {
+	case 2:
+		return orb.Point{nums[0], nums[1]}.Bound(), nil
+	case 4:
+		return orb.Bound{Min: orb.Point{nums[0], nums[1]}, Max: orb.Point{nums[2], nums[3]}}, nil
+	default:
+		return orb.Bound{}, fmt.Errorf("invalid rect %s", v)
+	}
 }
 
 func dbPattern(index string) string {
@@ -67,16 +88,127 @@ func dbPattern(index string) string {
 	return pattern
 }
 
+// dbKey escapes the id so that it never contains the key separator,
+// which lets arbitrary ids (colons, slashes, unicode) round-trip through dbParseKey
 func dbKey(index, id string) string {
 	var sb strings.Builder
 	sb.WriteString(index)
 	sb.WriteString(":")
-	sb.WriteString(id)
+	sb.WriteString(url.QueryEscape(id))
 	key := sb.String()
 	return key
 }
 
-func dbParseKey(key string) (string, string) {
-	k := strings.Split(key, ":")
-	return k[0], k[1]
+func dbPartKey(index, id string, part int) string {
+	if part == 0 {
+		return dbKey(index, id)
+	}
+	var sb strings.Builder
+	sb.WriteString(dbKey(index, id))
+	sb.WriteString(":")
+	sb.WriteString(strconv.Itoa(part))
+	key := sb.String()
+	return key
+}
+
+// dbFileKey is kept outside of the dbPattern keyspace
+// so that it isn't picked up by the spatial index
+func dbFileKey(index, id string) string {
+	var sb strings.Builder
+	sb.WriteString(index)
+	sb.WriteString(".file:")
+	sb.WriteString(url.QueryEscape(id))
+	key := sb.String()
+	return key
+}
+
+func dbFilePattern(index string) string {
+	var sb strings.Builder
+	sb.WriteString(index)
+	sb.WriteString(".file:*")
+	pattern := sb.String()
+	return pattern
+}
+
+// dbFormatKey marks databases whose keys escape ids (see dbKey).
+// Databases created before ids were escaped have neither a format key nor file keys.
+func dbFormatKey(index string) string {
+	return index + ".format"
+}
+
+// dbFormat is the current version of the key format
+const dbFormat = "1"
+
+// dbVersionKey counts the writes to an index, like the version key of bolt databases
+func dbVersionKey(index string) string {
+	return index + ".version"
+}
+
+// termKey is the key of an entry's search term (see searchTerms), followed by its escaped id.
+// Neither contains a space, so the keys of a term sort together, before those of longer terms.
+func termKey(term, id string) string {
+	return term + " " + url.QueryEscape(id)
+}
+
+// termPrefix starts the keys of a term, or of every term starting with it if prefix is set
+func termPrefix(term string, prefix bool) string {
+	if prefix {
+		return term
+	}
+	return term + " "
+}
+
+func parseTermKey(key string) (string, error) {
+	i := strings.LastIndex(key, " ")
+	if i < 0 {
+		return "", fmt.Errorf("not a term key: %s", key)
+	}
+	return url.QueryUnescape(key[i+1:])
+}
+
+// dbTermKey is kept outside of the dbPattern keyspace, like dbFileKey
+func dbTermKey(index, term, id string) string {
+	return index + ".term:" + termKey(term, id)
+}
+
+func dbTermPrefix(index, term string, prefix bool) string {
+	return index + ".term:" + termPrefix(term, prefix)
+}
+
+// dbTermsKey lists the terms of an entry, separated by spaces, so that they can be deleted
+func dbTermsKey(index, id string) string {
+	return index + ".terms:" + url.QueryEscape(id)
+}
+
+// dbParseKey returns the id of a key or part key
+func dbParseKey(index, key string) (string, error) {
+	id, _, err := dbParseKeyPart(index, key)
+	return id, err
+}
+
+func dbParseKeyPart(index, key string) (string, int, error) {
+	prefix := index + ":"
+	if !strings.HasPrefix(key, prefix) {
+		return "", 0, fmt.Errorf("key not in index %s", index)
+	}
+	id := strings.TrimPrefix(key, prefix)
+	part := 0
+	if i := strings.Index(id, ":"); i >= 0 {
+		p, err := strconv.Atoi(id[i+1:])
+		if err != nil {
+			return "", 0, err
+		}
+		id, part = id[:i], p
+	}
+	id, err := url.QueryUnescape(id)
+	return id, part, err
+}
+
+// dbParseFileKey returns the id of a file key
+func dbParseFileKey(index, key string) (string, error) {
+	prefix := index + ".file:"
+	if !strings.HasPrefix(key, prefix) {
+		return "", fmt.Errorf("key not in index %s", index)
+	}
+	return url.QueryUnescape(strings.TrimPrefix(key, prefix))
 }
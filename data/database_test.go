@@ -0,0 +1,105 @@
+package data
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb"
+)
+
+var testIDs = []string{"a", "parcel:12", "a:1", "roads/i-90", "100%", "with space", "Zürich", "::", "?*"}
+
+func TestDBKeyRoundTrip(t *testing.T) {
+	for _, id := range testIDs {
+		for _, part := range []int{0, 1, 12} {
+			key := dbPartKey("test", id, part)
+			if strings.Count(key, ":") > 2 {
+				t.Errorf("key of %q has separators in its id: %s", id, key)
+			}
+			gotID, gotPart, err := dbParseKeyPart("test", key)
+			if err != nil || gotID != id || gotPart != part {
+				t.Errorf("%q part %d: parsed %q part %d, %v", id, part, gotID, gotPart, err)
+			}
+		}
+		if fk := dbFileKey("test", id); strings.HasPrefix(fk, "test:") {
+			t.Errorf("file key of %q is in the index keyspace: %s", id, fk)
+		}
+	}
+
+	if _, err := dbParseKey("test", "other:a"); err == nil {
+		t.Error("parsed a key of another index")
+	}
+	if _, _, err := dbParseKeyPart("test", "test:a:x"); err == nil {
+		t.Error("parsed a key with an invalid part")
+	}
+}
+
+func TestDBBoundsRoundTrip(t *testing.T) {
+	for _, b := range []orb.Bound{
+		{Min: orb.Point{-73.98, 40.75}, Max: orb.Point{-73.97, 40.76}},
+		{Min: orb.Point{1, 2}, Max: orb.Point{1, 2}},
+		{Min: orb.Point{-180, -90}, Max: orb.Point{180, 90}},
+		{Min: orb.Point{0.1, 1e-9}, Max: orb.Point{0.30000000000000004, 2}},
+	} {
+		got, err := dbParseBounds(dbBounds(b))
+		if err != nil || got != b {
+			t.Errorf("%v: parsed %v, %v", b, got, err)
+		}
+	}
+	if _, err := dbParseBounds("[1 2 3]"); err == nil {
+		t.Error("parsed bounds of 3 numbers")
+	}
+}
+
+func TestLoadLayerEscapedIDs(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			files := map[string]string{}
+			for i, id := range testIDs {
+				files[string(rune('a'+i))] = testFeature(id, square0)
+			}
+			q := newTestQuery()
+			loadTestLayer(t, q, testConfLayer(t, backend, files))
+
+			for _, id := range testIDs {
+				features, err := q.ID(context.Background(), "test", id)
+				if err != nil || len(*features) != 1 || fid(&(*features)[0], "ID") != id {
+					t.Errorf("id query of %q returned %v", id, err)
+				}
+			}
+
+			features, err := q.BBox(context.Background(), "test", "0,0,1,1")
+			if err != nil || len(*features) != len(testIDs) {
+				t.Errorf("bbox query returned %d features, %v", len(*features), err)
+			}
+		})
+	}
+}
+
+func TestAddDataSkipsEmptyAndDuplicateIDs(t *testing.T) {
+	confLayer := testConfLayer(t, BackendBuntDB, map[string]string{
+		"a":     testFeature("a", square0),
+		"copy":  testFeature("a", square5),
+		"empty": testFeature("", square0),
+		"b":     testFeature("b", square5),
+	})
+	createTestDatabase(t, confLayer, RepairNone)
+
+	l := NewLayer(confLayer)
+	if err := l.OpenDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	defer l.CloseDatabase()
+
+	if n, _ := l.store.Count(); n != 2 {
+		t.Errorf("%d features indexed, want 2", n)
+	}
+	file, err := l.store.Get("a")
+	if err != nil || (file != "a.geojson" && file != "copy.geojson") {
+		t.Errorf("feature a indexed from %q, %v", file, err)
+	}
+	if _, err := l.store.Get(""); err != errNotIndexed {
+		t.Errorf("feature with an empty id was indexed: %v", err)
+	}
+}
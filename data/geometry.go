@@ -1,12 +1,19 @@
 package data
 
 import (
+	"math"
+
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/maptile"
 	"github.com/paulmach/orb/planar"
+	"github.com/paulmach/orb/project"
 )
 
 func pointInGeometry(geom orb.Geometry, pt orb.Point) bool {
+	if crossesAntimeridian(geom) {
+		geom = project.Geometry(orb.Clone(geom), shiftLon)
+		pt = shiftLon(pt)
+	}
 	switch g := geom.(type) {
 	case orb.Polygon:
 		return planar.PolygonContains(g, pt)
@@ -79,3 +86,74 @@ func uptile(set maptile.Set, n int) maptile.Set {
 	}
 	return uptile(childSet, n-1)
 }
+
+// antimeridian
+
+// crossesAntimeridian reports whether any ring of a polygon jumps
+// more than 180° in longitude, ie. wraps around ±180° instead of spanning the globe
+func crossesAntimeridian(geom orb.Geometry) bool {
+	switch g := geom.(type) {
+	case orb.Polygon:
+		for _, r := range g {
+			for i := 1; i < len(r); i++ {
+				if math.Abs(r[i][0]-r[i-1][0]) > 180 {
+					return true
+				}
+			}
+		}
+	case orb.MultiPolygon:
+		for _, p := range g {
+			if crossesAntimeridian(p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shiftLon moves negative longitudes east by 360°, so that a geometry
+// crossing the antimeridian is continuous in the range [0°, 360°]
+func shiftLon(pt orb.Point) orb.Point {
+	if pt[0] < 0 {
+		return orb.Point{pt[0] + 360, pt[1]}
+	}
+	return pt
+}
+
+// splitAntimeridian splits a bound in the range [0°, 360°] at 180°
+func splitAntimeridian(b orb.Bound) []orb.Bound {
+	if b.Max.Lon() <= 180 {
+		return []orb.Bound{b}
+	}
+	if b.Min.Lon() >= 180 {
+		return []orb.Bound{{
+			Min: orb.Point{b.Min.Lon() - 360, b.Min.Lat()},
+			Max: orb.Point{b.Max.Lon() - 360, b.Max.Lat()},
+		}}
+	}
+	return []orb.Bound{
+		{Min: b.Min, Max: orb.Point{180, b.Max.Lat()}},
+		{Min: orb.Point{-180, b.Min.Lat()}, Max: orb.Point{b.Max.Lon() - 360, b.Max.Lat()}},
+	}
+}
+
+// geometryBounds returns the bound of a geometry, split in two if it crosses the antimeridian
+func geometryBounds(geom orb.Geometry) []orb.Bound {
+	if !crossesAntimeridian(geom) {
+		return []orb.Bound{geom.Bound()}
+	}
+	shifted := project.Geometry(orb.Clone(geom), shiftLon)
+	return splitAntimeridian(shifted.Bound())
+}
+
+// queryBounds returns the bound of a query bbox, split in two if it crosses the antimeridian,
+// ie. if its min longitude is greater than its max longitude (170,-20,-170,-10)
+func queryBounds(b orb.Bound) []orb.Bound {
+	if b.Min.Lon() <= b.Max.Lon() {
+		return []orb.Bound{b}
+	}
+	return splitAntimeridian(orb.Bound{
+		Min: b.Min,
+		Max: orb.Point{b.Max.Lon() + 360, b.Max.Lat()},
+	})
+}
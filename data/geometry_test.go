@@ -0,0 +1,161 @@
+package data
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/paulmach/orb"
+)
+
+// fiji crosses the antimeridian, from 177°E to 178°W
+var fiji = orb.Polygon{{{177, -20}, {-178, -20}, {-178, -15}, {177, -15}, {177, -20}}}
+
+func equalBounds(a, b []orb.Bound) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCrossesAntimeridian(t *testing.T) {
+	tests := []struct {
+		geom orb.Geometry
+		want bool
+	}{
+		{fiji, true},
+		{orb.MultiPolygon{orb.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}}, fiji}, true},
+		{orb.Polygon{{{-179, 0}, {179, 0}, {179, 1}, {-179, 0}}}, true},
+		{orb.Polygon{{{-90, 0}, {90, 0}, {90, 1}, {-90, 0}}}, false},
+		{orb.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}}, false},
+		{orb.Point{180, 0}, false},
+	}
+	for i, tt := range tests {
+		if got := crossesAntimeridian(tt.geom); got != tt.want {
+			t.Errorf("test %d: %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestGeometryBounds(t *testing.T) {
+	got := geometryBounds(fiji)
+	want := []orb.Bound{
+		{Min: orb.Point{177, -20}, Max: orb.Point{180, -15}},
+		{Min: orb.Point{-180, -20}, Max: orb.Point{-178, -15}},
+	}
+	if !equalBounds(got, want) {
+		t.Errorf("bounds of fiji: %v, want %v", got, want)
+	}
+
+	square := orb.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 1}, {0, 0}}}
+	if got := geometryBounds(square); !equalBounds(got, []orb.Bound{square.Bound()}) {
+		t.Errorf("bounds of a square: %v", got)
+	}
+}
+
+func TestSplitAntimeridian(t *testing.T) {
+	tests := []struct {
+		b    orb.Bound
+		want []orb.Bound
+	}{
+		{
+			orb.Bound{Min: orb.Point{10, 0}, Max: orb.Point{20, 1}},
+			[]orb.Bound{{Min: orb.Point{10, 0}, Max: orb.Point{20, 1}}},
+		},
+		{
+			orb.Bound{Min: orb.Point{170, 0}, Max: orb.Point{180, 1}},
+			[]orb.Bound{{Min: orb.Point{170, 0}, Max: orb.Point{180, 1}}},
+		},
+		{
+			orb.Bound{Min: orb.Point{185, 0}, Max: orb.Point{190, 1}},
+			[]orb.Bound{{Min: orb.Point{-175, 0}, Max: orb.Point{-170, 1}}},
+		},
+		{
+			orb.Bound{Min: orb.Point{170, 0}, Max: orb.Point{190, 1}},
+			[]orb.Bound{
+				{Min: orb.Point{170, 0}, Max: orb.Point{180, 1}},
+				{Min: orb.Point{-180, 0}, Max: orb.Point{-170, 1}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := splitAntimeridian(tt.b); !equalBounds(got, tt.want) {
+			t.Errorf("split of %v: %v, want %v", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestQueryBounds(t *testing.T) {
+	b := orb.Bound{Min: orb.Point{-10, -10}, Max: orb.Point{10, 10}}
+	if got := queryBounds(b); !equalBounds(got, []orb.Bound{b}) {
+		t.Errorf("bounds of %v: %v", b, got)
+	}
+
+	b = orb.Bound{Min: orb.Point{170, -20}, Max: orb.Point{-170, -10}}
+	want := []orb.Bound{
+		{Min: orb.Point{170, -20}, Max: orb.Point{180, -10}},
+		{Min: orb.Point{-180, -20}, Max: orb.Point{-170, -10}},
+	}
+	if got := queryBounds(b); !equalBounds(got, want) {
+		t.Errorf("bounds of %v: %v, want %v", b, got, want)
+	}
+}
+
+func TestAntimeridianQueries(t *testing.T) {
+	fijiFeature := testFeature("fiji", `[[177,-20],[-178,-20],[-178,-15],[177,-15],[177,-20]]`)
+	east := testFeature("east", `[[171,-19],[172,-19],[172,-18],[171,-18],[171,-19]]`)
+	west := testFeature("west", `[[-172,-19],[-171,-19],[-171,-18],[-172,-18],[-172,-19]]`)
+
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			loadTestLayer(t, q, testConfLayer(t, backend, map[string]string{
+				"fiji": fijiFeature,
+				"east": east,
+				"west": west,
+				"a":    testFeature("a", square0),
+			}))
+
+			tests := []struct {
+				bbox string
+				want []string
+			}{
+				{"170,-20,-170,-10", []string{"east", "fiji", "west"}},
+				{"179,-18,-179,-17", []string{"fiji"}},
+				{"-179.5,-18,-179,-17", []string{"fiji"}},
+				{"178,-18,179,-17", []string{"fiji"}},
+				{"-170,-20,170,2", []string{"a"}},
+			}
+			for _, tt := range tests {
+				features, err := q.BBox(context.Background(), "test", tt.bbox)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := []string{}
+				for i := range *features {
+					got = append(got, fid(&(*features)[i], "ID"))
+				}
+				sort.Strings(got)
+				if !equalStrings(got, tt.want) {
+					t.Errorf("bbox %s: %v, want %v", tt.bbox, got, tt.want)
+				}
+			}
+
+			// points on both sides of the antimeridian are in fiji
+			for _, pt := range []string{"179.5,-17", "-179.5,-17"} {
+				features, err := q.Point(context.Background(), "test", pt)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(*features) != 1 || fid(&(*features)[0], "ID") != "fiji" {
+					t.Errorf("point %s returned %d features, want fiji", pt, len(*features))
+				}
+			}
+		})
+	}
+}
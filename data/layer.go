@@ -1,17 +1,21 @@
 package data
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/logger"
 	"github.com/karrick/godirwalk"
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
 	"github.com/paulmach/orb/maptile"
 	"github.com/schollz/progressbar/v3"
-	"github.com/tidwall/buntdb"
 )
 
 type Layer struct {
@@ -19,33 +23,90 @@ type Layer struct {
 	DataDir    string
 	DataExt    string
 	DataID     string
+	DataCRS    string
 	DBFilepath string
 	DBIndex    string
+	DBBackend  string
 	ZoomLimit  int
-	db         *buntdb.DB
+	Writable   bool
+	store      Store
+	rtree      *packedRTree
+	crs        *crs
+	features   *featureCache
+	stats      layerStats
+	conf       conf.Layer
+	inflight   sync.WaitGroup
+	// slots limits the queries served at once, if the layer has a concurrency limit
+	slots chan struct{}
+	// mu guards stamp and unpacked, which change with writes
+	mu       sync.RWMutex
+	stamp    string
+	modified time.Time
+	unpacked bool
+	// writeMu serializes writes, and guards frozen
+	writeMu sync.Mutex
+	frozen  bool
+	// closing is set, under the query handler's lock, once the layer
+	// stops serving queries to be closed before it's replaced
+	closing bool
 }
 
 func NewLayer(layer conf.Layer) *Layer {
+	var slots chan struct{}
+	if layer.ConcurrencyLimit > 0 {
+		slots = make(chan struct{}, layer.ConcurrencyLimit)
+	}
+	var features *featureCache
+	if layer.FeatureCacheMB > 0 || layer.FeatureCachePreload {
+		features = newFeatureCache(int64(layer.FeatureCacheMB) << 20)
+	}
 	return &Layer{
 		Name:       layer.Name,
 		DataDir:    layer.Data.Dir,
 		DataExt:    layer.Data.Ext,
 		DataID:     layer.Data.ID,
+		DataCRS:    layer.Data.CRS,
 		DBFilepath: layer.Database.Filepath,
 		DBIndex:    layer.Database.Index,
+		DBBackend:  layer.Database.Backend,
 		ZoomLimit:  layer.ZoomLimit,
+		Writable:   layer.Writable,
+		conf:       layer,
+		slots:      slots,
+		features:   features,
+	}
+}
+
+// loadCRS parses the crs of the source data, if it isn't WGS84
+func (l *Layer) loadCRS() error {
+	l.crs = nil
+	if l.DataCRS == "" {
+		return nil
 	}
+	c, err := parseCRS(l.DataCRS)
+	if err != nil {
+		return err
+	}
+	l.crs = c
+	return nil
 }
 
 //////////////////////////////////////////////////////////
 
-func (l *Layer) CheckData() error {
+// CheckData reads every data file of the layer and reports file sizes,
+// invalid geometries, missing ids and duplicate ids
+func (l *Layer) CheckData() (*DataReport, error) {
 
 	if !dirExists(l.DataDir) {
-		return fmt.Errorf("data dir does not exist")
+		return nil, fmt.Errorf("data dir does not exist")
+	}
+	if err := l.loadCRS(); err != nil {
+		return nil, err
 	}
 
-	numFiles := 0
+	report := newDataReport(l.Name)
+	ids := make(map[string][]string)
+
 	var minFilesize int64 = math.MaxInt64
 	var maxFilesize int64 = math.MinInt64
 
@@ -63,14 +124,26 @@ func (l *Layer) CheckData() error {
 					return nil
 				}
 
-				nbytes, _, _, err := read(path, l.DataID)
+				f, nbytes, err := feature(path)
 				if err != nil {
-					return err
+					report.addUnreadable(path, err)
+					return nil
 				}
 
-				numFiles++
+				report.Files++
 				minFilesize = minBytes(minFilesize, nbytes)
 				maxFilesize = maxBytes(maxFilesize, nbytes)
+
+				id := fid(f, l.DataID)
+				if id == "" {
+					report.MissingIDs = append(report.MissingIDs, path)
+				} else {
+					ids[id] = append(ids[id], path)
+				}
+
+				if issues := validateGeometry(f.Geometry); len(issues) > 0 {
+					report.addInvalid(path, id, issues)
+				}
 			}
 			return nil
 		},
@@ -79,29 +152,48 @@ func (l *Layer) CheckData() error {
 		},
 	})
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	for id, paths := range ids {
+		if len(paths) > 1 {
+			report.DuplicateIDs = append(report.DuplicateIDs, DuplicateID{ID: id, Files: paths})
+		}
+	}
+
+	if report.Files > 0 {
+		report.MinBytes = minFilesize
+		report.MaxBytes = maxFilesize
 	}
 
 	log.Println()
 	log.Println("done")
-	log.Printf("files found: %d\n", numFiles)
-	log.Printf("largest: %d | smallest: %d\n", maxFilesize, minFilesize)
+	log.Printf("files found: %d\n", report.Files)
+	log.Printf("largest: %d | smallest: %d\n", report.MaxBytes, report.MinBytes)
+	log.Println(report.summary())
 
-	return nil
+	return report, nil
 }
 
 //////////////////////////////////////////////////////////
 
 func (l *Layer) CreateDatabase() error {
 
+	store, err := newStore(l.DBBackend, l.DBFilepath, l.DBIndex)
+	if err != nil {
+		return err
+	}
+	if !store.Persistent() {
+		return fmt.Errorf("%s backend has no database file to create", l.DBBackend)
+	}
+
 	if fileExists(l.DBFilepath) {
 		return fmt.Errorf("database file already exists")
 	}
 
 	log.Printf("creating db...")
 
-	_, err := buntdb.Open(l.DBFilepath)
-	if err != nil {
+	if err := store.Create(); err != nil {
 		return err
 	}
 
@@ -110,44 +202,101 @@ func (l *Layer) CreateDatabase() error {
 	return nil
 }
 
+// OpenDatabase opens the layer's store. A store that isn't persisted
+// is empty when opened, so the data dir is added to it right away.
 func (l *Layer) OpenDatabase() error {
 
-	if !fileExists(l.DBFilepath) {
+	store, err := newStore(l.DBBackend, l.DBFilepath, l.DBIndex)
+	if err != nil {
+		return err
+	}
+	if store.Persistent() && !fileExists(l.DBFilepath) {
 		return fmt.Errorf("database file does not exists")
 	}
-	l.db = nil
+	if err := l.loadCRS(); err != nil {
+		return err
+	}
+	l.store = nil
 
 	log.Printf("opening db...")
 
-	bdb, err := buntdb.Open(l.DBFilepath)
-	if err != nil {
+	l.stamp = dbStamp(l.DBFilepath)
+	l.modified = dbModified(l.DBFilepath)
+	if !store.Persistent() {
+		l.modified = time.Now()
+	}
+	if err := store.Open(); err != nil {
 		return err
 	}
-	l.db = bdb
+	l.store = store
 
 	log.Println("done")
 
+	if !store.Persistent() {
+		return l.AddDataToDatabase(RepairNone)
+	}
+
 	return nil
 }
 
-func (l *Layer) AddDataToDatabase() error {
+// CloseDatabase closes the layer's store and index file
+func (l *Layer) CloseDatabase() error {
+	if l.rtree != nil {
+		l.rtree.Close()
+		l.rtree = nil
+	}
+	if l.store == nil {
+		return nil
+	}
+	err := l.store.Close()
+	l.store = nil
+	return err
+}
+
+// Repair is how AddDataToDatabase handles geometries with unclosed or misoriented rings
+// or degenerate parts
+type Repair int
+
+const (
+	// RepairNone indexes geometries as they are
+	RepairNone Repair = iota
+	// RepairIndex indexes the repaired geometries, leaving the data files as they are
+	RepairIndex
+	// RepairRewrite also replaces the data files of repaired features with the repaired features
+	RepairRewrite
+)
+
+// skippedID is a feature skipped by AddDataToDatabase, whose id was first seen in another file
+type skippedID struct {
+	path, id, first string
+}
+
+// AddDataToDatabase indexes every data file of the layer, repairing geometries if asked to
+func (l *Layer) AddDataToDatabase(repair Repair) error {
 
 	if !dirExists(l.DataDir) {
 		return fmt.Errorf("data dir does not exist")
 	}
-	if !fileExists(l.DBFilepath) {
-		return fmt.Errorf("database file does not exist")
-	}
-	if l.db == nil {
+	if l.store == nil {
 		return fmt.Errorf("database not loaded")
 	}
+	if err := l.loadCRS(); err != nil {
+		return err
+	}
 
 	log.Printf("uploading data to db...")
 
 	numLoadErrors := 0
 	numUpdateErrors := 0
+	numRepaired := 0
 	numFiles := 0
 
+	var dropped []string
+
+	ids := make(map[string]string)
+	var emptyIDs []string
+	var duplicateIDs []skippedID
+
 	progress := progressbar.Default(-1)
 
 	err := godirwalk.Walk(l.DataDir, &godirwalk.Options{
@@ -157,17 +306,57 @@ func (l *Layer) AddDataToDatabase() error {
 
 				progress.Add(1)
 
-				_, id, bound, err := read(path, l.DataID)
+				f, _, err := feature(path)
+				if err != nil {
+					numLoadErrors++
+					return err
+				}
+
+				if repair != RepairNone {
+					if g, repaired := repairGeometry(f.Geometry); repaired {
+						if g == nil {
+							dropped = append(dropped, path)
+							return nil
+						}
+						f.Geometry = g
+						if repair == RepairRewrite {
+							if err := writeFeature(path, f); err != nil {
+								numLoadErrors++
+								return err
+							}
+						}
+						numRepaired++
+					}
+				}
+
+				l.crs.toWGS84Feature(f)
+				id := fid(f, l.DataID)
+
+				if id == "" {
+					emptyIDs = append(emptyIDs, path)
+					return nil
+				}
+				if first, ok := ids[id]; ok {
+					duplicateIDs = append(duplicateIDs, skippedID{path: path, id: id, first: first})
+					return nil
+				}
+				ids[id] = path
+
+				file, err := filepath.Rel(l.DataDir, path)
 				if err != nil {
 					numLoadErrors++
 					return err
 				}
 
-				err = dbUpdate(l.db, l.DBIndex, id, bound)
+				err = l.store.Put(id, rects(f.Geometry), file)
 				if err != nil {
 					numUpdateErrors++
 					return err
 				}
+				if err := l.reindex(id, f); err != nil {
+					numUpdateErrors++
+					return err
+				}
 
 				numFiles++
 			}
@@ -182,59 +371,287 @@ func (l *Layer) AddDataToDatabase() error {
 	}
 	log.Println()
 	log.Println("done")
+	if numRepaired > 0 {
+		log.Printf("%d features repaired\n", numRepaired)
+	}
+	for _, path := range dropped {
+		logger.Warn("skipped feature with degenerate geometry", logger.Fields{"layer": l.Name, "file": path})
+	}
 	if numLoadErrors > 0 || numUpdateErrors > 0 {
-		log.Printf("warning: %d load errors | %d update errors\n", numLoadErrors, numUpdateErrors)
+		logger.Warn("errors while loading data", logger.Fields{"layer": l.Name, "load_errors": numLoadErrors, "update_errors": numUpdateErrors})
+	}
+	for _, path := range emptyIDs {
+		logger.Warn("skipped feature with missing or non-scalar id", logger.Fields{"layer": l.Name, "file": path})
+	}
+	for _, dup := range duplicateIDs {
+		logger.Warn("skipped feature with duplicate id", logger.Fields{"layer": l.Name, "file": dup.path, "id": dup.id, "first": dup.first})
+	}
+	if len(emptyIDs) > 0 || len(duplicateIDs) > 0 {
+		logger.Warn("skipped features with empty or duplicate ids", logger.Fields{"layer": l.Name, "empty_ids": len(emptyIDs), "duplicate_ids": len(duplicateIDs)})
 	}
 	log.Printf("%d files loaded to db: %s\n", numFiles, filename(l.DBFilepath))
 	return nil
 }
 
-func (l *Layer) IndexDatabase() error {
-	log.Printf("indexing db...")
+// CreateIndexFile writes the rects of the database to a packed R-tree file next to it,
+// which IndexDatabase maps instead of building an in-memory index
+func (l *Layer) CreateIndexFile() error {
+
+	if l.store == nil {
+		return fmt.Errorf("database not loaded")
+	}
+	if !l.store.Persistent() {
+		return nil
+	}
+
+	log.Printf("writing index file...")
+
+	var items []rtreeItem
 
-	err := l.db.CreateSpatialIndex(l.DBIndex, dbPattern(l.DBIndex), buntdb.IndexRect)
+	if err := l.store.Rects(func(id string, part int, rect orb.Bound) bool {
+		items = append(items, rtreeItem{key: dbPartKey(l.DBIndex, id, part), bound: rect})
+		return true
+	}); err != nil {
+		return err
+	}
+
+	version, err := l.store.Version()
 	if err != nil {
 		return err
 	}
+
+	if err := writePackedRTree(indexFilepath(l.DBFilepath), items, version); err != nil {
+		return err
+	}
+
 	log.Println("done")
+	log.Printf("%d rects written to index file: %s\n", len(items), filename(indexFilepath(l.DBFilepath)))
 	return nil
 }
 
-func (l *Layer) intersects(o interface{}) ([]geojson.Feature, error) {
+// IndexDatabase maps the layer's index file if it is up to date with the database.
+// Pages of the index are then loaded lazily by queries, so startup time doesn't grow
+// with the number of features. Otherwise, the store builds its own spatial index.
+func (l *Layer) IndexDatabase() error {
 
-	var features []geojson.Feature
+	if l.store == nil {
+		return fmt.Errorf("database not loaded")
+	}
 
-	if err := l.db.View(func(tx *buntdb.Tx) error {
-		tx.Intersects(l.DBIndex, bounds(o), func(k, v string) bool {
-			f := resolve(l, k, o)
-			if f != nil {
-				features = append(features, *f)
-			}
+	if l.store.Persistent() && fileExists(indexFilepath(l.DBFilepath)) {
+		version, err := l.store.Version()
+		if err != nil {
+			return err
+		}
+		log.Printf("opening index file...")
+		t, err := openPackedRTree(indexFilepath(l.DBFilepath), version)
+		if err == nil {
+			l.rtree = t
+			log.Println("done")
+			l.checkTerms()
+			return nil
+		}
+		logger.Warn("index file not used, rebuilding index", logger.Fields{"layer": l.Name, "file": indexFilepath(l.DBFilepath), "error": err})
+	}
+
+	log.Printf("indexing db...")
+
+	if err := l.store.Index(); err != nil {
+		return err
+	}
+	log.Println("done")
+	l.checkTerms()
+	return nil
+}
+
+// each calls fn with each feature matching a query as the index is searched,
+// until fn returns false or the context is done
+func (l *Layer) each(ctx context.Context, o interface{}, fn FeatureFunc) error {
+	return l.search(ctx, o, func(id, file string) bool {
+		f := resolve(ctx, l, id, file, o)
+		return f == nil || fn(f)
+	})
+}
+
+// count returns the number of features matching a query. Only point queries
+// read features, to test them against their geometry, others count the index
+// entries that intersect the query.
+func (l *Layer) count(ctx context.Context, o interface{}) (int, error) {
+	n := 0
+	if _, ok := o.(orb.Point); ok {
+		err := l.each(ctx, o, func(f *geojson.Feature) bool {
+			n++
 			return true
 		})
-		return nil
-	}); err != nil {
+		return n, err
+	}
+	err := l.search(ctx, o, func(id, file string) bool {
+		n++
+		return true
+	})
+	return n, err
+}
+
+// searchBatch is the number of entries a query reads from the store's index at once.
+// The store is released while the features of a batch are read and written out,
+// so that a slow client doesn't hold up writes, or queries queued behind them.
+// Each batch restarts the store's search, skipping the entries seen so far,
+// so batches double in size up to maxSearchBatch to keep large queries from rescanning it often.
+const (
+	searchBatch    = 256
+	maxSearchBatch = 16384
+)
+
+// search calls iter once with each index entry intersecting a query,
+// until iter returns false or the context is done
+func (l *Layer) search(ctx context.Context, o interface{}, iter func(id, file string) bool) error {
+
+	// a feature or query crossing the antimeridian has two rects,
+	// so the same feature can be hit more than once
+	seen := make(map[string]bool)
+
+	rtree := l.packedIndex()
+
+	for _, rect := range rects(o) {
+		if ctx.Err() != nil {
+			break
+		}
+		if rtree != nil {
+			// the index file isn't locked, so entries are visited as they're found
+			stopped := false
+			rtree.Search(rect, func(k string) bool {
+				if ctx.Err() != nil {
+					return false
+				}
+				id, err := dbParseKey(l.DBIndex, k)
+				if err != nil || seen[id] {
+					return true
+				}
+				file, err := l.store.Get(id)
+				if err != nil {
+					return true
+				}
+				seen[id] = true
+				stopped = !iter(id, file)
+				return !stopped
+			})
+			if stopped {
+				return nil
+			}
+			continue
+		}
+		for size := searchBatch; ctx.Err() == nil; size *= 2 {
+			if size > maxSearchBatch {
+				size = maxSearchBatch
+			}
+			batch := make([][2]string, 0, size)
+			err := l.store.Intersects(rect, func(id, file string) bool {
+				if ctx.Err() != nil {
+					return false
+				}
+				if !seen[id] {
+					seen[id] = true
+					batch = append(batch, [2]string{id, file})
+				}
+				return len(batch) < size
+			})
+			if err != nil {
+				return err
+			}
+			for _, e := range batch {
+				if ctx.Err() != nil {
+					break
+				}
+				if !iter(e[0], e[1]) {
+					return nil
+				}
+			}
+			if len(batch) < size {
+				// the search found every entry
+				break
+			}
+		}
+	}
+
+	return ctx.Err()
+}
+
+// ids lists the id of every entry of the layer, so that the store
+// isn't read while it's iterated
+func (l *Layer) ids() ([]string, error) {
+	ids := []string{}
+	err := l.store.IDs(func(id string) bool {
+		ids = append(ids, id)
+		return true
+	})
+	return ids, err
+}
+
+func (l *Layer) get(id string) (*geojson.Feature, error) {
+
+	file, err := l.store.Get(id)
+	if err != nil {
 		return nil, err
 	}
 
-	return features, nil
+	return l.feature(id, file)
 }
 
-func AddLayerToQueryHandler(layer *Layer) {
-	QueryHandler.layers[layer.Name] = layer
+// feature returns an indexed feature from the layer's feature cache,
+// or reads it from its data file
+func (l *Layer) feature(id, file string) (*geojson.Feature, error) {
+
+	if l.features == nil {
+		f, _, err := l.readFeature(id, file)
+		return f, err
+	}
+
+	f, gen, ok := l.features.get(id)
+	if ok {
+		return f, nil
+	}
+
+	f, size, err := l.readFeature(id, file)
+	if err != nil {
+		return nil, err
+	}
+
+	l.features.put(id, f, size, gen)
+
+	return f, nil
+}
+
+// readFeature reads an indexed feature from its data file
+func (l *Layer) readFeature(id, file string) (*geojson.Feature, int64, error) {
+
+	fp, err := dataPath(l.DataDir, file, id, l.DataExt)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f, size, err := feature(fp)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	l.crs.toWGS84Feature(f)
+
+	return f, size, nil
 }
 
-func resolve(layer *Layer, k string, o interface{}) *geojson.Feature {
+// AddLayerToQueryHandler adds a layer to the query handler, or swaps it in
+// for the layer of the same name, which is closed once its queries finish
+func AddLayerToQueryHandler(layer *Layer) {
+	QueryHandler.add(layer)
+}
 
-	index, id := dbParseKey(k)
+func resolve(ctx context.Context, layer *Layer, id, file string, o interface{}) *geojson.Feature {
 
-	if index != layer.DBIndex {
+	if ctx.Err() != nil {
 		return nil
 	}
 
-	fp := filePath(layer.DataDir, id, layer.DataExt)
-
-	f, _, err := feature(fp)
+	f, err := layer.feature(id, file)
 	if err != nil {
 		return nil
 	}
@@ -0,0 +1,309 @@
+package data
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/paulmach/orb/geojson"
+)
+
+var backends = []string{BackendBuntDB, BackendBolt, BackendMemory}
+
+func newTestQuery() *Query {
+	return &Query{
+		layers: make(map[string]*Layer),
+		status: make(map[string]*LayerStatus),
+	}
+}
+
+// testConfLayer writes data files to a temp data dir, each named after its key
+func testConfLayer(t *testing.T, backend string, files map[string]string) conf.Layer {
+	t.Helper()
+
+	dir := t.TempDir()
+	dataDir := filepath.Join(dir, "data")
+	if err := os.Mkdir(dataDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dataDir, name+".geojson"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return conf.Layer{
+		Name: "test",
+		Data: conf.LayerData{
+			Dir: dataDir,
+			Ext: ".geojson",
+			ID:  "ID",
+		},
+		Database: conf.LayerDatabase{
+			Filepath: filepath.Join(dir, "test.db"),
+			Index:    "test",
+			Backend:  backend,
+		},
+		Writable: true,
+	}
+}
+
+// createTestDatabase creates the database of a persisted layer, like rtyq create
+func createTestDatabase(t *testing.T, confLayer conf.Layer, repair Repair) {
+	t.Helper()
+
+	layer := NewLayer(confLayer)
+	if err := layer.CreateDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	if err := layer.OpenDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	if err := layer.AddDataToDatabase(repair); err != nil {
+		t.Fatal(err)
+	}
+	if err := layer.CloseDatabase(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// loadTestLayer creates the database of a layer if it's persisted and loads it,
+// closing the layers of q once the test is done
+func loadTestLayer(t *testing.T, q *Query, confLayer conf.Layer) *Layer {
+	t.Helper()
+
+	if confLayer.Database.Backend != BackendMemory {
+		createTestDatabase(t, confLayer, RepairNone)
+	}
+
+	layer, err := q.load(confLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q.add(layer)
+
+	t.Cleanup(func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for name, l := range q.layers {
+			l.drain()
+			delete(q.layers, name)
+		}
+	})
+
+	return layer
+}
+
+func testFeature(id string, coords string) string {
+	return `{"type":"Feature","properties":{"ID":"` + id + `"},"geometry":{"type":"Polygon","coordinates":[` + coords + `]}}`
+}
+
+const (
+	square0 = `[[0,0],[1,0],[1,1],[0,1],[0,0]]`
+	square5 = `[[5,5],[6,5],[6,6],[5,6],[5,5]]`
+)
+
+func TestLoadLayer(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			loadTestLayer(t, q, testConfLayer(t, backend, map[string]string{
+				"a": testFeature("a", square0),
+				"b": testFeature("b", square5),
+			}))
+
+			features, err := q.BBox(context.Background(), "test", "-1,-1,2,2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(*features) != 1 || fid(&(*features)[0], "ID") != "a" {
+				t.Fatalf("bbox query returned %v", *features)
+			}
+
+			features, err = q.ID(context.Background(), "test", "b")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(*features) != 1 {
+				t.Fatalf("id query returned %d features", len(*features))
+			}
+
+			status, _ := q.LayerStatus("test")
+			if status.Features != 2 {
+				t.Errorf("layer status has %d features, want 2", status.Features)
+			}
+		})
+	}
+}
+
+func TestAddDataToDatabaseRepair(t *testing.T) {
+	unclosed := testFeature("a", `[[0,0],[1,0],[1,1],[0,1]]`)
+	degenerate := testFeature("b", `[[5,5],[6,6],[5,5]]`)
+
+	tests := []struct {
+		repair    Repair
+		dropped   bool
+		rewritten bool
+	}{
+		{RepairNone, false, false},
+		{RepairIndex, true, false},
+		{RepairRewrite, true, true},
+	}
+
+	for _, tt := range tests {
+		confLayer := testConfLayer(t, BackendBuntDB, map[string]string{
+			"a": unclosed,
+			"b": degenerate,
+		})
+		createTestDatabase(t, confLayer, tt.repair)
+
+		l := NewLayer(confLayer)
+		if err := l.OpenDatabase(); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{"a", "b"} {
+			_, err := l.store.Get(id)
+			indexed := err == nil
+			want := id == "a" || !tt.dropped
+			if indexed != want {
+				t.Errorf("repair %d: feature %s indexed: %v, want %v", tt.repair, id, indexed, want)
+			}
+		}
+		l.CloseDatabase()
+
+		for name, content := range map[string]string{"a": unclosed, "b": degenerate} {
+			b, err := ioutil.ReadFile(filepath.Join(confLayer.Data.Dir, name+".geojson"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rewritten := string(b) != content
+			if rewritten != (tt.rewritten && name == "a") {
+				t.Errorf("repair %d: data file %s rewritten: %v", tt.repair, name, rewritten)
+			}
+		}
+	}
+}
+
+func TestLoadLayerWithoutRects(t *testing.T) {
+	line := `{"type":"Feature","properties":{"ID":"line"},"geometry":{"type":"LineString","coordinates":[[0,0],[1,1]]}}`
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			confLayer := testConfLayer(t, backend, map[string]string{
+				"a":    testFeature("a", square0),
+				"line": line,
+			})
+			confLayer.Search = []string{"ID"}
+			confLayer.FeatureCachePreload = true
+			l := loadTestLayer(t, q, confLayer)
+
+			// a feature of a geometry that isn't indexed spatially is still found by id
+			features, err := q.ID(context.Background(), "test", "line")
+			if err != nil || len(*features) != 1 {
+				t.Fatalf("id query returned %v", err)
+			}
+			status, _ := q.LayerStatus("test")
+			if status.Features != 2 {
+				t.Errorf("layer status has %d features, want 2", status.Features)
+			}
+
+			// and it's searched, summarized and preloaded like the others
+			if ids := searchIDs(t, q, url.Values{"ID": {"line"}}); len(ids) != 1 {
+				t.Errorf("search returned %v", ids)
+			}
+			stats, err := q.Stats(context.Background(), "test")
+			if err != nil || stats.Features != 2 || len(stats.GeometryTypes) != 2 {
+				t.Errorf("stats: %+v, %v", stats, err)
+			}
+			if len(l.features.items) != 2 {
+				t.Errorf("%d features preloaded, want 2", len(l.features.items))
+			}
+		})
+	}
+}
+
+func TestSearchBatches(t *testing.T) {
+	// enough features for several batches, with a feature crossing the antimeridian
+	files := map[string]string{
+		"fiji": testFeature("fiji", `[[177,-20],[-178,-20],[-178,-15],[177,-15],[177,-20]]`),
+	}
+	for i := 0; i < 2*searchBatch+10; i++ {
+		id := strconv.Itoa(i)
+		files[id] = testFeature(id, square0)
+	}
+
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			loadTestLayer(t, q, testConfLayer(t, backend, files))
+
+			seen := make(map[string]bool)
+			err := q.BBoxEach(context.Background(), "test", "-180,-30,180,30", func(f *geojson.Feature) bool {
+				id := fid(f, "ID")
+				if seen[id] {
+					t.Errorf("feature %s streamed twice", id)
+				}
+				seen[id] = true
+				return true
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(seen) != len(files) {
+				t.Errorf("streamed %d features, want %d", len(seen), len(files))
+			}
+
+			// a query stopped by its callback stops within the first batch
+			n := 0
+			if err := q.BBoxEach(context.Background(), "test", "-1,-1,2,2", func(f *geojson.Feature) bool {
+				n++
+				return n < 3
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if n != 3 {
+				t.Errorf("stopped query streamed %d features, want 3", n)
+			}
+		})
+	}
+}
+
+func TestSearchOutsideStoreLock(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			loadTestLayer(t, q, testConfLayer(t, backend, map[string]string{
+				"a": testFeature("a", square0),
+				"b": testFeature("b", square0),
+			}))
+
+			// a write made while a query's client is slow to read isn't held up by the query
+			done := make(chan error, 1)
+			err := q.BBoxEach(context.Background(), "test", "-1,-1,2,2", func(f *geojson.Feature) bool {
+				go func() {
+					_, _, err := q.Put("test", "c", parseTestFeature(t, testFeature("c", square5)))
+					done <- err
+				}()
+				select {
+				case err := <-done:
+					done <- err
+				case <-time.After(2 * time.Second):
+					t.Error("write blocked by a streaming query")
+				}
+				return false
+			})
+			if err := <-done; err != nil {
+				t.Error(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -1,9 +1,12 @@
 package data
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
@@ -17,34 +20,53 @@ var (
 	ErrQueryInvalidQuery          error = fmt.Errorf("invalid query")
 	ErrQueryMissingID             error = fmt.Errorf("missing id")
 	ErrQueryInvalidID             error = fmt.Errorf("invalid id")
+	ErrQueryNotFound              error = fmt.Errorf("not found")
 	ErrQueryMissingPoint          error = fmt.Errorf("missing point")
 	ErrQueryInvalidPoint          error = fmt.Errorf("invalid point")
 	ErrQueryMissingTile           error = fmt.Errorf("missing tile")
 	ErrQueryInvalidTile           error = fmt.Errorf("invalid tile")
 	ErrQueryMissingBBox           error = fmt.Errorf("missing bbox")
 	ErrQueryInvalidBBox           error = fmt.Errorf("invalid bbox")
+	ErrQueryMissingSearch         error = fmt.Errorf("missing search")
+	ErrQueryInvalidSearch         error = fmt.Errorf("invalid search")
 	ErrQueryExceededTileZoomLimit error = fmt.Errorf("exceeded tile zoom limit")
+	ErrQueryInvalidCRS            error = fmt.Errorf("invalid crs")
+	ErrQueryInvalidFeature        error = fmt.Errorf("invalid feature")
+	ErrQueryFeatureExists         error = fmt.Errorf("feature already exists")
+	ErrQueryReadOnly              error = fmt.Errorf("layer is read-only")
+	ErrQueryLayerBusy             error = fmt.Errorf("layer is busy")
+	ErrQueryTimeout               error = fmt.Errorf("query timed out")
+	ErrQueryCanceled              error = fmt.Errorf("query canceled")
 	ErrQueryRequest               error = fmt.Errorf("unable to make request")
 )
 
 var QueryHandler Query
 
 type Query struct {
-	layers map[string]*Layer
+	mu       sync.RWMutex
+	reloadMu sync.Mutex
+	layers   map[string]*Layer
+	status   map[string]*LayerStatus
+	changes  changes
 }
 
 func init() {
 	QueryHandler = Query{
 		layers: make(map[string]*Layer),
+		status: make(map[string]*LayerStatus),
 	}
 }
 
-func (q Query) HasLayer(layer string) bool {
+func (q *Query) HasLayer(layer string) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
 	_, ok := q.layers[layer]
 	return ok
 }
 
-func (q Query) Layers() []string {
+func (q *Query) Layers() []string {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
 	layers := []string{}
 	for l := range q.layers {
 		layers = append(layers, l)
@@ -52,128 +74,349 @@ func (q Query) Layers() []string {
 	return layers
 }
 
-func (q Query) Point(layer, pt string) (*[]geojson.Feature, error) {
+// acquire returns a layer for the duration of a query, which must release it.
+// A layer that is swapped out by a reload is closed once all of its queries are released.
+// It fails with ErrQueryLayerBusy if the layer is serving as many queries as it's limited to,
+// or is closing to be reopened.
+func (q *Query) acquire(layer string) (*Layer, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	l, ok := q.layers[layer]
+	if !ok {
+		return nil, ErrQueryInvalidLayer
+	}
+	if l.closing {
+		return nil, ErrQueryLayerBusy
+	}
+	if l.slots != nil {
+		select {
+		case l.slots <- struct{}{}:
+		default:
+			return nil, ErrQueryLayerBusy
+		}
+	}
+	l.inflight.Add(1)
+	return l, nil
+}
 
-	if layer == "" {
-		return &[]geojson.Feature{}, ErrQueryMissingLayer
+// Version identifies the current data of a layer, changing whenever it's
+// reloaded or written to, and returns when it was last modified
+func (q *Query) Version(layer string) (string, time.Time, error) {
+
+	l, err := q.acquire(layer)
+	if err != nil {
+		return "", time.Time{}, err
 	}
+	defer l.release()
 
-	if !q.HasLayer(layer) {
-		return &[]geojson.Feature{}, ErrQueryInvalidLayer
+	version, err := l.version()
+	if err != nil {
+		return "", time.Time{}, ErrQueryRequest
 	}
 
-	if pt == "" {
-		return &[]geojson.Feature{}, ErrQueryMissingPoint
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return version, l.modified, nil
+}
+
+func (l *Layer) version() (string, error) {
+
+	version, err := l.store.Version()
+	if err != nil {
+		return "", err
 	}
 
-	point := parsePoint(pt)
-	if point == nil {
-		return &[]geojson.Feature{}, ErrQueryInvalidPoint
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return fmt.Sprintf("%s%d:%d", l.stamp, l.modified.UnixNano(), version), nil
+}
+
+// FeatureFunc is called with each feature of a query, which must not be
+// modified, and returns false to stop the query
+type FeatureFunc func(f *geojson.Feature) bool
+
+func (q *Query) Point(ctx context.Context, layer, pt string) (*[]geojson.Feature, error) {
+	features := []geojson.Feature{}
+	err := q.PointEach(ctx, layer, pt, collect(&features))
+	return &features, err
+}
+
+// PointEach calls fn with each feature of a point query as the index is searched.
+// Query errors are returned before fn is called.
+func (q *Query) PointEach(ctx context.Context, layer, pt string, fn FeatureFunc) error {
+	return q.point(ctx, layer, pt, each(fn))
+}
+
+// PointCount returns the number of features of a point query
+func (q *Query) PointCount(ctx context.Context, layer, pt string) (int, error) {
+	n := 0
+	err := q.point(ctx, layer, pt, count(&n))
+	return n, err
+}
+
+func (q *Query) point(ctx context.Context, layer, pt string, run queryFunc) error {
+
+	if layer == "" {
+		return ErrQueryMissingLayer
 	}
 
-	features, err := q.layers[layer].intersects(*point)
+	l, err := q.acquire(layer)
 	if err != nil {
-		return &[]geojson.Feature{}, ErrQueryRequest
+		return err
 	}
+	defer l.release()
 
-	if len(features) == 0 {
-		return &[]geojson.Feature{}, nil
+	point, err := pointParam(pt)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := l.queryContext(ctx)
+	defer cancel()
+
+	if err := run(ctx, l, *point); err != nil {
+		return queryError(err)
 	}
 
-	return &features, nil
+	return nil
+}
+
+func (q *Query) BBox(ctx context.Context, layer, bb string) (*[]geojson.Feature, error) {
+	features := []geojson.Feature{}
+	err := q.BBoxEach(ctx, layer, bb, collect(&features))
+	return &features, err
+}
+
+// BBoxEach calls fn with each feature of a bbox query as the index is searched.
+// Query errors are returned before fn is called.
+func (q *Query) BBoxEach(ctx context.Context, layer, bb string, fn FeatureFunc) error {
+	return q.bbox(ctx, layer, bb, each(fn))
+}
+
+// BBoxCount returns the number of features of a bbox query
+func (q *Query) BBoxCount(ctx context.Context, layer, bb string) (int, error) {
+	n := 0
+	err := q.bbox(ctx, layer, bb, count(&n))
+	return n, err
 }
 
-func (q Query) BBox(layer, bb string) (*[]geojson.Feature, error) {
+func (q *Query) bbox(ctx context.Context, layer, bb string, run queryFunc) error {
 
 	if layer == "" {
-		return &[]geojson.Feature{}, ErrQueryMissingLayer
+		return ErrQueryMissingLayer
 	}
 
-	if !q.HasLayer(layer) {
-		return &[]geojson.Feature{}, ErrQueryInvalidLayer
+	l, err := q.acquire(layer)
+	if err != nil {
+		return err
 	}
+	defer l.release()
 
-	if bb == "" {
-		return &[]geojson.Feature{}, ErrQueryMissingBBox
+	bbox, err := bboxParam(bb)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := l.queryContext(ctx)
+	defer cancel()
+
+	if err := run(ctx, l, *bbox); err != nil {
+		return queryError(err)
+	}
+
+	return nil
+}
+
+func (q *Query) Tile(ctx context.Context, layer, x, y, z string) (*[]geojson.Feature, error) {
+	features := []geojson.Feature{}
+	err := q.TileEach(ctx, layer, x, y, z, collect(&features))
+	return &features, err
+}
+
+// TileEach calls fn with each feature of a tile query as the index is searched.
+// Query errors are returned before fn is called.
+func (q *Query) TileEach(ctx context.Context, layer, x, y, z string, fn FeatureFunc) error {
+	return q.tile(ctx, layer, x, y, z, each(fn))
+}
+
+// TileCount returns the number of features of a tile query
+func (q *Query) TileCount(ctx context.Context, layer, x, y, z string) (int, error) {
+	n := 0
+	err := q.tile(ctx, layer, x, y, z, count(&n))
+	return n, err
+}
+
+func (q *Query) tile(ctx context.Context, layer, x, y, z string, run queryFunc) error {
+
+	if layer == "" {
+		return ErrQueryMissingLayer
 	}
 
-	bbox := parseBBox(bb)
-	if bbox.IsEmpty() {
-		return &[]geojson.Feature{}, ErrQueryInvalidBBox
+	l, err := q.acquire(layer)
+	if err != nil {
+		return err
 	}
+	defer l.release()
 
-	features, err := q.layers[layer].intersects(*bbox)
+	tile, err := tileParam(x, y, z)
 	if err != nil {
-		return &[]geojson.Feature{}, ErrQueryRequest
+		return err
 	}
 
-	if len(features) == 0 {
-		return &[]geojson.Feature{}, nil
+	if int(tile.Z) < l.ZoomLimit {
+		return ErrQueryExceededTileZoomLimit
+	}
+
+	ctx, cancel := l.queryContext(ctx)
+	defer cancel()
+
+	if err := run(ctx, l, *tile); err != nil {
+		return queryError(err)
 	}
 
-	return &features, nil
+	return nil
 }
 
-func (q Query) Tile(layer, x, y, z string) (*[]geojson.Feature, error) {
+func (q *Query) ID(ctx context.Context, layer, id string) (*[]geojson.Feature, error) {
 
 	if layer == "" {
 		return &[]geojson.Feature{}, ErrQueryMissingLayer
 	}
 
-	if !q.HasLayer(layer) {
-		return &[]geojson.Feature{}, ErrQueryInvalidLayer
+	l, err := q.acquire(layer)
+	if err != nil {
+		return &[]geojson.Feature{}, err
 	}
+	defer l.release()
 
-	if x == "" || y == "" || z == "" {
-		return &[]geojson.Feature{}, ErrQueryMissingTile
+	if id == "" {
+		return &[]geojson.Feature{}, ErrQueryMissingID
 	}
 
-	tile := parseTile(x, y, z)
-	if tile == nil {
-		return &[]geojson.Feature{}, ErrQueryInvalidTile
-	}
+	ctx, cancel := l.queryContext(ctx)
+	defer cancel()
 
-	if int(tile.Z) < q.layers[layer].ZoomLimit {
-		return &[]geojson.Feature{}, ErrQueryExceededTileZoomLimit
+	if err := ctx.Err(); err != nil {
+		return &[]geojson.Feature{}, queryError(err)
 	}
 
-	features, err := q.layers[layer].intersects(*tile)
+	f, err := l.get(id)
+	if err == errNotIndexed {
+		return &[]geojson.Feature{}, ErrQueryNotFound
+	}
 	if err != nil {
 		return &[]geojson.Feature{}, ErrQueryRequest
 	}
 
-	if len(features) == 0 {
-		return &[]geojson.Feature{}, nil
+	if err := ctx.Err(); err != nil {
+		return &[]geojson.Feature{}, queryError(err)
 	}
 
-	return &features, nil
+	return &[]geojson.Feature{*f}, nil
 }
 
-func (q Query) ID(layer, id string) (*[]geojson.Feature, error) {
+///////////////////////////////////////////////////////////////////////////////////////
 
-	if layer == "" {
-		return &[]geojson.Feature{}, ErrQueryMissingLayer
+// queryFunc runs a point, bbox or tile query on a layer
+type queryFunc func(ctx context.Context, l *Layer, o interface{}) error
+
+func each(fn FeatureFunc) queryFunc {
+	return func(ctx context.Context, l *Layer, o interface{}) error {
+		return l.each(ctx, o, fn)
 	}
+}
 
-	if !q.HasLayer(layer) {
-		return &[]geojson.Feature{}, ErrQueryInvalidLayer
+func count(n *int) queryFunc {
+	return func(ctx context.Context, l *Layer, o interface{}) error {
+		c, err := l.count(ctx, o)
+		*n = c
+		return err
 	}
+}
 
-	if id == "" {
-		return &[]geojson.Feature{}, ErrQueryMissingID
+// queryContext bounds a query by the layer's query timeout, if it has one
+func (l *Layer) queryContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if l.conf.QueryTimeoutMs <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(l.conf.QueryTimeoutMs)*time.Millisecond)
+}
+
+func queryError(err error) error {
+	switch err {
+	case context.DeadlineExceeded:
+		return ErrQueryTimeout
+	case context.Canceled:
+		return ErrQueryCanceled
+	default:
+		return ErrQueryRequest
 	}
+}
+
+// collect appends the features of a query to a slice
+func collect(features *[]geojson.Feature) FeatureFunc {
+	return func(f *geojson.Feature) bool {
+		*features = append(*features, *f)
+		return true
+	}
+}
+
+// ValidatePoint, ValidateBBox and ValidateTile check the params of a query
+// without running it, so that an invalid query can be rejected before it's
+// answered from a cache
+
+func ValidatePoint(pt string) error {
+	_, err := pointParam(pt)
+	return err
+}
 
-	fp := filePath(q.layers[layer].DataDir, id, q.layers[layer].DataExt)
+func ValidateBBox(bb string) error {
+	_, err := bboxParam(bb)
+	return err
+}
 
-	f, _, err := feature(fp)
+// ValidateTile also checks the zoom limit of the layer, if it's loaded
+func (q *Query) ValidateTile(layer, x, y, z string) error {
+	tile, err := tileParam(x, y, z)
 	if err != nil {
-		return &[]geojson.Feature{}, nil
+		return err
+	}
+	if l := q.current(layer); l != nil && int(tile.Z) < l.ZoomLimit {
+		return ErrQueryExceededTileZoomLimit
 	}
+	return nil
+}
 
-	return &[]geojson.Feature{*f}, nil
+func pointParam(pt string) (*orb.Point, error) {
+	if pt == "" {
+		return nil, ErrQueryMissingPoint
+	}
+	point := parsePoint(pt)
+	if point == nil {
+		return nil, ErrQueryInvalidPoint
+	}
+	return point, nil
 }
 
-///////////////////////////////////////////////////////////////////////////////////////
+func bboxParam(bb string) (*orb.Bound, error) {
+	if bb == "" {
+		return nil, ErrQueryMissingBBox
+	}
+	return ParseBBox(bb)
+}
+
+func tileParam(x, y, z string) (*maptile.Tile, error) {
+	if x == "" || y == "" || z == "" {
+		return nil, ErrQueryMissingTile
+	}
+	tile := parseTile(x, y, z)
+	if tile == nil {
+		return nil, ErrQueryInvalidTile
+	}
+	return tile, nil
+}
 
 func parsePoint(pt string) *orb.Point {
 
@@ -0,0 +1,406 @@
+package data
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/logger"
+)
+
+// LoadLayer opens and indexes a layer, recording its status in the query handler
+func LoadLayer(confLayer conf.Layer) (*Layer, error) {
+	return QueryHandler.load(confLayer)
+}
+
+func (q *Query) load(confLayer conf.Layer) (*Layer, error) {
+
+	layer := NewLayer(confLayer)
+
+	log.Printf("loading layer: %s\n", layer.Name)
+
+	q.setStatus(layer.Name, func(s *LayerStatus) {
+		s.State = StatusLoading
+		s.Error = ""
+	})
+
+	start := time.Now()
+	if err := layer.OpenDatabase(); err != nil {
+		q.setFailed(layer.Name, err)
+		return nil, err
+	}
+	openMs := time.Since(start).Milliseconds()
+
+	q.setStatus(layer.Name, func(s *LayerStatus) {
+		s.State = StatusIndexing
+	})
+
+	start = time.Now()
+	if err := layer.IndexDatabase(); err != nil {
+		layer.CloseDatabase()
+		q.setFailed(layer.Name, err)
+		return nil, err
+	}
+
+	if confLayer.FeatureCachePreload {
+		log.Printf("preloading features...")
+		if err := layer.preload(); err != nil {
+			layer.CloseDatabase()
+			q.setFailed(layer.Name, err)
+			return nil, err
+		}
+		log.Println("done")
+	}
+	indexMs := time.Since(start).Milliseconds()
+
+	count, err := layer.store.Count()
+	if err != nil {
+		layer.CloseDatabase()
+		q.setFailed(layer.Name, err)
+		return nil, err
+	}
+
+	q.setStatus(layer.Name, func(s *LayerStatus) {
+		s.State = StatusReady
+		s.Features = count
+		s.OpenMs = openMs
+		s.IndexMs = indexMs
+	})
+
+	return layer, nil
+}
+
+// Reload loads layers that are new, whose config changed or whose database or index
+// file was rewritten since they were loaded (or all layers, with force), and removes
+// layers that are no longer configured. Layers are loaded while the current ones keep
+// serving queries (see reload), then swapped in. A layer that fails to load keeps its current version.
+func (q *Query) Reload(confLayers []conf.Layer, force bool) {
+
+	q.reloadMu.Lock()
+	defer q.reloadMu.Unlock()
+
+	configured := make(map[string]bool)
+
+	for _, confLayer := range confLayers {
+		configured[confLayer.Name] = true
+
+		if !force && !q.changed(confLayer) {
+			continue
+		}
+		q.reload(confLayer)
+	}
+
+	for _, name := range q.loaded() {
+		if !configured[name] {
+			log.Printf("removing layer: %s\n", name)
+			q.remove(name)
+		}
+	}
+}
+
+// ReloadLayer loads a layer and swaps it in
+func (q *Query) ReloadLayer(confLayer conf.Layer) error {
+	q.reloadMu.Lock()
+	defer q.reloadMu.Unlock()
+	return q.reload(confLayer)
+}
+
+// RemoveLayer closes a layer once its queries finish and forgets its status
+func (q *Query) RemoveLayer(name string) error {
+	q.reloadMu.Lock()
+	defer q.reloadMu.Unlock()
+	if _, ok := q.LayerStatus(name); !ok {
+		return ErrQueryInvalidLayer
+	}
+	log.Printf("removing layer: %s\n", name)
+	q.remove(name)
+	return nil
+}
+
+// RebuildLayer recreates a layer's database and index file from its data dir, then reloads it.
+// The new files are built next to the current ones while the current version of the layer
+// keeps serving queries (but not writes). They're then moved into place, which leaves the
+// files the current version has open as they are, and loaded. The current version is swapped
+// out and closed once they're loaded, or keeps serving with its files restored if they fail to load.
+func (q *Query) RebuildLayer(confLayer conf.Layer) error {
+
+	q.reloadMu.Lock()
+	defer q.reloadMu.Unlock()
+
+	store, err := newStore(confLayer.Database.Backend, confLayer.Database.Filepath, confLayer.Database.Index)
+	if err != nil {
+		q.setFailed(confLayer.Name, err)
+		return err
+	}
+	if !store.Persistent() {
+		return q.reload(confLayer)
+	}
+
+	old := q.current(confLayer.Name)
+	if old != nil {
+		old.freeze()
+	}
+
+	q.setStatus(confLayer.Name, func(s *LayerStatus) {
+		s.State = StatusBuilding
+		s.Error = ""
+	})
+
+	dbFilepath := confLayer.Database.Filepath
+	rebuilt := dbFilepath + ".rebuild"
+	backup := dbFilepath + ".backup"
+
+	start := time.Now()
+	if err := rebuild(confLayer, rebuilt); err != nil {
+		removeDatabase(rebuilt)
+		if old != nil {
+			old.thaw()
+		}
+		q.setFailed(confLayer.Name, err)
+		return err
+	}
+	buildMs := time.Since(start).Milliseconds()
+
+	q.setStatus(confLayer.Name, func(s *LayerStatus) {
+		s.BuildMs = buildMs
+	})
+
+	removeDatabase(backup)
+	if fileExists(dbFilepath) {
+		if err := moveDatabase(dbFilepath, backup); err != nil {
+			q.restore(old, dbFilepath, backup)
+			q.setFailed(confLayer.Name, err)
+			return err
+		}
+	}
+	if err := moveDatabase(rebuilt, dbFilepath); err != nil {
+		q.restore(old, dbFilepath, backup)
+		q.setFailed(confLayer.Name, err)
+		return err
+	}
+
+	layer, err := q.load(confLayer)
+	if err != nil {
+		logger.Error("unable to load rebuilt layer", logger.Fields{"layer": confLayer.Name, "error": err})
+		q.restore(old, dbFilepath, backup)
+		return err
+	}
+	q.add(layer)
+	// the swapped out version keeps the backup open until its queries finish
+	removeDatabase(backup)
+
+	return nil
+}
+
+// rebuild builds the database and index file of a layer at dbFilepath
+func rebuild(confLayer conf.Layer, dbFilepath string) error {
+
+	tmp := confLayer
+	tmp.Database.Filepath = dbFilepath
+
+	removeDatabase(dbFilepath)
+
+	layer := NewLayer(tmp)
+
+	log.Printf("rebuilding layer: %s\n", layer.Name)
+
+	if err := layer.CreateDatabase(); err != nil {
+		return err
+	}
+	if err := layer.OpenDatabase(); err != nil {
+		return err
+	}
+	if err := layer.AddDataToDatabase(RepairNone); err != nil {
+		layer.CloseDatabase()
+		return err
+	}
+	if err := layer.CreateIndexFile(); err != nil {
+		layer.CloseDatabase()
+		return err
+	}
+	return layer.CloseDatabase()
+}
+
+// restore moves the backed up files of a layer that failed to rebuild back into place,
+// and allows writes to its current version again
+func (q *Query) restore(old *Layer, dbFilepath, backup string) {
+	if fileExists(backup) {
+		removeDatabase(dbFilepath)
+		if err := moveDatabase(backup, dbFilepath); err != nil {
+			logger.Error("unable to restore database", logger.Fields{"file": dbFilepath, "error": err})
+		}
+	}
+	if old != nil {
+		old.thaw()
+	}
+}
+
+// reload loads a layer and swaps it in. The current version of the layer keeps serving
+// queries meanwhile, but not writes, so that its database file doesn't change while
+// the new version opens it. A bolt database is locked by the current version though,
+// so it's closed first and reopened if the new version fails to load.
+func (q *Query) reload(confLayer conf.Layer) error {
+
+	old := q.current(confLayer.Name)
+	exclusive := false
+	if old != nil {
+		old.freeze()
+		exclusive = old.DBBackend == BackendBolt && old.DBFilepath == confLayer.Database.Filepath
+		if exclusive {
+			q.close(old)
+		}
+	}
+
+	layer, err := q.load(confLayer)
+	if err != nil {
+		logger.Error("unable to load layer", logger.Fields{"layer": confLayer.Name, "error": err})
+		if exclusive {
+			q.reopen(old)
+		} else if old != nil {
+			old.thaw()
+		}
+		return err
+	}
+	q.add(layer)
+
+	return nil
+}
+
+// current returns the layer serving queries under a name, if any
+func (q *Query) current(name string) *Layer {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.layers[name]
+}
+
+// close stops a layer from serving new queries, which fail with ErrQueryLayerBusy
+// until it's replaced, and closes it once its queries finish
+func (q *Query) close(l *Layer) {
+	q.mu.Lock()
+	l.closing = true
+	q.mu.Unlock()
+	l.drain()
+}
+
+// reopen loads a closed layer again with its config, or stops serving it if it fails to load
+func (q *Query) reopen(old *Layer) {
+	log.Printf("reopening layer: %s\n", old.Name)
+	layer, err := q.load(old.conf)
+	if err != nil {
+		logger.Error("unable to reopen layer", logger.Fields{"layer": old.Name, "error": err})
+		q.mu.Lock()
+		if q.layers[old.Name] == old {
+			delete(q.layers, old.Name)
+		}
+		q.mu.Unlock()
+		return
+	}
+	q.add(layer)
+}
+
+func (q *Query) changed(confLayer conf.Layer) bool {
+	q.mu.RLock()
+	l, ok := q.layers[confLayer.Name]
+	q.mu.RUnlock()
+	if !ok {
+		return true
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return !reflect.DeepEqual(l.conf, confLayer) || l.stamp != dbStamp(l.DBFilepath)
+}
+
+// loaded returns the names of the layers that are serving or failed to load
+func (q *Query) loaded() []string {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	names := []string{}
+	for name := range q.status {
+		names = append(names, name)
+	}
+	return names
+}
+
+// add swaps a layer in, replacing any layer of the same name
+func (q *Query) add(layer *Layer) {
+	q.mu.Lock()
+	old := q.layers[layer.Name]
+	q.layers[layer.Name] = layer
+	// a closing layer is closed by whoever closes it
+	drain := old != nil && !old.closing
+	q.mu.Unlock()
+	if drain {
+		go old.drain()
+	}
+}
+
+func (q *Query) remove(name string) {
+	q.mu.Lock()
+	old := q.layers[name]
+	delete(q.layers, name)
+	delete(q.status, name)
+	q.mu.Unlock()
+	if old != nil {
+		go old.drain()
+	}
+}
+
+// drain waits for the queries of a layer that was swapped out, then closes it
+func (l *Layer) drain() {
+	l.inflight.Wait()
+	if err := l.CloseDatabase(); err != nil {
+		logger.Error("unable to close layer", logger.Fields{"layer": l.Name, "error": err})
+	}
+}
+
+func (l *Layer) release() {
+	if l.slots != nil {
+		<-l.slots
+	}
+	l.inflight.Done()
+}
+
+// dbModified is the last time a database or its index file was written
+func dbModified(dbFilepath string) time.Time {
+	var modified time.Time
+	for _, path := range []string{dbFilepath, indexFilepath(dbFilepath)} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+	}
+	return modified
+}
+
+// dbStamp identifies the current version of a database and its index file on disk
+func dbStamp(dbFilepath string) string {
+	var sb strings.Builder
+	for _, path := range []string{dbFilepath, indexFilepath(dbFilepath)} {
+		if info, err := os.Stat(path); err == nil {
+			sb.WriteString(fmt.Sprintf("%d:%d;", info.ModTime().UnixNano(), info.Size()))
+		} else {
+			sb.WriteString("-;")
+		}
+	}
+	return sb.String()
+}
+
+// moveDatabase renames a database file and its index file, if it has one
+func moveDatabase(from, to string) error {
+	os.Remove(indexFilepath(to))
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	if !fileExists(indexFilepath(from)) {
+		return nil
+	}
+	return os.Rename(indexFilepath(from), indexFilepath(to))
+}
+
+func removeDatabase(dbFilepath string) {
+	os.Remove(dbFilepath)
+	os.Remove(indexFilepath(dbFilepath))
+}
@@ -0,0 +1,246 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/engelsjk/rtyq/logger"
+	"github.com/paulmach/orb"
+)
+
+func TestReloadFailureKeepsLayer(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			confLayer := testConfLayer(t, backend, map[string]string{
+				"a": testFeature("a", square0),
+			})
+			old := loadTestLayer(t, q, confLayer)
+
+			bad := confLayer
+			bad.Data.CRS = "EPSG:1"
+			if err := q.ReloadLayer(bad); err == nil {
+				t.Fatal("reload with an invalid crs succeeded")
+			}
+
+			l, err := q.acquire("test")
+			if err != nil {
+				t.Fatalf("layer isn't serving after a failed reload: %v", err)
+			}
+			l.release()
+			if backend != BackendBolt && l != old {
+				t.Error("layer was replaced by a failed reload")
+			}
+
+			features, err := q.ID(context.Background(), "test", "a")
+			if err != nil || len(*features) != 1 {
+				t.Fatalf("id query after a failed reload returned %v", err)
+			}
+			if _, _, err := q.Put("test", "b", parseTestFeature(t, testFeature("b", square5))); err != nil {
+				t.Errorf("write after a failed reload returned %v", err)
+			}
+		})
+	}
+}
+
+func TestReloadFailureLogged(t *testing.T) {
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	defer logger.SetOutput(os.Stderr)
+
+	q := newTestQuery()
+	confLayer := testConfLayer(t, BackendMemory, map[string]string{
+		"a": testFeature("a", square0),
+	})
+	loadTestLayer(t, q, confLayer)
+
+	bad := confLayer
+	bad.Data.CRS = "EPSG:1"
+	q.ReloadLayer(bad)
+
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["msg"] == "unable to load layer" {
+			if entry["level"] != "error" || entry["layer"] != "test" || entry["error"] == nil {
+				t.Errorf("failed load logged as %v", entry)
+			}
+			return
+		}
+	}
+	t.Errorf("failed load not logged: %s", buf.String())
+}
+
+func TestReloadSwapsLayer(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			confLayer := testConfLayer(t, backend, map[string]string{
+				"a": testFeature("a", square0),
+			})
+			old := loadTestLayer(t, q, confLayer)
+
+			changed := confLayer
+			changed.ZoomLimit = 4
+			if err := q.ReloadLayer(changed); err != nil {
+				t.Fatal(err)
+			}
+
+			l, err := q.acquire("test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.release()
+			if l == old || l.ZoomLimit != 4 {
+				t.Fatal("layer wasn't replaced by its reload")
+			}
+
+			// the replaced layer no longer takes writes
+			if err := old.write("b", parseTestFeature(t, testFeature("b", square5)), true, func([]orb.Bound) {}); err != ErrQueryLayerBusy {
+				t.Errorf("write to the replaced layer returned %v, want %v", err, ErrQueryLayerBusy)
+			}
+			if _, _, err := q.Put("test", "b", parseTestFeature(t, testFeature("b", square5))); err != nil {
+				t.Errorf("write to the reloaded layer returned %v", err)
+			}
+		})
+	}
+}
+
+func TestFrozenLayerRejectsWrites(t *testing.T) {
+	q := newTestQuery()
+	l := loadTestLayer(t, q, testConfLayer(t, BackendBuntDB, map[string]string{
+		"a": testFeature("a", square0),
+	}))
+
+	l.freeze()
+	if _, _, err := q.Put("test", "b", parseTestFeature(t, testFeature("b", square5))); err != ErrQueryLayerBusy {
+		t.Errorf("put to a frozen layer returned %v, want %v", err, ErrQueryLayerBusy)
+	}
+	if err := q.Delete("test", "a"); err != ErrQueryLayerBusy {
+		t.Errorf("delete from a frozen layer returned %v, want %v", err, ErrQueryLayerBusy)
+	}
+
+	l.thaw()
+	if err := q.Delete("test", "a"); err != nil {
+		t.Errorf("delete from a thawed layer returned %v", err)
+	}
+}
+
+func TestRebuildLayer(t *testing.T) {
+	for _, backend := range []string{BackendBuntDB, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			confLayer := testConfLayer(t, backend, map[string]string{
+				"a": testFeature("a", square0),
+			})
+			loadTestLayer(t, q, confLayer)
+
+			// a data file added behind the layer's back is indexed by a rebuild
+			if err := ioutil.WriteFile(filepath.Join(confLayer.Data.Dir, "b.geojson"), []byte(testFeature("b", square5)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := q.RebuildLayer(confLayer); err != nil {
+				t.Fatal(err)
+			}
+
+			features, err := q.ID(context.Background(), "test", "b")
+			if err != nil || len(*features) != 1 {
+				t.Fatalf("id query of a rebuilt feature returned %v", err)
+			}
+			if _, _, err := q.Put("test", "c", parseTestFeature(t, testFeature("c", square5))); err != nil {
+				t.Errorf("write to the rebuilt layer returned %v", err)
+			}
+
+			dbFilepath := confLayer.Database.Filepath
+			if !fileExists(dbFilepath) || !fileExists(indexFilepath(dbFilepath)) {
+				t.Error("rebuilt database isn't in place")
+			}
+			for _, path := range []string{dbFilepath + ".rebuild", dbFilepath + ".backup"} {
+				if fileExists(path) || fileExists(indexFilepath(path)) {
+					t.Errorf("%s was left behind", filepath.Base(path))
+				}
+			}
+		})
+	}
+}
+
+func TestRebuildLayerKeepsServing(t *testing.T) {
+	for _, backend := range []string{BackendBuntDB, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			confLayer := testConfLayer(t, backend, map[string]string{
+				"a": testFeature("a", square0),
+			})
+			loadTestLayer(t, q, confLayer)
+
+			done := make(chan struct{})
+			errs := make(chan error, 1)
+			go func() {
+				defer close(errs)
+				for {
+					select {
+					case <-done:
+						return
+					default:
+					}
+					if _, err := q.ID(context.Background(), "test", "a"); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+
+			for i := 0; i < 3; i++ {
+				if err := q.RebuildLayer(confLayer); err != nil {
+					t.Fatal(err)
+				}
+			}
+			close(done)
+
+			if err := <-errs; err != nil {
+				t.Errorf("id query during a rebuild returned %v", err)
+			}
+		})
+	}
+}
+
+func TestRebuildFailureKeepsLayer(t *testing.T) {
+	for _, backend := range []string{BackendBuntDB, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			confLayer := testConfLayer(t, backend, map[string]string{
+				"a": testFeature("a", square0),
+			})
+			loadTestLayer(t, q, confLayer)
+			before, err := ioutil.ReadFile(confLayer.Database.Filepath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			bad := confLayer
+			bad.Data.CRS = "EPSG:1"
+			if err := q.RebuildLayer(bad); err == nil {
+				t.Fatal("rebuild with an invalid crs succeeded")
+			}
+
+			after, err := ioutil.ReadFile(confLayer.Database.Filepath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(before) != string(after) {
+				t.Error("database file changed by a failed rebuild")
+			}
+			if _, _, err := q.Put("test", "b", parseTestFeature(t, testFeature("b", square5))); err != nil {
+				t.Errorf("write after a failed rebuild returned %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,309 @@
+package data
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/paulmach/orb"
+)
+
+// packedRTree is a static, Hilbert-sorted R-tree (after flatbush) stored in a single file.
+// Nodes are laid out level by level, leaves first and the root last, so the file
+// can be memory-mapped and searched without decoding it.
+//
+// file layout (little endian):
+//
+//	header   magic [8]byte | version int64 | numItems uint32 | nodeSize uint32
+//	boxes    numNodes * [minX, minY, maxX, maxY float64]
+//	indices  numNodes * uint32 (item index for leaves, first child node otherwise)
+//	offsets  (numItems+1) * uint32 (key offsets into the key bytes)
+//	keys     database keys of the items
+type packedRTree struct {
+	data        []byte
+	close       func() error
+	numItems    int
+	nodeSize    int
+	numNodes    int
+	levelBounds []int
+	boxesOff    int
+	indicesOff  int
+	offsetsOff  int
+	keysOff     int
+}
+
+const (
+	rtreeMagic      = "RTYQIDX1"
+	rtreeHeaderSize = 24
+	rtreeNodeSize   = 16
+	hilbertMax      = 1<<16 - 1
+)
+
+type rtreeItem struct {
+	key   string
+	bound orb.Bound
+}
+
+func rtreeLevels(numItems, nodeSize int) (int, []int) {
+	n := numItems
+	numNodes := n
+	levelBounds := []int{n}
+	for {
+		n = (n + nodeSize - 1) / nodeSize
+		numNodes += n
+		levelBounds = append(levelBounds, numNodes)
+		if n <= 1 {
+			break
+		}
+	}
+	return numNodes, levelBounds
+}
+
+// writePackedRTree sorts the items along a Hilbert curve, packs them into
+// a tree and writes it to path. version is the version of the store the
+// items were read from (see Store.Version), to detect a stale index when it is opened.
+func writePackedRTree(path string, items []rtreeItem, version int64) error {
+
+	nodeSize := rtreeNodeSize
+	numItems := len(items)
+	numNodes, levelBounds := rtreeLevels(numItems, nodeSize)
+
+	total := orb.Bound{Min: orb.Point{math.Inf(1), math.Inf(1)}, Max: orb.Point{math.Inf(-1), math.Inf(-1)}}
+	for _, it := range items {
+		total = total.Union(it.bound)
+	}
+
+	hilbertValues := make([]uint32, numItems)
+	w, h := total.Max[0]-total.Min[0], total.Max[1]-total.Min[1]
+	for i, it := range items {
+		c := it.bound.Center()
+		x, y := 0.0, 0.0
+		if w > 0 {
+			x = math.Floor(hilbertMax * (c[0] - total.Min[0]) / w)
+		}
+		if h > 0 {
+			y = math.Floor(hilbertMax * (c[1] - total.Min[1]) / h)
+		}
+		hilbertValues[i] = hilbert(uint32(x), uint32(y))
+	}
+
+	order := make([]int, numItems)
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		return hilbertValues[order[a]] < hilbertValues[order[b]]
+	})
+
+	boxes := make([]orb.Bound, numNodes)
+	indices := make([]uint32, numNodes)
+
+	for pos, i := range order {
+		boxes[pos] = items[i].bound
+		indices[pos] = uint32(i)
+	}
+
+	pos := numItems
+	for l := 0; l < len(levelBounds)-1; l++ {
+		start := 0
+		if l > 0 {
+			start = levelBounds[l-1]
+		}
+		end := levelBounds[l]
+		for p := start; p < end; p += nodeSize {
+			b := boxes[p]
+			for c := p + 1; c < p+nodeSize && c < end; c++ {
+				b = b.Union(boxes[c])
+			}
+			boxes[pos] = b
+			indices[pos] = uint32(p)
+			pos++
+		}
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(file)
+	le := binary.LittleEndian
+
+	bw.WriteString(rtreeMagic)
+	binary.Write(bw, le, version)
+	binary.Write(bw, le, uint32(numItems))
+	binary.Write(bw, le, uint32(nodeSize))
+
+	for _, b := range boxes {
+		binary.Write(bw, le, [4]float64{b.Min[0], b.Min[1], b.Max[0], b.Max[1]})
+	}
+	binary.Write(bw, le, indices)
+
+	var offset uint32
+	for _, it := range items {
+		binary.Write(bw, le, offset)
+		offset += uint32(len(it.key))
+	}
+	binary.Write(bw, le, offset)
+	for _, it := range items {
+		bw.WriteString(it.key)
+	}
+
+	if err := bw.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// openPackedRTree maps an index file written by writePackedRTree.
+// It fails if the index was built from another version of the store than version.
+func openPackedRTree(path string, version int64) (*packedRTree, error) {
+
+	data, closeFn, err := mmapFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := parsePackedRTree(data, version)
+	if err != nil {
+		closeFn()
+		return nil, err
+	}
+	t.close = closeFn
+
+	return t, nil
+}
+
+func parsePackedRTree(data []byte, version int64) (*packedRTree, error) {
+
+	le := binary.LittleEndian
+
+	if len(data) < rtreeHeaderSize || string(data[:8]) != rtreeMagic {
+		return nil, fmt.Errorf("invalid index file")
+	}
+	if int64(le.Uint64(data[8:])) != version {
+		return nil, fmt.Errorf("index file is out of date with database")
+	}
+
+	t := &packedRTree{
+		data:     data,
+		numItems: int(le.Uint32(data[16:])),
+		nodeSize: int(le.Uint32(data[20:])),
+	}
+	if t.nodeSize < 2 {
+		return nil, fmt.Errorf("invalid index file")
+	}
+
+	t.numNodes, t.levelBounds = rtreeLevels(t.numItems, t.nodeSize)
+	t.boxesOff = rtreeHeaderSize
+	t.indicesOff = t.boxesOff + t.numNodes*32
+	t.offsetsOff = t.indicesOff + t.numNodes*4
+	t.keysOff = t.offsetsOff + (t.numItems+1)*4
+
+	if len(data) < t.keysOff || len(data) < t.keysOff+int(le.Uint32(data[t.keysOff-4:])) {
+		return nil, fmt.Errorf("invalid index file")
+	}
+
+	return t, nil
+}
+
+func (t *packedRTree) Close() error {
+	if t.close == nil {
+		return nil
+	}
+	return t.close()
+}
+
+func (t *packedRTree) box(pos int) (float64, float64, float64, float64) {
+	le := binary.LittleEndian
+	off := t.boxesOff + pos*32
+	return math.Float64frombits(le.Uint64(t.data[off:])),
+		math.Float64frombits(le.Uint64(t.data[off+8:])),
+		math.Float64frombits(le.Uint64(t.data[off+16:])),
+		math.Float64frombits(le.Uint64(t.data[off+24:]))
+}
+
+func (t *packedRTree) index(pos int) int {
+	return int(binary.LittleEndian.Uint32(t.data[t.indicesOff+pos*4:]))
+}
+
+func (t *packedRTree) key(item int) string {
+	le := binary.LittleEndian
+	start := le.Uint32(t.data[t.offsetsOff+item*4:])
+	end := le.Uint32(t.data[t.offsetsOff+(item+1)*4:])
+	return string(t.data[t.keysOff+int(start) : t.keysOff+int(end)])
+}
+
+// Search calls iter with the key of every item intersecting b, until iter returns false
+func (t *packedRTree) Search(b orb.Bound, iter func(key string) bool) {
+
+	if t.numItems == 0 {
+		return
+	}
+
+	nodeIndex := t.numNodes - 1
+	queue := []int{}
+
+	for {
+		end := nodeIndex + t.nodeSize
+		if upper := t.upperBound(nodeIndex); upper < end {
+			end = upper
+		}
+
+		for pos := nodeIndex; pos < end; pos++ {
+			minX, minY, maxX, maxY := t.box(pos)
+			if b.Max[0] < minX || b.Max[1] < minY || b.Min[0] > maxX || b.Min[1] > maxY {
+				continue
+			}
+			if nodeIndex < t.numItems {
+				if !iter(t.key(t.index(pos))) {
+					return
+				}
+			} else {
+				queue = append(queue, t.index(pos))
+			}
+		}
+
+		if len(queue) == 0 {
+			return
+		}
+		nodeIndex = queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+	}
+}
+
+// upperBound returns the end of the level that contains the node
+func (t *packedRTree) upperBound(nodeIndex int) int {
+	i := sort.Search(len(t.levelBounds), func(i int) bool {
+		return t.levelBounds[i] > nodeIndex
+	})
+	return t.levelBounds[i]
+}
+
+// hilbert returns the distance along a Hilbert curve of order 16
+func hilbert(x, y uint32) uint32 {
+	var d uint32
+	for s := uint32(1 << 15); s > 0; s /= 2 {
+		var rx, ry uint32
+		if x&s > 0 {
+			rx = 1
+		}
+		if y&s > 0 {
+			ry = 1
+		}
+		d += s * s * ((3 * rx) ^ ry)
+		if ry == 0 {
+			if rx == 1 {
+				x = hilbertMax - x
+				y = hilbertMax - y
+			}
+			x, y = y, x
+		}
+	}
+	return d
+}
@@ -0,0 +1,168 @@
+package data
+
+import (
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/paulmach/orb"
+)
+
+func randomBound(r *rand.Rand) orb.Bound {
+	x, y := r.Float64()*360-180, r.Float64()*180-90
+	return orb.Bound{Min: orb.Point{x, y}, Max: orb.Point{x + r.Float64()*5, y + r.Float64()*5}}
+}
+
+func searchKeys(t *packedRTree, b orb.Bound) []string {
+	keys := []string{}
+	t.Search(b, func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+func TestPackedRTree(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{0, 1, 15, 16, 17, 1000} {
+		items := make([]rtreeItem, n)
+		for i := range items {
+			items[i] = rtreeItem{key: "k" + strconv.Itoa(i), bound: randomBound(r)}
+		}
+
+		path := filepath.Join(t.TempDir(), "test.db.rtree")
+		if err := writePackedRTree(path, items, 42); err != nil {
+			t.Fatal(err)
+		}
+		tree, err := openPackedRTree(path, 42)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 50; i++ {
+			b := randomBound(r)
+			b.Max = orb.Point{b.Max[0] + 20, b.Max[1] + 20}
+			want := []string{}
+			for _, item := range items {
+				if item.bound.Intersects(b) {
+					want = append(want, item.key)
+				}
+			}
+			sort.Strings(want)
+			if got := searchKeys(tree, b); !equalStrings(got, want) {
+				t.Fatalf("%d items: search of %v returned %d keys, want %d", n, b, len(got), len(want))
+			}
+		}
+
+		if n > 0 {
+			found := 0
+			tree.Search(orb.Bound{Min: orb.Point{-180, -90}, Max: orb.Point{180, 90}}, func(key string) bool {
+				found++
+				return false
+			})
+			if found != 1 {
+				t.Errorf("%d items: search went on after iter returned false", n)
+			}
+		}
+
+		if err := tree.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestOpenPackedRTreeInvalid(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db.rtree")
+	items := []rtreeItem{{key: "a", bound: orb.Bound{Max: orb.Point{1, 1}}}}
+	if err := writePackedRTree(path, items, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openPackedRTree(path, 43); err == nil {
+		t.Error("index of another version of the database was opened")
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string][]byte{
+		"truncated": b[:len(b)-1],
+		"header":    b[:rtreeHeaderSize-1],
+		"magic":     append([]byte("RTYQIDX0"), b[8:]...),
+		"empty":     {},
+	} {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := openPackedRTree(p, 42); err == nil {
+			t.Errorf("%s index file was opened", name)
+		}
+	}
+}
+
+func TestIndexFile(t *testing.T) {
+	for _, backend := range []string{BackendBuntDB, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			confLayer := testConfLayer(t, backend, map[string]string{
+				"a": testFeature("a", square0),
+				"b": testFeature("b", square5),
+			})
+			createTestDatabase(t, confLayer, RepairNone)
+
+			l := NewLayer(confLayer)
+			if err := l.OpenDatabase(); err != nil {
+				t.Fatal(err)
+			}
+			if err := l.CreateIndexFile(); err != nil {
+				t.Fatal(err)
+			}
+			l.CloseDatabase()
+
+			q := newTestQuery()
+			l, err := q.load(confLayer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q.add(l)
+			if l.packedIndex() == nil {
+				t.Fatal("index file wasn't mapped")
+			}
+
+			features, err := q.BBox(context.Background(), "test", "-1,-1,2,2")
+			if err != nil || len(*features) != 1 || fid(&(*features)[0], "ID") != "a" {
+				t.Fatalf("bbox query with the index file returned %v", err)
+			}
+
+			// the first write falls back to the store's index, which sees it
+			if _, _, err := q.Put("test", "c", parseTestFeature(t, testFeature("c", square5))); err != nil {
+				t.Fatal(err)
+			}
+			if l.packedIndex() != nil {
+				t.Error("index file still used after a write")
+			}
+			features, err = q.BBox(context.Background(), "test", "4,4,7,7")
+			if err != nil || len(*features) != 2 {
+				t.Fatalf("bbox query after a write returned %v", err)
+			}
+			l.drain()
+
+			// and the index file, now out of date, isn't mapped anymore
+			l, err = newTestQuery().load(confLayer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.drain()
+			if l.rtree != nil {
+				t.Error("out of date index file was mapped")
+			}
+		})
+	}
+}
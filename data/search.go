@@ -0,0 +1,287 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/engelsjk/rtyq/logger"
+	"github.com/paulmach/orb/geojson"
+)
+
+const (
+	// SearchText is the search param matching words of any search field,
+	// other search params are named after the field they match
+	SearchText = "q"
+	// searchPrefix ends a value or word that is matched as a prefix
+	searchPrefix = "*"
+)
+
+// searchTerms returns the terms a feature is searched by, which the layer's store keeps:
+// the lowercased value of each search field as v:{field}:{value},
+// and the words of all the fields as t:{word}, with fields, values and words escaped
+func searchTerms(fields []string, f *geojson.Feature) []string {
+	terms := []string{}
+	seen := make(map[string]bool)
+	for _, field := range fields {
+		v, ok := f.Properties[field]
+		if !ok || v == nil {
+			continue
+		}
+		s := searchValue(v)
+		terms = append(terms, valueTerm(field, s))
+		for _, w := range searchWords(s) {
+			if !seen[w] {
+				seen[w] = true
+				terms = append(terms, wordTerm(w))
+			}
+		}
+	}
+	return terms
+}
+
+func valueTerm(field, value string) string {
+	return "v:" + url.QueryEscape(field) + ":" + url.QueryEscape(value)
+}
+
+func wordTerm(word string) string {
+	return "t:" + url.QueryEscape(word)
+}
+
+// match returns the ids of the features matching every search param, in order,
+// or the error of ctx if it's done before they're all matched
+func (l *Layer) match(ctx context.Context, params url.Values) ([]string, error) {
+
+	var ids map[string]bool
+
+	// scan intersects ids with the entries having a term,
+	// or a term starting with it if value ends with searchPrefix
+	scan := func(term func(string) string, value string) error {
+		prefix := strings.HasSuffix(value, searchPrefix)
+		found := make(map[string]bool)
+		err := l.store.Terms(term(strings.TrimSuffix(value, searchPrefix)), prefix, func(id string) bool {
+			if ctx.Err() != nil {
+				return false
+			}
+			found[id] = true
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if ids == nil {
+			ids = found
+			return nil
+		}
+		for id := range ids {
+			if !found[id] {
+				delete(ids, id)
+			}
+		}
+		return nil
+	}
+
+	for key, values := range params {
+		for _, value := range values {
+			if key == SearchText {
+				words := searchWords(strings.ToLower(value))
+				for n, w := range words {
+					// only the last word of the text is matched as a prefix
+					if n == len(words)-1 && strings.HasSuffix(value, searchPrefix) {
+						w += searchPrefix
+					}
+					if err := scan(wordTerm, w); err != nil {
+						return nil, err
+					}
+				}
+				continue
+			}
+			if !l.isSearchField(key) {
+				return nil, ErrQueryInvalidSearch
+			}
+			field := func(v string) string {
+				return valueTerm(key, v)
+			}
+			if err := scan(field, searchValue(value)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	matched := make([]string, 0, len(ids))
+	for id := range ids {
+		matched = append(matched, id)
+	}
+	sort.Strings(matched)
+
+	return matched, nil
+}
+
+// searchValue is a property value as it's indexed and matched
+func searchValue(v interface{}) string {
+	switch p := v.(type) {
+	case string:
+		return strings.ToLower(strings.TrimSpace(p))
+	case float64:
+		return strconv.FormatFloat(p, 'f', -1, 64)
+	default:
+		return strings.ToLower(fmt.Sprint(p))
+	}
+}
+
+// searchWords splits a value into words of letters and digits
+func searchWords(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+/////////////////////////////////////////////////////////////////////
+
+// checkTerms warns if a layer has search fields but its database has no search terms,
+// ie. it was created before terms were stored
+func (l *Layer) checkTerms() {
+	if len(l.conf.Search) == 0 || !l.store.Persistent() {
+		return
+	}
+	if n, err := l.store.Count(); err != nil || n == 0 {
+		return
+	}
+	found := false
+	if err := l.store.Terms("", true, func(id string) bool {
+		found = true
+		return false
+	}); err != nil || found {
+		return
+	}
+	logger.Warn("database has no search terms, searches won't find any feature until it's created again", logger.Fields{"layer": l.Name})
+}
+
+// reindex stores the search terms of a written feature
+func (l *Layer) reindex(id string, f *geojson.Feature) error {
+	if len(l.conf.Search) == 0 {
+		return nil
+	}
+	return l.store.SetTerms(id, searchTerms(l.conf.Search, f))
+}
+
+/////////////////////////////////////////////////////////////////////
+
+// Search returns the features matching the search params, in id order.
+// SearchText matches features with each of its words in any of their search fields.
+// Every other param names a search field of the layer and matches features
+// whose value equals it, or starts with it if it ends with *, ignoring case.
+func (q *Query) Search(ctx context.Context, layer string, params url.Values) (*[]geojson.Feature, error) {
+	features := []geojson.Feature{}
+	err := q.SearchEach(ctx, layer, params, collect(&features))
+	return &features, err
+}
+
+// SearchEach calls fn with each feature matching the search params.
+// Query errors are returned before fn is called.
+func (q *Query) SearchEach(ctx context.Context, layer string, params url.Values, fn FeatureFunc) error {
+	return q.find(ctx, layer, params, func(ctx context.Context, l *Layer, ids []string) error {
+		for _, id := range ids {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			f, err := l.get(id)
+			if err != nil {
+				continue
+			}
+			if !fn(f) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// SearchCount returns the number of features matching the search params
+func (q *Query) SearchCount(ctx context.Context, layer string, params url.Values) (int, error) {
+	n := 0
+	err := q.find(ctx, layer, params, func(ctx context.Context, l *Layer, ids []string) error {
+		n = len(ids)
+		return nil
+	})
+	return n, err
+}
+
+// ValidateSearch checks that params have a search text or fields of the layer,
+// without running the search
+func (q *Query) ValidateSearch(layer string, params url.Values) error {
+	if len(params) == 0 {
+		return ErrQueryMissingSearch
+	}
+	l := q.current(layer)
+	if l == nil {
+		return nil
+	}
+	if len(l.conf.Search) == 0 {
+		return ErrQueryInvalidSearch
+	}
+	for key := range params {
+		if key != SearchText && !l.isSearchField(key) {
+			return ErrQueryInvalidSearch
+		}
+	}
+	return nil
+}
+
+func (l *Layer) isSearchField(name string) bool {
+	for _, field := range l.conf.Search {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *Query) find(ctx context.Context, layer string, params url.Values, run func(ctx context.Context, l *Layer, ids []string) error) error {
+
+	if layer == "" {
+		return ErrQueryMissingLayer
+	}
+
+	l, err := q.acquire(layer)
+	if err != nil {
+		return err
+	}
+	defer l.release()
+
+	if len(params) == 0 {
+		return ErrQueryMissingSearch
+	}
+
+	if len(l.conf.Search) == 0 {
+		return ErrQueryInvalidSearch
+	}
+
+	ctx, cancel := l.queryContext(ctx)
+	defer cancel()
+
+	ids, err := l.match(ctx, params)
+	if err == ErrQueryInvalidSearch {
+		return err
+	}
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		return queryError(err)
+	}
+	if err != nil {
+		logger.Error("unable to search layer", logger.Fields{"layer": l.Name, "error": err})
+		return ErrQueryRequest
+	}
+
+	if err := run(ctx, l, ids); err != nil {
+		return queryError(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,211 @@
+package data
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func searchFeature(id, name, county string) string {
+	return `{"type":"Feature","properties":{"ID":"` + id + `","NAME":"` + name + `","COUNTY":"` + county + `"},"geometry":{"type":"Polygon","coordinates":[` + square0 + `]}}`
+}
+
+func loadSearchLayer(t *testing.T, q *Query, backend string) *Layer {
+	t.Helper()
+	confLayer := testConfLayer(t, backend, map[string]string{
+		"1": searchFeature("1", "Main Street Park", "Travis"),
+		"2": searchFeature("2", "Maple Grove", "Travis"),
+		"3": searchFeature("3", "Riverside Park", "Hays"),
+	})
+	confLayer.Search = []string{"NAME", "COUNTY"}
+	return loadTestLayer(t, q, confLayer)
+}
+
+func searchIDs(t *testing.T, q *Query, params url.Values) []string {
+	t.Helper()
+	features, err := q.Search(context.Background(), "test", params)
+	if err != nil {
+		t.Fatalf("search %v: %v", params, err)
+	}
+	ids := []string{}
+	for i := range *features {
+		ids = append(ids, fid(&(*features)[i], "ID"))
+	}
+	return ids
+}
+
+func TestSearch(t *testing.T) {
+	tests := []struct {
+		params url.Values
+		want   []string
+	}{
+		{url.Values{"COUNTY": {"travis"}}, []string{"1", "2"}},
+		{url.Values{"NAME": {"ma*"}}, []string{"1", "2"}},
+		{url.Values{"NAME": {"Maple Grove"}}, []string{"2"}},
+		{url.Values{"NAME": {"maple"}}, []string{}},
+		{url.Values{"NAME": {"ma*"}, "COUNTY": {"Travis"}}, []string{"1", "2"}},
+		{url.Values{"q": {"park"}}, []string{"1", "3"}},
+		{url.Values{"q": {"park tra*"}}, []string{"1"}},
+		{url.Values{"q": {"hays"}, "NAME": {"river*"}}, []string{"3"}},
+		{url.Values{"COUNTY": {"Bexar"}}, []string{}},
+	}
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			loadSearchLayer(t, q, backend)
+			for _, tt := range tests {
+				if got := searchIDs(t, q, tt.params); !equalStrings(got, tt.want) {
+					t.Errorf("search %v: %v, want %v", tt.params, got, tt.want)
+				}
+			}
+		})
+	}
+
+	q := newTestQuery()
+	loadSearchLayer(t, q, BackendMemory)
+
+	if _, err := q.Search(context.Background(), "test", url.Values{"ZIP": {"78701"}}); err != ErrQueryInvalidSearch {
+		t.Errorf("search of a field that isn't indexed returned %v, want %v", err, ErrQueryInvalidSearch)
+	}
+	if _, err := q.Search(context.Background(), "test", url.Values{}); err != ErrQueryMissingSearch {
+		t.Errorf("search without search params returned %v, want %v", err, ErrQueryMissingSearch)
+	}
+}
+
+func TestValidateSearch(t *testing.T) {
+	q := newTestQuery()
+	loadSearchLayer(t, q, BackendMemory)
+	confLayer := testConfLayer(t, BackendMemory, nil)
+	confLayer.Name = "plain"
+	loadTestLayer(t, q, confLayer)
+
+	tests := []struct {
+		layer  string
+		params url.Values
+		want   error
+	}{
+		{"test", url.Values{"NAME": {"ma*"}, "q": {"park"}}, nil},
+		{"test", url.Values{}, ErrQueryMissingSearch},
+		{"test", url.Values{"ZIP": {"78701"}}, ErrQueryInvalidSearch},
+		{"test", url.Values{"COUNTY": {"hays"}, "_": {"1602201600"}}, ErrQueryInvalidSearch},
+		{"plain", url.Values{"q": {"park"}}, ErrQueryInvalidSearch},
+	}
+	for _, tt := range tests {
+		if err := q.ValidateSearch(tt.layer, tt.params); err != tt.want {
+			t.Errorf("validate search of %s %v: %v, want %v", tt.layer, tt.params, err, tt.want)
+		}
+	}
+}
+
+func TestSearchReindexesWrites(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			loadSearchLayer(t, q, backend)
+
+			if _, _, err := q.Put("test", "2", parseTestFeature(t, searchFeature("2", "Maple Grove", "Hays"))); err != nil {
+				t.Fatal(err)
+			}
+			if err := q.Delete("test", "3"); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := searchIDs(t, q, url.Values{"COUNTY": {"hays"}}); !equalStrings(got, []string{"2"}) {
+				t.Errorf("search after writes: %v, want [2]", got)
+			}
+			if got := searchIDs(t, q, url.Values{"q": {"riverside"}}); len(got) != 0 {
+				t.Errorf("search of a deleted feature: %v", got)
+			}
+		})
+	}
+}
+
+func TestSearchTermsPersisted(t *testing.T) {
+	for _, backend := range []string{BackendBuntDB, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			confLayer := testConfLayer(t, backend, map[string]string{
+				"1": searchFeature("1", "Main Street Park", "Travis"),
+			})
+			confLayer.Search = []string{"NAME", "COUNTY"}
+			createTestDatabase(t, confLayer, RepairNone)
+
+			// the terms of a database are searched as they were created,
+			// without reading the data files when the layer is loaded
+			path := filepath.Join(confLayer.Data.Dir, "1.geojson")
+			if err := ioutil.WriteFile(path, []byte(searchFeature("1", "Oak Hill", "Hays")), 0644); err != nil {
+				t.Fatal(err)
+			}
+			q := newTestQuery()
+			l, err := q.load(confLayer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q.add(l)
+			defer l.drain()
+
+			if got := searchIDs(t, q, url.Values{"NAME": {"main*"}}); !equalStrings(got, []string{"1"}) {
+				t.Errorf("search of created terms: %v, want [1]", got)
+			}
+			if got := searchIDs(t, q, url.Values{"q": {"oak"}}); len(got) != 0 {
+				t.Errorf("search of data that wasn't indexed: %v", got)
+			}
+		})
+	}
+}
+
+func TestSearchContext(t *testing.T) {
+	q := newTestQuery()
+	l := loadSearchLayer(t, q, BackendMemory)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// the context bounds the match, before any feature is read
+	if _, err := l.match(ctx, url.Values{"COUNTY": {"travis"}}); err != context.Canceled {
+		t.Errorf("match with a canceled context returned %v, want %v", err, context.Canceled)
+	}
+	if _, err := q.SearchCount(ctx, "test", url.Values{"NAME": {"ma*"}}); err != ErrQueryCanceled {
+		t.Errorf("search count with a canceled context returned %v, want %v", err, ErrQueryCanceled)
+	}
+	if _, err := q.ID(ctx, "test", "1"); err != ErrQueryCanceled {
+		t.Errorf("id query with a canceled context returned %v, want %v", err, ErrQueryCanceled)
+	}
+}
+
+func TestQueryContext(t *testing.T) {
+	l := NewLayer(testConfLayer(t, BackendMemory, nil))
+
+	ctx, cancel := l.queryContext(context.Background())
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("query context has a deadline without a query timeout")
+	}
+	cancel()
+
+	l.conf.QueryTimeoutMs = 50
+	ctx, cancel = l.queryContext(context.Background())
+	defer cancel()
+	if _, ok := ctx.Deadline(); !ok {
+		t.Error("query context has no deadline with a query timeout")
+	}
+}
+
+func TestSearchReservedFieldNames(t *testing.T) {
+	q := newTestQuery()
+	confLayer := testConfLayer(t, BackendMemory, map[string]string{
+		"1": `{"type":"Feature","properties":{"ID":"1","q":"x","count":"10"},"geometry":{"type":"Polygon","coordinates":[` + square0 + `]}}`,
+		"2": `{"type":"Feature","properties":{"ID":"2","q":"y","count":"10"},"geometry":{"type":"Polygon","coordinates":[` + square5 + `]}}`,
+	})
+	confLayer.Search = []string{"q", "count"}
+	loadTestLayer(t, q, confLayer)
+
+	// q is the search text, which matches the words of every field, named q or not
+	if got := searchIDs(t, q, url.Values{"q": {"y"}}); !equalStrings(got, []string{"2"}) {
+		t.Errorf("text search: %v, want [2]", got)
+	}
+	// other params are fields, whatever the server reserves
+	if got := searchIDs(t, q, url.Values{"count": {"10"}}); !equalStrings(got, []string{"1", "2"}) {
+		t.Errorf("search of field count: %v, want [1 2]", got)
+	}
+}
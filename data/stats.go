@@ -0,0 +1,177 @@
+package data
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/paulmach/orb"
+)
+
+// LayerStats summarizes the features of a layer
+type LayerStats struct {
+	Name     string `json:"name"`
+	Features int    `json:"features"`
+	// Bounds is the [minX, minY, maxX, maxY] of all the features
+	Bounds        []float64       `json:"bounds,omitempty"`
+	GeometryTypes []GeometryCount `json:"geometry_types"`
+	Properties    []PropertyTypes `json:"properties"`
+	// AverageSize is the average size of a feature's data file in bytes
+	AverageSize int64 `json:"average_size"`
+}
+
+// GeometryCount is the number of features of a geometry type
+type GeometryCount struct {
+	Type  string `json:"type"`
+	Count int    `json:"count"`
+}
+
+// PropertyTypes lists the JSON types of the values of a property
+type PropertyTypes struct {
+	Name  string   `json:"name"`
+	Types []string `json:"types"`
+}
+
+// layerStats keeps the stats of a layer for the version they were computed for
+type layerStats struct {
+	mu      sync.Mutex
+	version string
+	stats   *LayerStats
+}
+
+// Stats reads every feature of a layer to summarize them. Stats are kept
+// until the layer is written to, so only the first request reads the features.
+func (q *Query) Stats(ctx context.Context, layer string) (*LayerStats, error) {
+
+	if layer == "" {
+		return nil, ErrQueryMissingLayer
+	}
+
+	l, err := q.acquire(layer)
+	if err != nil {
+		return nil, err
+	}
+	defer l.release()
+
+	l.stats.mu.Lock()
+	defer l.stats.mu.Unlock()
+
+	version, err := l.version()
+	if err != nil {
+		return nil, ErrQueryRequest
+	}
+	if l.stats.stats != nil && l.stats.version == version {
+		return l.stats.stats, nil
+	}
+
+	stats, err := l.computeStats(ctx)
+	if err != nil {
+		return nil, queryError(err)
+	}
+
+	l.stats.version = version
+	l.stats.stats = stats
+
+	return stats, nil
+}
+
+func (l *Layer) computeStats(ctx context.Context) (*LayerStats, error) {
+
+	ids, err := l.ids()
+	if err != nil {
+		return nil, err
+	}
+
+	var bound orb.Bound
+	hasBound := false
+	var total int64
+	read := 0
+	geometries := make(map[string]int)
+	types := make(map[string]map[string]bool)
+
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		file, err := l.store.Get(id)
+		if err != nil {
+			continue
+		}
+		f, size, err := l.readFeature(id, file)
+		if err != nil {
+			continue
+		}
+
+		if f.Geometry != nil {
+			if !hasBound {
+				bound = f.Geometry.Bound()
+				hasBound = true
+			} else {
+				bound = bound.Union(f.Geometry.Bound())
+			}
+			geometries[f.Geometry.GeoJSONType()]++
+		}
+
+		for k, v := range f.Properties {
+			if types[k] == nil {
+				types[k] = make(map[string]bool)
+			}
+			types[k][jsonType(v)] = true
+		}
+
+		total += size
+		read++
+	}
+
+	stats := &LayerStats{
+		Name:          l.Name,
+		Features:      len(ids),
+		GeometryTypes: []GeometryCount{},
+		Properties:    []PropertyTypes{},
+	}
+
+	if hasBound {
+		stats.Bounds = []float64{bound.Min.X(), bound.Min.Y(), bound.Max.X(), bound.Max.Y()}
+	}
+	if read > 0 {
+		stats.AverageSize = total / int64(read)
+	}
+
+	for t, n := range geometries {
+		stats.GeometryTypes = append(stats.GeometryTypes, GeometryCount{Type: t, Count: n})
+	}
+	sort.Slice(stats.GeometryTypes, func(i, j int) bool {
+		return stats.GeometryTypes[i].Type < stats.GeometryTypes[j].Type
+	})
+
+	for k, ts := range types {
+		names := make([]string, 0, len(ts))
+		for t := range ts {
+			names = append(names, t)
+		}
+		sort.Strings(names)
+		stats.Properties = append(stats.Properties, PropertyTypes{Name: k, Types: names})
+	}
+	sort.Slice(stats.Properties, func(i, j int) bool {
+		return stats.Properties[i].Name < stats.Properties[j].Name
+	})
+
+	return stats, nil
+}
+
+func jsonType(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return "number"
+	}
+}
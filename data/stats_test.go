@@ -0,0 +1,125 @@
+package data
+
+import (
+	"context"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+// lshape's bound covers 1.5,1.5, which is outside of the polygon itself
+const lshape = `[[0,0],[2,0],[2,1],[1,1],[1,2],[0,2],[0,0]]`
+
+func TestCount(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			confLayer := testConfLayer(t, backend, map[string]string{
+				"l":    testFeature("l", lshape),
+				"b":    testFeature("b", square5),
+				"fiji": testFeature("fiji", `[[177,-20],[-178,-20],[-178,-15],[177,-15],[177,-20]]`),
+			})
+			confLayer.Search = []string{"ID"}
+			loadTestLayer(t, q, confLayer)
+			ctx := context.Background()
+
+			tests := []struct {
+				name  string
+				count func() (int, error)
+				want  int
+			}{
+				{"bbox", func() (int, error) { return q.BBoxCount(ctx, "test", "-1,-1,7,7") }, 2},
+				{"bbox of one", func() (int, error) { return q.BBoxCount(ctx, "test", "4,4,7,7") }, 1},
+				{"bbox of none", func() (int, error) { return q.BBoxCount(ctx, "test", "10,10,11,11") }, 0},
+				// a feature with two rects is counted once
+				{"bbox across 180", func() (int, error) { return q.BBoxCount(ctx, "test", "170,-20,-170,-10") }, 1},
+				{"point", func() (int, error) { return q.PointCount(ctx, "test", "0.5,0.5") }, 1},
+				// points are tested against geometries, not rects
+				{"point in bound", func() (int, error) { return q.PointCount(ctx, "test", "1.5,1.5") }, 0},
+				{"tile", func() (int, error) { return q.TileCount(ctx, "test", "0", "0", "0") }, 3},
+				{"search", func() (int, error) { return q.SearchCount(ctx, "test", url.Values{"ID": {"b"}}) }, 1},
+			}
+			for _, tt := range tests {
+				n, err := tt.count()
+				if err != nil || n != tt.want {
+					t.Errorf("%s count: %d, %v, want %d", tt.name, n, err, tt.want)
+				}
+			}
+
+			// counts match the number of features their query returns
+			features, err := q.BBox(ctx, "test", "-1,-1,7,7")
+			if err != nil || len(*features) != 2 {
+				t.Errorf("bbox query returned %v", err)
+			}
+			if _, err := q.BBoxCount(ctx, "test", "1,1,1"); err != ErrQueryInvalidBBox {
+				t.Errorf("count of an invalid bbox returned %v, want %v", err, ErrQueryInvalidBBox)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			l := loadTestLayer(t, q, testConfLayer(t, backend, map[string]string{
+				"a": `{"type":"Feature","properties":{"ID":"a","n":1,"tags":["x"]},"geometry":{"type":"Polygon","coordinates":[` + square0 + `]}}`,
+				"b": `{"type":"Feature","properties":{"ID":"b","n":"one","extra":null},"geometry":{"type":"Polygon","coordinates":[` + square5 + `]}}`,
+				"c": `{"type":"Feature","properties":{"ID":"c","n":true},"geometry":{"type":"MultiPolygon","coordinates":[[` + square0 + `]]}}`,
+			}))
+
+			stats, err := q.Stats(context.Background(), "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Name != "test" || stats.Features != 3 || stats.AverageSize <= 0 {
+				t.Errorf("stats: %+v", stats)
+			}
+			if len(stats.Bounds) != 4 || stats.Bounds[0] != 0 || stats.Bounds[1] != 0 || stats.Bounds[2] != 6 || stats.Bounds[3] != 6 {
+				t.Errorf("bounds: %v, want [0 0 6 6]", stats.Bounds)
+			}
+			geometries := []GeometryCount{{"MultiPolygon", 1}, {"Polygon", 2}}
+			if len(stats.GeometryTypes) != 2 || stats.GeometryTypes[0] != geometries[0] || stats.GeometryTypes[1] != geometries[1] {
+				t.Errorf("geometry types: %v, want %v", stats.GeometryTypes, geometries)
+			}
+			properties := map[string][]string{
+				"ID":    {"string"},
+				"extra": {"null"},
+				"n":     {"boolean", "number", "string"},
+				"tags":  {"array"},
+			}
+			if len(stats.Properties) != len(properties) {
+				t.Errorf("properties: %v", stats.Properties)
+			}
+			for _, p := range stats.Properties {
+				if !equalStrings(p.Types, properties[p.Name]) {
+					t.Errorf("property %s types: %v, want %v", p.Name, p.Types, properties[p.Name])
+				}
+			}
+
+			// stats are kept until the layer is written to
+			if err := ioutil.WriteFile(filepath.Join(l.DataDir, "a.geojson"), []byte(testFeature("a", square5)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if again, _ := q.Stats(context.Background(), "test"); again != stats {
+				t.Error("stats were computed again without a write")
+			}
+			if _, _, err := q.Put("test", "d", parseTestFeature(t, testFeature("d", `[[8,8],[9,8],[9,9],[8,8]]`))); err != nil {
+				t.Fatal(err)
+			}
+			stats, err = q.Stats(context.Background(), "test")
+			if err != nil || stats.Features != 4 || stats.Bounds[2] != 9 {
+				t.Errorf("stats after a write: %+v, %v", stats, err)
+			}
+		})
+	}
+
+	q := newTestQuery()
+	if _, err := q.Stats(context.Background(), ""); err != ErrQueryMissingLayer {
+		t.Errorf("stats without a layer returned %v, want %v", err, ErrQueryMissingLayer)
+	}
+	if _, err := q.Stats(context.Background(), "missing"); err == nil {
+		t.Error("stats of a missing layer succeeded")
+	}
+}
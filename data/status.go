@@ -0,0 +1,77 @@
+package data
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	StatusLoading  = "loading"
+	StatusIndexing = "indexing"
+	StatusBuilding = "building"
+	StatusReady    = "ready"
+	StatusFailed   = "failed"
+)
+
+// LayerStatus is the state of the last load (or rebuild) of a layer.
+// A layer that fails to reload keeps serving its previous version.
+type LayerStatus struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Serving   bool      `json:"serving"`
+	Features  int       `json:"features"`
+	Error     string    `json:"error,omitempty"`
+	BuildMs   int64     `json:"build_ms,omitempty"`
+	OpenMs    int64     `json:"open_ms"`
+	IndexMs   int64     `json:"index_ms"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// LayerStatuses returns the status of every layer that was loaded, sorted by name
+func (q *Query) LayerStatuses() []LayerStatus {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	statuses := []LayerStatus{}
+	for name, s := range q.status {
+		status := *s
+		_, status.Serving = q.layers[name]
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// LayerStatus returns the status of a layer, or false if it was never loaded
+func (q *Query) LayerStatus(name string) (LayerStatus, bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	s, ok := q.status[name]
+	if !ok {
+		return LayerStatus{}, false
+	}
+	status := *s
+	_, status.Serving = q.layers[name]
+	return status, true
+}
+
+// setStatus updates the status of a layer under the lock
+func (q *Query) setStatus(name string, update func(s *LayerStatus)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s, ok := q.status[name]
+	if !ok {
+		s = &LayerStatus{Name: name}
+		q.status[name] = s
+	}
+	update(s)
+	s.UpdatedAt = time.Now()
+}
+
+func (q *Query) setFailed(name string, err error) {
+	q.setStatus(name, func(s *LayerStatus) {
+		s.State = StatusFailed
+		s.Error = err.Error()
+	})
+}
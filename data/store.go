@@ -0,0 +1,335 @@
+package data
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/paulmach/orb"
+	"github.com/tidwall/btree"
+	"github.com/tidwall/rtree"
+)
+
+const (
+	BackendBuntDB = "buntdb"
+	BackendMemory = "memory"
+	BackendBolt   = "bolt"
+)
+
+var errNotIndexed error = fmt.Errorf("feature not indexed")
+
+// Store keeps the index entries of a layer, ie. the rects and the data file of each feature
+// (relative to the data dir), and answers spatial queries on them.
+// A feature crossing the antimeridian has more than one rect, so ids passed
+// to Intersects and Nearby iterators are not necessarily unique.
+type Store interface {
+	// Create creates an empty database
+	Create() error
+	Open() error
+	Close() error
+	// Index builds the spatial index of an opened database
+	Index() error
+	// Persistent reports whether entries are kept when the store is closed
+	Persistent() bool
+	// Version changes whenever an entry is put or deleted
+	Version() (int64, error)
+	// Count returns the number of entries
+	Count() (int, error)
+
+	Put(id string, rects []orb.Bound, file string) error
+	// Delete and Get return errNotIndexed for unknown ids
+	Delete(id string) error
+	Get(id string) (string, error)
+
+	// IDs calls iter with the id of every entry, including entries without rects
+	IDs(iter func(id string) bool) error
+	// Rects calls iter with every rect of every entry
+	Rects(iter func(id string, part int, rect orb.Bound) bool) error
+	Intersects(b orb.Bound, iter func(id, file string) bool) error
+	// Nearby iterates entries by the squared distance of their rects to pt
+	Nearby(pt orb.Point, iter func(id, file string, dist float64) bool) error
+
+	// SetTerms replaces the search terms of an entry (see searchTerms),
+	// which Delete deletes with the entry
+	SetTerms(id string, terms []string) error
+	// Terms calls iter with the id of every entry having a term,
+	// or a term starting with it if prefix is set
+	Terms(term string, prefix bool, iter func(id string) bool) error
+}
+
+func newStore(backend, path, index string) (Store, error) {
+	switch backend {
+	case "", BackendBuntDB:
+		return &buntStore{path: path, index: index}, nil
+	case BackendMemory:
+		return newMemStore(), nil
+	case BackendBolt:
+		return &boltStore{path: path, index: index}, nil
+	default:
+		return nil, fmt.Errorf("unknown database backend %s", backend)
+	}
+}
+
+/////////////////////////////////////////////////////////////////////
+
+// memIndex is an in-memory R-tree of entry rects,
+// used by stores without a spatial index of their own
+type memIndex struct {
+	mu    sync.RWMutex
+	tr    *rtree.RTree
+	items map[string][]*memItem
+}
+
+type memItem struct {
+	id       string
+	min, max [2]float64
+}
+
+func (it *memItem) Rect(ctx interface{}) ([]float64, []float64) {
+	return it.min[:], it.max[:]
+}
+
+func newMemItem(id string, b orb.Bound) *memItem {
+	return &memItem{
+		id:  id,
+		min: [2]float64{b.Min[0], b.Min[1]},
+		max: [2]float64{b.Max[0], b.Max[1]},
+	}
+}
+
+func newMemIndex() *memIndex {
+	return &memIndex{
+		tr:    rtree.New(nil),
+		items: make(map[string][]*memItem),
+	}
+}
+
+func (m *memIndex) put(id string, rects []orb.Bound) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(id)
+	items := make([]*memItem, len(rects))
+	for i, b := range rects {
+		items[i] = newMemItem(id, b)
+		m.tr.Insert(items[i])
+	}
+	m.items[id] = items
+}
+
+func (m *memIndex) delete(id string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remove(id)
+}
+
+func (m *memIndex) remove(id string) {
+	for _, it := range m.items[id] {
+		m.tr.Remove(it)
+	}
+	delete(m.items, id)
+}
+
+func (m *memIndex) rects(iter func(id string, part int, rect orb.Bound) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for id, items := range m.items {
+		for part, it := range items {
+			b := orb.Bound{Min: orb.Point(it.min), Max: orb.Point(it.max)}
+			if !iter(id, part, b) {
+				return
+			}
+		}
+	}
+}
+
+func (m *memIndex) search(b orb.Bound, iter func(id string) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	m.tr.Search(newMemItem("", b), func(item rtree.Item) bool {
+		return iter(item.(*memItem).id)
+	})
+}
+
+func (m *memIndex) nearby(pt orb.Point, iter func(id string, dist float64) bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	m.tr.KNN(newMemItem("", pt.Bound()), false, func(item rtree.Item, dist float64) bool {
+		return iter(item.(*memItem).id, dist)
+	})
+}
+
+/////////////////////////////////////////////////////////////////////
+
+// memStore keeps its entries in memory only,
+// so a layer using it is indexed from its data dir whenever it is opened
+type memStore struct {
+	mu      sync.RWMutex
+	idx     *memIndex
+	files   map[string]string
+	version int64
+	// terms holds the term keys of entries (see termKey), in order,
+	// and entryTerms the terms of each entry
+	terms      *btree.BTree
+	entryTerms map[string][]string
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		idx:   newMemIndex(),
+		files: make(map[string]string),
+		terms: btree.New(func(a, b interface{}) bool {
+			return a.(string) < b.(string)
+		}),
+		entryTerms: make(map[string][]string),
+	}
+}
+
+func (s *memStore) Create() error {
+	return fmt.Errorf("memory backend is not persisted")
+}
+
+func (s *memStore) Open() error {
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+func (s *memStore) Index() error {
+	return nil
+}
+
+func (s *memStore) Persistent() bool {
+	return false
+}
+
+func (s *memStore) Version() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.version, nil
+}
+
+func (s *memStore) Count() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.files), nil
+}
+
+// Put and Delete never hold both locks at once, since the
+// index lock is held while Intersects and Nearby look up files
+
+func (s *memStore) Put(id string, rects []orb.Bound, file string) error {
+	s.idx.put(id, rects)
+	s.mu.Lock()
+	s.files[id] = file
+	s.version++
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memStore) Delete(id string) error {
+	s.mu.Lock()
+	_, ok := s.files[id]
+	delete(s.files, id)
+	s.deleteTerms(id)
+	s.version++
+	s.mu.Unlock()
+	if !ok {
+		return errNotIndexed
+	}
+	s.idx.delete(id)
+	return nil
+}
+
+func (s *memStore) Get(id string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	file, ok := s.files[id]
+	if !ok {
+		return "", errNotIndexed
+	}
+	return file, nil
+}
+
+func (s *memStore) IDs(iter func(id string) bool) error {
+	s.mu.RLock()
+	ids := make([]string, 0, len(s.files))
+	for id := range s.files {
+		ids = append(ids, id)
+	}
+	s.mu.RUnlock()
+	sort.Strings(ids)
+	for _, id := range ids {
+		if !iter(id) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Rects(iter func(id string, part int, rect orb.Bound) bool) error {
+	s.idx.rects(iter)
+	return nil
+}
+
+func (s *memStore) Intersects(b orb.Bound, iter func(id, file string) bool) error {
+	s.idx.search(b, func(id string) bool {
+		file, err := s.Get(id)
+		if err != nil {
+			return true
+		}
+		return iter(id, file)
+	})
+	return nil
+}
+
+func (s *memStore) Nearby(pt orb.Point, iter func(id, file string, dist float64) bool) error {
+	s.idx.nearby(pt, func(id string, dist float64) bool {
+		file, err := s.Get(id)
+		if err != nil {
+			return true
+		}
+		return iter(id, file, dist)
+	})
+	return nil
+}
+
+func (s *memStore) SetTerms(id string, terms []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleteTerms(id)
+	for _, term := range terms {
+		s.terms.Set(termKey(term, id))
+	}
+	if len(terms) > 0 {
+		s.entryTerms[id] = terms
+	}
+	return nil
+}
+
+func (s *memStore) deleteTerms(id string) {
+	for _, term := range s.entryTerms[id] {
+		s.terms.Delete(termKey(term, id))
+	}
+	delete(s.entryTerms, id)
+}
+
+func (s *memStore) Terms(term string, prefix bool, iter func(id string) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pivot := termPrefix(term, prefix)
+	s.terms.Ascend(pivot, func(item interface{}) bool {
+		k := item.(string)
+		if !strings.HasPrefix(k, pivot) {
+			return false
+		}
+		id, err := parseTermKey(k)
+		if err != nil {
+			return true
+		}
+		return iter(id)
+	})
+	return nil
+}
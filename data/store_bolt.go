@@ -0,0 +1,363 @@
+package data
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/paulmach/orb"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltBucketRects = []byte("rects")
+	boltBucketFiles = []byte("files")
+	// terms holds the term keys of entries (see termKey),
+	// and entryterms the terms of each entry, separated by spaces
+	boltBucketTerms      = []byte("terms")
+	boltBucketEntryTerms = []byte("entryterms")
+	boltKeyVersion       = []byte("version")
+)
+
+// boltStore keeps entries in a bbolt file, in a bucket named after the layer's index.
+// bbolt has no spatial index, so the rects are loaded into a memIndex by Index.
+type boltStore struct {
+	path  string
+	index string
+	db    *bolt.DB
+
+	idxMu sync.RWMutex // guards idx, which Index replaces while queries use it
+	idx   *memIndex
+}
+
+func (s *boltStore) Create() error {
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(s.index))
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{boltBucketRects, boltBucketFiles, boltBucketTerms, boltBucketEntryTerms} {
+			if _, err := b.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+func (s *boltStore) Open() error {
+	db, err := bolt.Open(s.path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	legacy := false
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(s.index))
+		if b == nil {
+			return fmt.Errorf("index %s not in database", s.index)
+		}
+		legacy = b.Bucket(boltBucketTerms) == nil
+		return nil
+	})
+	if err == nil && legacy {
+		// databases created before search terms were stored
+		err = db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(s.index))
+			for _, name := range [][]byte{boltBucketTerms, boltBucketEntryTerms} {
+				if _, err := b.CreateBucketIfNotExists(name); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		db.Close()
+		return err
+	}
+	s.db = db
+	return nil
+}
+
+func (s *boltStore) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func (s *boltStore) Index() error {
+	idx := newMemIndex()
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return s.bucket(tx, boltBucketRects).ForEach(func(k, v []byte) error {
+			idx.put(string(k), boltDecodeRects(v))
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	s.idxMu.Lock()
+	s.idx = idx
+	s.idxMu.Unlock()
+	return nil
+}
+
+// memIndex returns the index built by Index, nil if it wasn't called yet
+func (s *boltStore) memIndex() *memIndex {
+	s.idxMu.RLock()
+	defer s.idxMu.RUnlock()
+	return s.idx
+}
+
+func (s *boltStore) Persistent() bool {
+	return true
+}
+
+// Version is a counter incremented by every Put and Delete
+func (s *boltStore) Version() (int64, error) {
+	var version int64
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(s.index)).Get(boltKeyVersion); len(v) == 8 {
+			version = int64(binary.BigEndian.Uint64(v))
+		}
+		return nil
+	})
+	return version, err
+}
+
+func (s *boltStore) Count() (int, error) {
+	count := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		count = s.bucket(tx, boltBucketFiles).Stats().KeyN
+		return nil
+	})
+	return count, err
+}
+
+func (s *boltStore) Put(id string, rects []orb.Bound, file string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if err := s.bucket(tx, boltBucketRects).Put([]byte(id), boltEncodeRects(rects)); err != nil {
+			return err
+		}
+		if err := s.bucket(tx, boltBucketFiles).Put([]byte(id), []byte(file)); err != nil {
+			return err
+		}
+		return s.incrementVersion(tx)
+	})
+	if err != nil {
+		return err
+	}
+	if idx := s.memIndex(); idx != nil {
+		idx.put(id, rects)
+	}
+	return nil
+}
+
+func (s *boltStore) Delete(id string) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if s.bucket(tx, boltBucketFiles).Get([]byte(id)) == nil {
+			return errNotIndexed
+		}
+		if err := s.bucket(tx, boltBucketRects).Delete([]byte(id)); err != nil {
+			return err
+		}
+		if err := s.bucket(tx, boltBucketFiles).Delete([]byte(id)); err != nil {
+			return err
+		}
+		if err := s.deleteTerms(tx, id); err != nil {
+			return err
+		}
+		return s.incrementVersion(tx)
+	})
+	if err != nil {
+		return err
+	}
+	if idx := s.memIndex(); idx != nil {
+		idx.delete(id)
+	}
+	return nil
+}
+
+func (s *boltStore) SetTerms(id string, terms []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := s.deleteTerms(tx, id); err != nil {
+			return err
+		}
+		if len(terms) == 0 {
+			return nil
+		}
+		b := s.bucket(tx, boltBucketTerms)
+		for _, term := range terms {
+			if err := b.Put([]byte(termKey(term, id)), []byte{}); err != nil {
+				return err
+			}
+		}
+		return s.bucket(tx, boltBucketEntryTerms).Put([]byte(id), []byte(strings.Join(terms, " ")))
+	})
+}
+
+func (s *boltStore) deleteTerms(tx *bolt.Tx, id string) error {
+	entries := s.bucket(tx, boltBucketEntryTerms)
+	terms := entries.Get([]byte(id))
+	if terms == nil {
+		return nil
+	}
+	b := s.bucket(tx, boltBucketTerms)
+	for _, term := range strings.Fields(string(terms)) {
+		if err := b.Delete([]byte(termKey(term, id))); err != nil {
+			return err
+		}
+	}
+	return entries.Delete([]byte(id))
+}
+
+func (s *boltStore) Terms(term string, prefix bool, iter func(id string) bool) error {
+	pivot := []byte(termPrefix(term, prefix))
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := s.bucket(tx, boltBucketTerms).Cursor()
+		for k, _ := c.Seek(pivot); k != nil && bytes.HasPrefix(k, pivot); k, _ = c.Next() {
+			id, err := parseTermKey(string(k))
+			if err != nil {
+				continue
+			}
+			if !iter(id) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Get(id string) (string, error) {
+	var file string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := s.bucket(tx, boltBucketFiles).Get([]byte(id))
+		if v == nil {
+			return errNotIndexed
+		}
+		file = string(v)
+		return nil
+	})
+	return file, err
+}
+
+func (s *boltStore) IDs(iter func(id string) bool) error {
+	errStop := fmt.Errorf("stop")
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return s.bucket(tx, boltBucketFiles).ForEach(func(k, v []byte) error {
+			if !iter(string(k)) {
+				return errStop
+			}
+			return nil
+		})
+	})
+	if err == errStop {
+		return nil
+	}
+	return err
+}
+
+func (s *boltStore) Rects(iter func(id string, part int, rect orb.Bound) bool) error {
+	errStop := fmt.Errorf("stop")
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return s.bucket(tx, boltBucketRects).ForEach(func(k, v []byte) error {
+			for part, b := range boltDecodeRects(v) {
+				if !iter(string(k), part, b) {
+					return errStop
+				}
+			}
+			return nil
+		})
+	})
+	if err == errStop {
+		return nil
+	}
+	return err
+}
+
+func (s *boltStore) Intersects(b orb.Bound, iter func(id, file string) bool) error {
+	idx := s.memIndex()
+	if idx == nil {
+		return fmt.Errorf("database not indexed")
+	}
+	return s.db.View(func(tx *bolt.Tx) error {
+		files := s.bucket(tx, boltBucketFiles)
+		idx.search(b, func(id string) bool {
+			file := files.Get([]byte(id))
+			if file == nil {
+				return true
+			}
+			return iter(id, string(file))
+		})
+		return nil
+	})
+}
+
+func (s *boltStore) Nearby(pt orb.Point, iter func(id, file string, dist float64) bool) error {
+	idx := s.memIndex()
+	if idx == nil {
+		return fmt.Errorf("database not indexed")
+	}
+	return s.db.View(func(tx *bolt.Tx) error {
+		files := s.bucket(tx, boltBucketFiles)
+		idx.nearby(pt, func(id string, dist float64) bool {
+			file := files.Get([]byte(id))
+			if file == nil {
+				return true
+			}
+			return iter(id, string(file), dist)
+		})
+		return nil
+	})
+}
+
+func (s *boltStore) bucket(tx *bolt.Tx, name []byte) *bolt.Bucket {
+	return tx.Bucket([]byte(s.index)).Bucket(name)
+}
+
+func (s *boltStore) incrementVersion(tx *bolt.Tx) error {
+	b := tx.Bucket([]byte(s.index))
+	var version uint64
+	if v := b.Get(boltKeyVersion); len(v) == 8 {
+		version = binary.BigEndian.Uint64(v)
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, version+1)
+	return b.Put(boltKeyVersion, v)
+}
+
+// rects are encoded as consecutive [minX, minY, maxX, maxY] float64s
+func boltEncodeRects(rects []orb.Bound) []byte {
+	buf := make([]byte, 32*len(rects))
+	for i, r := range rects {
+		for j, f := range [4]float64{r.Min[0], r.Min[1], r.Max[0], r.Max[1]} {
+			binary.LittleEndian.PutUint64(buf[i*32+j*8:], math.Float64bits(f))
+		}
+	}
+	return buf
+}
+
+func boltDecodeRects(buf []byte) []orb.Bound {
+	rects := make([]orb.Bound, len(buf)/32)
+	for i := range rects {
+		f := func(j int) float64 {
+			return math.Float64frombits(binary.LittleEndian.Uint64(buf[i*32+j*8:]))
+		}
+		rects[i] = orb.Bound{Min: orb.Point{f(0), f(1)}, Max: orb.Point{f(2), f(3)}}
+	}
+	return rects
+}
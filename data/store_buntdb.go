@@ -0,0 +1,441 @@
+package data
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/paulmach/orb"
+	"github.com/tidwall/buntdb"
+)
+
+// buntShrinkMinSize is the size a buntdb file grows to before it's shrunk
+const buntShrinkMinSize = 32 << 20
+
+// buntStore keeps entries in a buntdb file, with the rects of each feature
+// under its key (see dbKey, dbPartKey) and its data file under dbFileKey,
+// which is written even if the feature has no rects to index, and its search terms under dbTermKey.
+// buntdb would shrink its file in the background, whenever it likes, so the file is
+// shrunk by Put and Delete instead, which only change it while the layer allows writes.
+type buntStore struct {
+	path  string
+	index string
+	db    *buntdb.DB
+	// shrunk is the size of the file when it was opened or last shrunk
+	shrunk int64
+}
+
+func (s *buntStore) Create() error {
+	db, err := buntdb.Open(s.path)
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(dbFormatKey(s.index), dbFormat, nil)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return err
+	}
+	return db.Close()
+}
+
+func (s *buntStore) Open() error {
+	db, err := buntdb.Open(s.path)
+	if err != nil {
+		return err
+	}
+	var config buntdb.Config
+	if err := db.ReadConfig(&config); err != nil {
+		db.Close()
+		return err
+	}
+	config.AutoShrinkDisabled = true
+	if err := db.SetConfig(config); err != nil {
+		db.Close()
+		return err
+	}
+	if err := buntMigrate(db, s.index); err != nil {
+		db.Close()
+		return fmt.Errorf("unable to migrate database keys: %v", err)
+	}
+	s.db = db
+	s.shrunk, err = s.size()
+	return err
+}
+
+// buntMigrate escapes the ids in the keys of a database created before
+// ids were escaped (see dbFormatKey), then marks the database with the current format
+func buntMigrate(db *buntdb.DB, index string) error {
+	return db.Update(func(tx *buntdb.Tx) error {
+		if _, err := tx.Get(dbFormatKey(index)); err != buntdb.ErrNotFound {
+			return err
+		}
+		legacy := true
+		err := tx.AscendKeys(dbFilePattern(index), func(k, v string) bool {
+			legacy = false
+			return false
+		})
+		if err != nil {
+			return err
+		}
+		// these databases have a single key per feature, with the id as it is
+		keys := make(map[string]string)
+		if legacy {
+			err := tx.AscendKeys(dbPattern(index), func(k, v string) bool {
+				if k != dbKey(index, strings.TrimPrefix(k, index+":")) {
+					keys[k] = v
+				}
+				return true
+			})
+			if err != nil {
+				return err
+			}
+		}
+		for k, v := range keys {
+			if _, err := tx.Delete(k); err != nil {
+				return err
+			}
+			if _, _, err := tx.Set(dbKey(index, strings.TrimPrefix(k, index+":")), v, nil); err != nil {
+				return err
+			}
+		}
+		if len(keys) > 0 {
+			log.Printf("escaped the ids of %d keys of index %s\n", len(keys), index)
+		}
+		_, _, err = tx.Set(dbFormatKey(index), dbFormat, nil)
+		return err
+	})
+}
+
+// shrink rewrites the file once it's twice as large as when it was last shrunk
+func (s *buntStore) shrink() error {
+	size, err := s.size()
+	if err != nil {
+		return err
+	}
+	if size < buntShrinkMinSize || size < 2*s.shrunk {
+		return nil
+	}
+	if err := s.db.Shrink(); err != nil {
+		return err
+	}
+	s.shrunk, err = s.size()
+	return err
+}
+
+func (s *buntStore) size() (int64, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *buntStore) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func (s *buntStore) Index() error {
+	return s.db.CreateSpatialIndex(s.index, dbPattern(s.index), buntdb.IndexRect)
+}
+
+func (s *buntStore) Persistent() bool {
+	return true
+}
+
+// Version is a counter incremented by every Put and Delete.
+// The size of the file isn't used, since it can be the same after writes and a shrink.
+func (s *buntStore) Version() (int64, error) {
+	var version int64
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		version, err = dbVersion(tx, s.index)
+		return err
+	})
+	return version, err
+}
+
+// Count counts the file key of each entry, and the first key of entries
+// written before file keys were stored
+func (s *buntStore) Count() (int, error) {
+	count := 0
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		err := tx.AscendKeys(dbFilePattern(s.index), func(k, v string) bool {
+			count++
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		return tx.AscendKeys(dbPattern(s.index), func(k, v string) bool {
+			id, part, err := dbParseKeyPart(s.index, k)
+			if err != nil || part != 0 {
+				return true
+			}
+			if _, err := tx.Get(dbFileKey(s.index, id)); err == buntdb.ErrNotFound {
+				count++
+			}
+			return true
+		})
+	})
+	return count, err
+}
+
+func (s *buntStore) Put(id string, rects []orb.Bound, file string) error {
+	err := s.db.Update(func(tx *buntdb.Tx) error {
+		if _, err := tx.Delete(dbKey(s.index, id)); err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+		if err := dbDeleteParts(tx, s.index, id); err != nil {
+			return err
+		}
+		for part, b := range rects {
+			if _, _, err := tx.Set(dbPartKey(s.index, id, part), dbBounds(b), nil); err != nil {
+				return err
+			}
+		}
+		if _, _, err := tx.Set(dbFileKey(s.index, id), file, nil); err != nil {
+			return err
+		}
+		return dbIncrementVersion(tx, s.index)
+	})
+	if err != nil {
+		return err
+	}
+	return s.shrink()
+}
+
+// Delete deletes the keys of an entry, which has no rects if its geometry isn't indexed
+// spatially and no file key if it was written before file keys were stored
+func (s *buntStore) Delete(id string) error {
+	err := s.db.Update(func(tx *buntdb.Tx) error {
+		found := false
+		for _, k := range []string{dbKey(s.index, id), dbFileKey(s.index, id)} {
+			if _, err := tx.Delete(k); err == nil {
+				found = true
+			} else if err != buntdb.ErrNotFound {
+				return err
+			}
+		}
+		if !found {
+			return errNotIndexed
+		}
+		if err := dbDeleteParts(tx, s.index, id); err != nil {
+			return err
+		}
+		if err := dbDeleteTerms(tx, s.index, id); err != nil {
+			return err
+		}
+		return dbIncrementVersion(tx, s.index)
+	})
+	if err != nil {
+		return err
+	}
+	return s.shrink()
+}
+
+func (s *buntStore) SetTerms(id string, terms []string) error {
+	err := s.db.Update(func(tx *buntdb.Tx) error {
+		if err := dbDeleteTerms(tx, s.index, id); err != nil {
+			return err
+		}
+		if len(terms) == 0 {
+			return nil
+		}
+		for _, term := range terms {
+			if _, _, err := tx.Set(dbTermKey(s.index, term, id), "", nil); err != nil {
+				return err
+			}
+		}
+		_, _, err := tx.Set(dbTermsKey(s.index, id), strings.Join(terms, " "), nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return s.shrink()
+}
+
+func (s *buntStore) Terms(term string, prefix bool, iter func(id string) bool) error {
+	pivot := dbTermPrefix(s.index, term, prefix)
+	return s.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendGreaterOrEqual("", pivot, func(k, v string) bool {
+			if !strings.HasPrefix(k, pivot) {
+				return false
+			}
+			id, err := parseTermKey(k)
+			if err != nil {
+				return true
+			}
+			return iter(id)
+		})
+	})
+}
+
+func (s *buntStore) Get(id string) (string, error) {
+	var file string
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		var err error
+		file, err = dbFile(tx, s.index, id)
+		return err
+	})
+	return file, err
+}
+
+// IDs iterates the file keys of entries, then the first key of entries
+// written before file keys were stored
+func (s *buntStore) IDs(iter func(id string) bool) error {
+	return s.db.View(func(tx *buntdb.Tx) error {
+		stopped := false
+		err := tx.AscendKeys(dbFilePattern(s.index), func(k, v string) bool {
+			id, err := dbParseFileKey(s.index, k)
+			if err != nil {
+				return true
+			}
+			stopped = !iter(id)
+			return !stopped
+		})
+		if err != nil || stopped {
+			return err
+		}
+		return tx.AscendKeys(dbPattern(s.index), func(k, v string) bool {
+			id, part, err := dbParseKeyPart(s.index, k)
+			if err != nil || part != 0 {
+				return true
+			}
+			if _, err := tx.Get(dbFileKey(s.index, id)); err != buntdb.ErrNotFound {
+				return true
+			}
+			return iter(id)
+		})
+	})
+}
+
+func (s *buntStore) Rects(iter func(id string, part int, rect orb.Bound) bool) error {
+	return s.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendKeys(dbPattern(s.index), func(k, v string) bool {
+			id, part, err := dbParseKeyPart(s.index, k)
+			if err != nil {
+				return true
+			}
+			b, err := dbParseBounds(v)
+			if err != nil {
+				return true
+			}
+			return iter(id, part, b)
+		})
+	})
+}
+
+func (s *buntStore) Intersects(b orb.Bound, iter func(id, file string) bool) error {
+	return s.db.View(func(tx *buntdb.Tx) error {
+		return tx.Intersects(s.index, dbBounds(b), func(k, v string) bool {
+			id, err := dbParseKey(s.index, k)
+			if err != nil {
+				return true
+			}
+			file, err := dbFile(tx, s.index, id)
+			if err != nil {
+				return true
+			}
+			return iter(id, file)
+		})
+	})
+}
+
+func (s *buntStore) Nearby(pt orb.Point, iter func(id, file string, dist float64) bool) error {
+	return s.db.View(func(tx *buntdb.Tx) error {
+		return tx.Nearby(s.index, dbPointBounds(pt), func(k, v string, dist float64) bool {
+			id, err := dbParseKey(s.index, k)
+			if err != nil {
+				return true
+			}
+			file, err := dbFile(tx, s.index, id)
+			if err != nil {
+				return true
+			}
+			return iter(id, file, dist)
+		})
+	})
+}
+
+// dbFile returns the data file of an indexed feature, relative to the data dir.
+// It returns errNotIndexed if the id is not in the index.
+func dbFile(tx *buntdb.Tx, index, id string) (string, error) {
+	file, err := tx.Get(dbFileKey(index, id))
+	if err != buntdb.ErrNotFound {
+		return file, err
+	}
+	if _, err := tx.Get(dbKey(index, id)); err != nil {
+		if err == buntdb.ErrNotFound {
+			return "", errNotIndexed
+		}
+		return "", err
+	}
+	// databases created before file keys were stored
+	// name each data file after its feature id
+	return "", nil
+}
+
+// dbVersion returns the write counter of an index, 0 if it was never written to
+func dbVersion(tx *buntdb.Tx, index string) (int64, error) {
+	v, err := tx.Get(dbVersionKey(index))
+	if err == buntdb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
+
+func dbIncrementVersion(tx *buntdb.Tx, index string) error {
+	version, err := dbVersion(tx, index)
+	if err != nil {
+		return err
+	}
+	_, _, err = tx.Set(dbVersionKey(index), strconv.FormatInt(version+1, 10), nil)
+	return err
+}
+
+// dbDeleteParts deletes the part keys of a feature, leaving its first key
+func dbDeleteParts(tx *buntdb.Tx, index, id string) error {
+	var keys []string
+	err := tx.AscendKeys(dbKey(index, id)+":*", func(k, v string) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if _, err := tx.Delete(k); err != nil {
+			return fmt.Errorf("unable to delete %s: %v", k, err)
+		}
+	}
+	return nil
+}
+
+// dbDeleteTerms deletes the term keys of an entry, and the key listing them
+func dbDeleteTerms(tx *buntdb.Tx, index, id string) error {
+	terms, err := tx.Delete(dbTermsKey(index, id))
+	if err == buntdb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, term := range strings.Fields(terms) {
+		if _, err := tx.Delete(dbTermKey(index, term, id)); err != nil && err != buntdb.ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,535 @@
+package data
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/tidwall/buntdb"
+	bolt "go.etcd.io/bbolt"
+)
+
+// newTestStore opens an empty, indexed store
+func newTestStore(t *testing.T, backend string) Store {
+	t.Helper()
+
+	s, err := newStore(backend, filepath.Join(t.TempDir(), "test.db"), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Persistent() {
+		if err := s.Create(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Index(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close()
+	})
+	return s
+}
+
+func intersecting(t *testing.T, s Store, b orb.Bound) []string {
+	t.Helper()
+	seen := make(map[string]bool)
+	ids := []string{}
+	err := s.Intersects(b, func(id, file string) bool {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id+"="+file)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func storeIDs(t *testing.T, s Store) []string {
+	t.Helper()
+	ids := []string{}
+	if err := s.IDs(func(id string) bool {
+		ids = append(ids, id)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func bound(minX, minY, maxX, maxY float64) orb.Bound {
+	return orb.Bound{Min: orb.Point{minX, minY}, Max: orb.Point{maxX, maxY}}
+}
+
+func TestStore(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			s := newTestStore(t, backend)
+
+			v0, err := s.Version()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.Put("a", []orb.Bound{bound(0, 0, 1, 1)}, "a.geojson"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Put("b", []orb.Bound{bound(5, 5, 6, 6)}, "dir/b.geojson"); err != nil {
+				t.Fatal(err)
+			}
+			// crossing the antimeridian
+			if err := s.Put("c", []orb.Bound{bound(179, 0, 180, 1), bound(-180, 0, -179, 1)}, "c.geojson"); err != nil {
+				t.Fatal(err)
+			}
+
+			if v, _ := s.Version(); v == v0 {
+				t.Error("version didn't change with put")
+			}
+			if n, _ := s.Count(); n != 3 {
+				t.Errorf("count: %d, want 3", n)
+			}
+
+			file, err := s.Get("b")
+			if err != nil || file != "dir/b.geojson" {
+				t.Errorf("get b: %q, %v", file, err)
+			}
+			if _, err := s.Get("x"); err != errNotIndexed {
+				t.Errorf("get of an unknown id returned %v, want %v", err, errNotIndexed)
+			}
+
+			tests := []struct {
+				b    orb.Bound
+				want []string
+			}{
+				{bound(-1, -1, 2, 2), []string{"a=a.geojson"}},
+				{bound(0.5, 0.5, 5.5, 5.5), []string{"a=a.geojson", "b=dir/b.geojson"}},
+				{bound(-179.5, 0, -179.5, 0.5), []string{"c=c.geojson"}},
+				{bound(179.5, 0, 179.5, 0.5), []string{"c=c.geojson"}},
+				{bound(10, 10, 11, 11), []string{}},
+			}
+			for _, tt := range tests {
+				if got := intersecting(t, s, tt.b); !equalStrings(got, tt.want) {
+					t.Errorf("intersects %v: %v, want %v", tt.b, got, tt.want)
+				}
+			}
+
+			var nearest string
+			err = s.Nearby(orb.Point{4, 4}, func(id, file string, dist float64) bool {
+				nearest = id
+				return false
+			})
+			if err != nil || nearest != "b" {
+				t.Errorf("nearest to 4,4: %q, %v, want b", nearest, err)
+			}
+
+			parts := 0
+			s.Rects(func(id string, part int, rect orb.Bound) bool {
+				if id == "c" {
+					parts++
+				}
+				return true
+			})
+			if parts != 2 {
+				t.Errorf("c has %d rects, want 2", parts)
+			}
+
+			// a put replaces all rects of an entry
+			if err := s.Put("c", []orb.Bound{bound(2, 2, 3, 3)}, "c.geojson"); err != nil {
+				t.Fatal(err)
+			}
+			if got := intersecting(t, s, bound(-180, 0, -179, 1)); len(got) != 0 {
+				t.Errorf("replaced rect of c is still indexed: %v", got)
+			}
+			if got := intersecting(t, s, bound(2, 2, 3, 3)); !equalStrings(got, []string{"c=c.geojson"}) {
+				t.Errorf("new rect of c isn't indexed: %v", got)
+			}
+
+			v1, _ := s.Version()
+			if err := s.Delete("a"); err != nil {
+				t.Fatal(err)
+			}
+			if v, _ := s.Version(); v == v1 {
+				t.Error("version didn't change with delete")
+			}
+			if err := s.Delete("a"); err != errNotIndexed {
+				t.Errorf("delete of a deleted id returned %v, want %v", err, errNotIndexed)
+			}
+			if _, err := s.Get("a"); err != errNotIndexed {
+				t.Errorf("get of a deleted id returned %v, want %v", err, errNotIndexed)
+			}
+			if got := intersecting(t, s, bound(-1, -1, 1.5, 1.5)); len(got) != 0 {
+				t.Errorf("deleted a is still indexed: %v", got)
+			}
+			if n, _ := s.Count(); n != 2 {
+				t.Errorf("count after delete: %d, want 2", n)
+			}
+		})
+	}
+}
+
+func TestStoreEntryWithoutRects(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			s := newTestStore(t, backend)
+
+			if err := s.Put("line", nil, "line.geojson"); err != nil {
+				t.Fatal(err)
+			}
+			file, err := s.Get("line")
+			if err != nil || file != "line.geojson" {
+				t.Errorf("get of an entry without rects: %q, %v", file, err)
+			}
+			if n, _ := s.Count(); n != 1 {
+				t.Errorf("count: %d, want 1", n)
+			}
+			if got := intersecting(t, s, bound(-180, -90, 180, 90)); len(got) != 0 {
+				t.Errorf("entry without rects intersects %v", got)
+			}
+
+			// an entry that loses its rects keeps its file
+			if err := s.Put("a", []orb.Bound{bound(0, 0, 1, 1)}, "a.geojson"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Put("a", nil, "a.geojson"); err != nil {
+				t.Fatal(err)
+			}
+			if file, err := s.Get("a"); err != nil || file != "a.geojson" {
+				t.Errorf("get of an entry that lost its rects: %q, %v", file, err)
+			}
+			if got := intersecting(t, s, bound(0, 0, 1, 1)); len(got) != 0 {
+				t.Errorf("entry that lost its rects intersects %v", got)
+			}
+			if err := s.Put("b", []orb.Bound{bound(0, 0, 1, 1), bound(2, 2, 3, 3)}, "b.geojson"); err != nil {
+				t.Fatal(err)
+			}
+			if got := storeIDs(t, s); !equalStrings(got, []string{"a", "b", "line"}) {
+				t.Errorf("ids: %v, want [a b line]", got)
+			}
+
+			if err := s.Delete("line"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Get("line"); err != errNotIndexed {
+				t.Errorf("get of a deleted entry returned %v, want %v", err, errNotIndexed)
+			}
+			if n, _ := s.Count(); n != 2 {
+				t.Errorf("count after delete: %d, want 2", n)
+			}
+		})
+	}
+}
+
+func TestStoreReopen(t *testing.T) {
+	for _, backend := range []string{BackendBuntDB, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			s, _ := newStore(backend, path, "test")
+			if err := s.Create(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Open(); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Put("a", []orb.Bound{bound(0, 0, 1, 1)}, "a.geojson"); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SetTerms("a", []string{"t:main"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			s, _ = newStore(backend, path, "test")
+			if err := s.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if err := s.Index(); err != nil {
+				t.Fatal(err)
+			}
+			if got := intersecting(t, s, bound(0, 0, 1, 1)); !equalStrings(got, []string{"a=a.geojson"}) {
+				t.Errorf("intersects after reopening: %v", got)
+			}
+			if got := termIDs(t, s, "t:main", false); !equalStrings(got, []string{"a"}) {
+				t.Errorf("terms after reopening: %v", got)
+			}
+		})
+	}
+}
+
+func termIDs(t *testing.T, s Store, term string, prefix bool) []string {
+	t.Helper()
+	ids := []string{}
+	if err := s.Terms(term, prefix, func(id string) bool {
+		ids = append(ids, id)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestStoreTerms(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			s := newTestStore(t, backend)
+			for _, id := range []string{"a", "a b", "c"} {
+				if err := s.Put(id, []orb.Bound{bound(0, 0, 1, 1)}, id+".geojson"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for id, terms := range map[string][]string{
+				"a":   {"v:NAME:main", "t:main"},
+				"a b": {"v:NAME:maple", "t:maple"},
+				"c":   {"v:NAME:ma", "t:ma"},
+			} {
+				if err := s.SetTerms(id, terms); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tests := []struct {
+				term   string
+				prefix bool
+				want   []string
+			}{
+				{"t:ma", false, []string{"c"}},
+				{"t:ma", true, []string{"a", "a b", "c"}},
+				{"t:map", true, []string{"a b"}},
+				{"v:NAME:main", false, []string{"a"}},
+				{"v:NAME", true, []string{"a", "a b", "c"}},
+				{"t:x", true, []string{}},
+			}
+			for _, tt := range tests {
+				if got := termIDs(t, s, tt.term, tt.prefix); !equalStrings(got, tt.want) {
+					t.Errorf("terms %q (prefix %v): %v, want %v", tt.term, tt.prefix, got, tt.want)
+				}
+			}
+
+			// terms are replaced, and deleted with their entry
+			if err := s.SetTerms("a", []string{"t:oak"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.Delete("c"); err != nil {
+				t.Fatal(err)
+			}
+			if got := termIDs(t, s, "", true); !equalStrings(got, []string{"a", "a b", "a b"}) {
+				t.Errorf("terms after writes: %v", got)
+			}
+			if got := termIDs(t, s, "t:oak", false); !equalStrings(got, []string{"a"}) {
+				t.Errorf("replaced terms: %v", got)
+			}
+			if err := s.SetTerms("a", nil); err != nil {
+				t.Fatal(err)
+			}
+			if got := termIDs(t, s, "t:oak", false); len(got) != 0 {
+				t.Errorf("cleared terms: %v", got)
+			}
+		})
+	}
+}
+
+func TestBoltStoreWithoutTerms(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	s := &boltStore{path: path, index: "test"}
+	if err := s.Create(); err != nil {
+		t.Fatal(err)
+	}
+
+	// databases created before terms were stored don't have their buckets
+	db, err := bolt.Open(path, 0644, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("test"))
+		if err := b.DeleteBucket(boltBucketTerms); err != nil {
+			return err
+		}
+		return b.DeleteBucket(boltBucketEntryTerms)
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got := termIDs(t, s, "", true); len(got) != 0 {
+		t.Errorf("terms: %v", got)
+	}
+	if err := s.Put("a", nil, "a.geojson"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetTerms("a", []string{"t:main"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := termIDs(t, s, "t:main", false); !equalStrings(got, []string{"a"}) {
+		t.Errorf("terms: %v", got)
+	}
+}
+
+func TestBoltStoreConcurrentIndex(t *testing.T) {
+	s := newTestStore(t, BackendBolt)
+	for i, id := range []string{"a", "b", "c"} {
+		if err := s.Put(id, []orb.Bound{bound(float64(i), 0, float64(i)+1, 1)}, id+".geojson"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			s.Index()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			s.Intersects(bound(0, 0, 3, 1), func(id, file string) bool { return true })
+			s.Nearby(orb.Point{0, 0}, func(id, file string, dist float64) bool { return true })
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			s.Put("d", []orb.Bound{bound(0, 0, 1, 1)}, "d.geojson")
+		}
+	}()
+	wg.Wait()
+
+	if got := intersecting(t, s, bound(0, 0, 0.5, 0.5)); !equalStrings(got, []string{"a=a.geojson", "d=d.geojson"}) {
+		t.Errorf("intersects after concurrent indexing: %v", got)
+	}
+}
+
+func TestBuntStoreLegacyEntries(t *testing.T) {
+	s := newTestStore(t, BackendBuntDB).(*buntStore)
+
+	// databases created before file keys were stored only have the keys of rects
+	err := s.db.Update(func(tx *buntdb.Tx) error {
+		_, _, err := tx.Set(dbKey(s.index, "old"), dbBounds(bound(0, 0, 1, 1)), nil)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("new", []orb.Bound{bound(2, 2, 3, 3)}, "new.geojson"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := storeIDs(t, s); !equalStrings(got, []string{"new", "old"}) {
+		t.Errorf("ids: %v, want [new old]", got)
+	}
+	if n, _ := s.Count(); n != 2 {
+		t.Errorf("count: %d, want 2", n)
+	}
+	if file, err := s.Get("old"); err != nil || file != "" {
+		t.Errorf("get of a legacy entry: %q, %v", file, err)
+	}
+}
+
+func TestBuntStoreMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+
+	// databases created before ids were escaped have the ids in their keys as they are
+	db, err := buntdb.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *buntdb.Tx) error {
+		for _, id := range []string{"urn:ogc:1", "a+b", "100%", "with space", "plain"} {
+			if _, _, err := tx.Set("test:"+id, dbBounds(bound(0, 0, 1, 1)), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for i := 0; i < 2; i++ {
+		s, err := newStore(BackendBuntDB, path, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Index(); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"100%", "a+b", "plain", "urn:ogc:1", "with space"}
+		if got := storeIDs(t, s); !equalStrings(got, want) {
+			t.Errorf("ids after opening %d times: %v, want %v", i+1, got, want)
+		}
+		if file, err := s.Get("urn:ogc:1"); err != nil || file != "" {
+			t.Errorf("get of a migrated entry: %q, %v", file, err)
+		}
+		if got := intersecting(t, s, bound(0, 0, 0.5, 0.5)); len(got) != 5 {
+			t.Errorf("intersects after migration: %v", got)
+		}
+		s.Close()
+	}
+}
+
+func TestBuntStoreVersionAfterShrink(t *testing.T) {
+	s := newTestStore(t, BackendBuntDB).(*buntStore)
+
+	if err := s.Put("a", []orb.Bound{bound(0, 0, 1, 1)}, "a.geojson"); err != nil {
+		t.Fatal(err)
+	}
+	v0, _ := s.Version()
+
+	// rewriting an entry as it was and shrinking the file leaves it the same size,
+	// so only the version tells the database was written to
+	if err := s.Put("a", []orb.Bound{bound(0, 0, 1, 1)}, "a.geojson"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.db.Shrink(); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Version(); err != nil || v == v0 {
+		t.Errorf("version after a write and a shrink: %d, %v, want other than %d", v, err, v0)
+	}
+
+	// the version is kept in the database
+	v1, _ := s.Version()
+	s.Close()
+	if err := s.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := s.Version(); v != v1 {
+		t.Errorf("version after reopening: %d, want %d", v, v1)
+	}
+}
@@ -2,7 +2,9 @@ package data
 
 import (
 	"bytes"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -23,6 +25,29 @@ func filePath(dir, id, ext string) string {
 	return fp
 }
 
+// dataPath resolves a data file of a layer, either from the file stored
+// in the database or, if none was stored, from the feature id.
+// It never resolves to a path outside of the data dir.
+func dataPath(dir, file, id, ext string) (string, error) {
+	fp := filepath.Join(dir, file)
+	if file == "" {
+		fp = filePath(dir, id, ext)
+	}
+	rel, err := filepath.Rel(dir, fp)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path outside of data dir")
+	}
+	return fp, nil
+}
+
+// indexFilepath is the packed R-tree file of a database
+func indexFilepath(dbFilepath string) string {
+	return dbFilepath + ".rtree"
+}
+
 func filename(path string) string {
 	return filepath.Base(path)
 }
@@ -50,14 +75,6 @@ func pathExists(path string) bool {
 
 // files
 
-func read(path, id string) (int64, string, string, error) {
-	f, nbytes, err := feature(path)
-	if err != nil {
-		return 0, "", "", err
-	}
-	return nbytes, fid(f, id), bounds(f.Geometry), nil
-}
-
 func feature(path string) (*geojson.Feature, int64, error) {
 
 	file, err := os.Open(path)
@@ -84,6 +101,48 @@ func feature(path string) (*geojson.Feature, int64, error) {
 	return f, nbytes, nil
 }
 
+// writeFeature writes a feature to a temp file next to path and renames it over path,
+// so that a failed write leaves the current file as it was and readers never see
+// a partly written file
+func writeFeature(path string, f *geojson.Feature) error {
+	b, err := f.MarshalJSON()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// createFile creates an empty file, or fails with an os.IsExist error if there is one
+func createFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 func maxBytes(x, y int64) int64 {
 	if x < y {
 		return y
@@ -106,6 +165,11 @@ func validExtension(path, ext string) bool {
 	return true
 }
 
+// FeatureID returns the id of a feature, ie. its property key
+func FeatureID(f *geojson.Feature, key string) string {
+	return fid(f, key)
+}
+
 func fid(f *geojson.Feature, key string) string {
 	id, ok := f.Properties[key]
 	if !ok {
@@ -124,19 +188,21 @@ func fid(f *geojson.Feature, key string) string {
 	return fid
 }
 
-func bounds(o interface{}) string {
+// rects returns the bounds of a geometry or query,
+// which are split in two if they cross the antimeridian
+func rects(o interface{}) []orb.Bound {
 	switch v := o.(type) {
 	case orb.Bound:
-		return dbPolyBounds(v)
+		return queryBounds(v)
 	case orb.Point:
-		return dbPointBounds(v)
+		return []orb.Bound{v.Bound()}
 	case orb.Polygon:
-		return dbPolyBounds(v.Bound())
+		return geometryBounds(v)
 	case orb.MultiPolygon:
-		return dbPolyBounds(v.Bound())
+		return geometryBounds(v)
 	case maptile.Tile:
-		return dbPolyBounds(v.Bound())
+		return []orb.Bound{v.Bound()}
 	default:
-		return ""
+		return nil
 	}
 }
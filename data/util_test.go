@@ -0,0 +1,63 @@
+package data
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDataPath(t *testing.T) {
+	dir := filepath.Join("/srv", "data")
+
+	tests := []struct {
+		file, id string
+		want     string
+	}{
+		{"a.geojson", "x", "/srv/data/a.geojson"},
+		{"sub/a.geojson", "x", "/srv/data/sub/a.geojson"},
+		{"", "a", "/srv/data/a.geojson"},
+		{"", "sub/../a", "/srv/data/a.geojson"},
+		{"../secret.geojson", "x", ""},
+		{"", "../secret", ""},
+		{"", "../../etc/passwd", ""},
+		{"/etc/passwd", "x", "/srv/data/etc/passwd"},
+	}
+
+	for _, tt := range tests {
+		got, err := dataPath(dir, tt.file, tt.id, ".geojson")
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("file %q id %q resolved to %s outside of the data dir", tt.file, tt.id, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.FromSlash(tt.want) {
+			t.Errorf("file %q id %q: %s, %v, want %s", tt.file, tt.id, got, err, tt.want)
+		}
+	}
+}
+
+func TestIDQueryOutsideDataDir(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			l := loadTestLayer(t, q, testConfLayer(t, backend, map[string]string{
+				"a": testFeature("a", square0),
+			}))
+
+			// a feature file next to the data dir isn't served by its relative path
+			secret := filepath.Join(filepath.Dir(l.DataDir), "secret.geojson")
+			if err := ioutil.WriteFile(secret, []byte(testFeature("secret", square5)), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, id := range []string{"../secret", "..%2Fsecret", "b", ""} {
+				features, err := q.ID(context.Background(), "test", id)
+				if err == nil || len(*features) != 0 {
+					t.Errorf("id query of %q returned %d features", id, len(*features))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package data
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/paulmach/orb"
+)
+
+const (
+	issueEmptyGeometry    = "empty geometry"
+	issueUnsupportedType  = "unsupported geometry type"
+	issueNaNCoordinate    = "nan coordinate"
+	issueUnclosedRing     = "unclosed ring"
+	issueDegenerateRing   = "degenerate ring"
+	issueWrongWinding     = "wrong winding"
+	issueSelfIntersection = "self-intersection"
+)
+
+// validateGeometry returns the issues found in a geometry.
+// Polygon winding follows RFC 7946: exterior rings are counterclockwise, holes are clockwise.
+func validateGeometry(geom orb.Geometry) []string {
+
+	issues := make(map[string]bool)
+
+	switch g := geom.(type) {
+	case nil:
+		issues[issueEmptyGeometry] = true
+	case orb.Point:
+		if hasNaN(g) {
+			issues[issueNaNCoordinate] = true
+		}
+	case orb.Polygon:
+		validatePolygon(g, issues)
+	case orb.MultiPolygon:
+		if len(g) == 0 {
+			issues[issueEmptyGeometry] = true
+		}
+		for _, p := range g {
+			validatePolygon(p, issues)
+		}
+	default:
+		issues[issueUnsupportedType] = true
+	}
+
+	list := []string{}
+	for issue := range issues {
+		list = append(list, issue)
+	}
+	sort.Strings(list)
+
+	return list
+}
+
+func validatePolygon(p orb.Polygon, issues map[string]bool) {
+
+	if len(p) == 0 {
+		issues[issueEmptyGeometry] = true
+		return
+	}
+
+	for i, r := range p {
+
+		if len(r) == 0 {
+			issues[issueEmptyGeometry] = true
+			continue
+		}
+		for _, pt := range r {
+			if hasNaN(pt) {
+				issues[issueNaNCoordinate] = true
+				return
+			}
+		}
+		if !r.Closed() {
+			issues[issueUnclosedRing] = true
+		}
+		if len(closeRing(r)) < 4 {
+			issues[issueDegenerateRing] = true
+			continue
+		}
+		if ringSelfIntersects(closeRing(r)) {
+			issues[issueSelfIntersection] = true
+		}
+		switch r.Orientation() {
+		case 0:
+			issues[issueDegenerateRing] = true
+		case ringOrientation(i):
+		default:
+			issues[issueWrongWinding] = true
+		}
+	}
+}
+
+// repairGeometry closes rings, fixes ring orientation and drops degenerate parts.
+// It returns false if the geometry didn't need any repairs.
+// Self-intersections are not repaired.
+func repairGeometry(geom orb.Geometry) (orb.Geometry, bool) {
+
+	switch g := geom.(type) {
+	case orb.Polygon:
+		p, repaired := repairPolygon(g)
+		if p == nil {
+			return nil, true
+		}
+		return p, repaired
+	case orb.MultiPolygon:
+		mp := orb.MultiPolygon{}
+		repaired := false
+		for _, p := range g {
+			rp, ok := repairPolygon(p)
+			repaired = repaired || ok
+			if rp != nil {
+				mp = append(mp, rp)
+			}
+		}
+		if len(mp) == 0 {
+			return nil, true
+		}
+		return mp, repaired
+	default:
+		return geom, false
+	}
+}
+
+// repairPolygon returns nil if the exterior ring is degenerate
+func repairPolygon(p orb.Polygon) (orb.Polygon, bool) {
+
+	repaired := false
+	rp := orb.Polygon{}
+
+	for i, r := range p {
+
+		degenerate := len(r) == 0
+		for _, pt := range r {
+			if hasNaN(pt) {
+				degenerate = true
+				break
+			}
+		}
+
+		if !degenerate {
+			if !r.Closed() {
+				r = closeRing(r)
+				repaired = true
+			}
+			degenerate = len(r) < 4 || r.Orientation() == 0
+		}
+
+		if degenerate {
+			if i == 0 {
+				return nil, true
+			}
+			repaired = true
+			continue
+		}
+
+		if r.Orientation() != ringOrientation(i) {
+			r = r.Clone()
+			r.Reverse()
+			repaired = true
+		}
+
+		rp = append(rp, r)
+	}
+
+	if len(rp) == 0 {
+		return nil, true
+	}
+
+	return rp, repaired
+}
+
+func ringOrientation(i int) orb.Orientation {
+	if i == 0 {
+		return orb.CCW
+	}
+	return orb.CW
+}
+
+func closeRing(r orb.Ring) orb.Ring {
+	if len(r) == 0 || r.Closed() {
+		return r
+	}
+	cr := append(r.Clone(), r[0])
+	return cr
+}
+
+func hasNaN(pt orb.Point) bool {
+	return math.IsNaN(pt[0]) || math.IsNaN(pt[1]) || math.IsInf(pt[0], 0) || math.IsInf(pt[1], 0)
+}
+
+// ringSelfIntersects sweeps the segments of a closed ring along x
+// and checks each pair of non-adjacent, overlapping segments
+func ringSelfIntersects(r orb.Ring) bool {
+
+	n := len(r) - 1
+	if n < 3 {
+		return false
+	}
+
+	segs := make([]int, n)
+	for i := range segs {
+		segs[i] = i
+	}
+
+	minX := func(i int) float64 { return math.Min(r[i][0], r[i+1][0]) }
+	maxX := func(i int) float64 { return math.Max(r[i][0], r[i+1][0]) }
+
+	sort.Slice(segs, func(a, b int) bool {
+		return minX(segs[a]) < minX(segs[b])
+	})
+
+	for a := 0; a < n; a++ {
+		i := segs[a]
+		for b := a + 1; b < n && minX(segs[b]) <= maxX(i); b++ {
+			j := segs[b]
+			if adjacentSegments(i, j, n) {
+				continue
+			}
+			if segmentsIntersect(r[i], r[i+1], r[j], r[j+1]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func adjacentSegments(i, j, n int) bool {
+	d := i - j
+	if d < 0 {
+		d = -d
+	}
+	return d == 1 || d == n-1
+}
+
+func segmentsIntersect(p1, p2, p3, p4 orb.Point) bool {
+
+	d1 := cross(p3, p4, p1)
+	d2 := cross(p3, p4, p2)
+	d3 := cross(p1, p2, p3)
+	d4 := cross(p1, p2, p4)
+
+	if ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) &&
+		((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0)) {
+		return true
+	}
+
+	return (d1 == 0 && onSegment(p3, p4, p1)) ||
+		(d2 == 0 && onSegment(p3, p4, p2)) ||
+		(d3 == 0 && onSegment(p1, p2, p3)) ||
+		(d4 == 0 && onSegment(p1, p2, p4))
+}
+
+func cross(a, b, c orb.Point) float64 {
+	return (b[0]-a[0])*(c[1]-a[1]) - (b[1]-a[1])*(c[0]-a[0])
+}
+
+func onSegment(a, b, p orb.Point) bool {
+	return math.Min(a[0], b[0]) <= p[0] && p[0] <= math.Max(a[0], b[0]) &&
+		math.Min(a[1], b[1]) <= p[1] && p[1] <= math.Max(a[1], b[1])
+}
+
+/////////////////////////////////////////////////////////////////////
+
+// DataReport is the machine-readable result of checking a layer's data dir
+type DataReport struct {
+	Layer           string          `json:"layer"`
+	Files           int             `json:"files"`
+	MinBytes        int64           `json:"min_bytes"`
+	MaxBytes        int64           `json:"max_bytes"`
+	IssueCounts     map[string]int  `json:"issue_counts"`
+	InvalidFeatures []FeatureIssues `json:"invalid_features"`
+	MissingIDs      []string        `json:"missing_ids"`
+	DuplicateIDs    []DuplicateID   `json:"duplicate_ids"`
+	UnreadableFiles []FeatureIssues `json:"unreadable_files"`
+}
+
+type FeatureIssues struct {
+	File   string   `json:"file"`
+	ID     string   `json:"id,omitempty"`
+	Issues []string `json:"issues"`
+}
+
+type DuplicateID struct {
+	ID    string   `json:"id"`
+	Files []string `json:"files"`
+}
+
+func newDataReport(layer string) *DataReport {
+	return &DataReport{
+		Layer:           layer,
+		IssueCounts:     make(map[string]int),
+		InvalidFeatures: []FeatureIssues{},
+		MissingIDs:      []string{},
+		DuplicateIDs:    []DuplicateID{},
+		UnreadableFiles: []FeatureIssues{},
+	}
+}
+
+func (r *DataReport) addInvalid(file, id string, issues []string) {
+	r.InvalidFeatures = append(r.InvalidFeatures, FeatureIssues{File: file, ID: id, Issues: issues})
+	for _, issue := range issues {
+		r.IssueCounts[issue]++
+	}
+}
+
+func (r *DataReport) addUnreadable(file string, err error) {
+	r.UnreadableFiles = append(r.UnreadableFiles, FeatureIssues{File: file, Issues: []string{err.Error()}})
+}
+
+func (r *DataReport) summary() string {
+	return fmt.Sprintf("invalid geometries: %d | missing ids: %d | duplicate ids: %d | unreadable: %d",
+		len(r.InvalidFeatures), len(r.MissingIDs), len(r.DuplicateIDs), len(r.UnreadableFiles))
+}
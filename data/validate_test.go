@@ -0,0 +1,168 @@
+package data
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb"
+)
+
+var (
+	ccwSquare = orb.Ring{{0, 0}, {4, 0}, {4, 4}, {0, 4}, {0, 0}}
+	cwSquare  = orb.Ring{{0, 0}, {0, 4}, {4, 4}, {4, 0}, {0, 0}}
+	cwHole    = orb.Ring{{1, 1}, {1, 2}, {2, 2}, {2, 1}, {1, 1}}
+	ccwHole   = orb.Ring{{1, 1}, {2, 1}, {2, 2}, {1, 2}, {1, 1}}
+	bowtie    = orb.Ring{{0, 0}, {4, 4}, {4, 0}, {0, 4}, {0, 0}}
+)
+
+func TestValidateGeometry(t *testing.T) {
+	tests := []struct {
+		name   string
+		geom   orb.Geometry
+		issues []string
+	}{
+		{"valid polygon", orb.Polygon{ccwSquare}, nil},
+		{"valid polygon with hole", orb.Polygon{ccwSquare, cwHole}, nil},
+		{"valid multipolygon", orb.MultiPolygon{{ccwSquare}, {ccwSquare, cwHole}}, nil},
+		{"valid point", orb.Point{1, 2}, nil},
+		{"nil", nil, []string{issueEmptyGeometry}},
+		{"empty polygon", orb.Polygon{}, []string{issueEmptyGeometry}},
+		{"empty ring", orb.Polygon{{}}, []string{issueEmptyGeometry}},
+		{"empty multipolygon", orb.MultiPolygon{}, []string{issueEmptyGeometry}},
+		{"line", orb.LineString{{0, 0}, {1, 1}}, []string{issueUnsupportedType}},
+		{"nan point", orb.Point{math.NaN(), 0}, []string{issueNaNCoordinate}},
+		{"inf coordinate", orb.Polygon{{{0, 0}, {math.Inf(1), 0}, {4, 4}, {0, 0}}}, []string{issueNaNCoordinate}},
+		{"unclosed ring", orb.Polygon{ccwSquare[:4]}, []string{issueUnclosedRing}},
+		{"clockwise exterior", orb.Polygon{cwSquare}, []string{issueWrongWinding}},
+		{"counterclockwise hole", orb.Polygon{ccwSquare, ccwHole}, []string{issueWrongWinding}},
+		{"two points", orb.Polygon{{{0, 0}, {1, 1}, {0, 0}}}, []string{issueDegenerateRing}},
+		{"collinear", orb.Polygon{{{0, 0}, {1, 1}, {2, 2}, {0, 0}}}, []string{issueDegenerateRing}},
+		{"bowtie", orb.Polygon{bowtie}, []string{issueDegenerateRing, issueSelfIntersection}},
+		{"unclosed clockwise", orb.Polygon{cwSquare[:4]}, []string{issueUnclosedRing, issueWrongWinding}},
+		{"invalid part", orb.MultiPolygon{{ccwSquare}, {cwSquare}}, []string{issueWrongWinding}},
+	}
+
+	for _, tt := range tests {
+		got := validateGeometry(tt.geom)
+		if strings.Join(got, ",") != strings.Join(tt.issues, ",") {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.issues)
+		}
+	}
+}
+
+func TestRingSelfIntersects(t *testing.T) {
+	tests := []struct {
+		name string
+		ring orb.Ring
+		want bool
+	}{
+		{"square", ccwSquare, false},
+		{"triangle", orb.Ring{{0, 0}, {4, 0}, {2, 3}, {0, 0}}, false},
+		{"concave", orb.Ring{{0, 0}, {4, 0}, {4, 4}, {2, 1}, {0, 4}, {0, 0}}, false},
+		{"bowtie", bowtie, true},
+		{"spike touching an edge", orb.Ring{{0, 0}, {4, 0}, {4, 4}, {2, 0}, {0, 4}, {0, 0}}, true},
+		{"crossing far apart", orb.Ring{{0, 0}, {10, 0}, {10, 1}, {1, 1}, {1, -1}, {0, -1}, {0, 0}}, true},
+	}
+
+	for _, tt := range tests {
+		if got := ringSelfIntersects(tt.ring); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRepairGeometry(t *testing.T) {
+	tests := []struct {
+		name     string
+		geom     orb.Geometry
+		want     orb.Geometry
+		repaired bool
+	}{
+		{"valid", orb.Polygon{ccwSquare, cwHole}, orb.Polygon{ccwSquare, cwHole}, false},
+		{"unclosed", orb.Polygon{ccwSquare[:4]}, orb.Polygon{ccwSquare}, true},
+		{"clockwise exterior", orb.Polygon{cwSquare}, orb.Polygon{reversed(cwSquare)}, true},
+		{"counterclockwise hole", orb.Polygon{ccwSquare, ccwHole}, orb.Polygon{ccwSquare, reversed(ccwHole)}, true},
+		{"degenerate hole", orb.Polygon{ccwSquare, {{1, 1}, {2, 2}, {1, 1}}}, orb.Polygon{ccwSquare}, true},
+		{"nan hole", orb.Polygon{ccwSquare, {{1, 1}, {math.NaN(), 2}, {2, 1}, {1, 1}}}, orb.Polygon{ccwSquare}, true},
+		{"degenerate exterior", orb.Polygon{{{0, 0}, {1, 1}, {0, 0}}, cwHole}, nil, true},
+		{"degenerate part", orb.MultiPolygon{{ccwSquare}, {{{0, 0}, {1, 1}, {0, 0}}}}, orb.MultiPolygon{{ccwSquare}}, true},
+		{"every part degenerate", orb.MultiPolygon{{{{0, 0}, {1, 1}, {0, 0}}}}, nil, true},
+		{"valid multipolygon", orb.MultiPolygon{{ccwSquare}}, orb.MultiPolygon{{ccwSquare}}, false},
+		// self-intersections aren't repaired
+		{"bowtie", orb.Polygon{bowtie}, nil, true},
+		{"point", orb.Point{1, 2}, orb.Point{1, 2}, false},
+	}
+
+	for _, tt := range tests {
+		got, repaired := repairGeometry(tt.geom)
+		if repaired != tt.repaired {
+			t.Errorf("%s: repaired %v, want %v", tt.name, repaired, tt.repaired)
+		}
+		if tt.want == nil {
+			if got != nil {
+				t.Errorf("%s: %v, want nil", tt.name, got)
+			}
+			continue
+		}
+		if got == nil || !orb.Equal(got, tt.want) {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		if issues := validateGeometry(got); len(issues) > 0 {
+			t.Errorf("%s: repaired geometry has issues %v", tt.name, issues)
+		}
+	}
+
+	// the geometry is repaired in a copy
+	p := orb.Polygon{cwSquare.Clone()}
+	repairGeometry(p)
+	if !orb.Equal(p, orb.Polygon{cwSquare}) {
+		t.Error("geometry was repaired in place")
+	}
+}
+
+func reversed(r orb.Ring) orb.Ring {
+	rr := r.Clone()
+	rr.Reverse()
+	return rr
+}
+
+func TestCheckData(t *testing.T) {
+	confLayer := testConfLayer(t, BackendBuntDB, map[string]string{
+		"a":         testFeature("a", square0),
+		"b":         testFeature("b", `[[0,0],[1,0],[1,1],[0,1]]`),
+		"c":         testFeature("a", square5),
+		"d":         `{"type":"Feature","properties":{},"geometry":{"type":"Polygon","coordinates":[` + square0 + `]}}`,
+		"broken":    `{"type":"Feature",`,
+		"bowtie":    testFeature("e", `[[0,0],[4,4],[4,0],[0,4],[0,0]]`),
+		"clockwise": testFeature("f", `[[0,0],[0,1],[1,1],[1,0],[0,0]]`),
+	})
+
+	report, err := NewLayer(confLayer).CheckData()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Files != 6 {
+		t.Errorf("%d files, want 6", report.Files)
+	}
+	if len(report.UnreadableFiles) != 1 {
+		t.Errorf("%d unreadable files, want 1", len(report.UnreadableFiles))
+	}
+	if len(report.MissingIDs) != 1 {
+		t.Errorf("%d missing ids, want 1", len(report.MissingIDs))
+	}
+	if len(report.DuplicateIDs) != 1 || report.DuplicateIDs[0].ID != "a" || len(report.DuplicateIDs[0].Files) != 2 {
+		t.Errorf("duplicate ids %v, want a twice", report.DuplicateIDs)
+	}
+	want := map[string]int{issueUnclosedRing: 1, issueSelfIntersection: 1, issueDegenerateRing: 1, issueWrongWinding: 1}
+	for issue, n := range want {
+		if report.IssueCounts[issue] != n {
+			t.Errorf("%d %s issues, want %d", report.IssueCounts[issue], issue, n)
+		}
+	}
+	if len(report.InvalidFeatures) != 3 {
+		t.Errorf("%d invalid features, want 3", len(report.InvalidFeatures))
+	}
+}
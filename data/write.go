@@ -0,0 +1,340 @@
+package data
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/engelsjk/rtyq/logger"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// Put writes a feature to a layer under the given id, replacing the feature
+// if it exists. It returns true if the feature was created.
+func (q *Query) Put(layer, id string, f *geojson.Feature) (*[]geojson.Feature, bool, error) {
+
+	if layer == "" {
+		return &[]geojson.Feature{}, false, ErrQueryMissingLayer
+	}
+
+	l, err := q.acquire(layer)
+	if err != nil {
+		return &[]geojson.Feature{}, false, err
+	}
+	defer l.release()
+
+	if !l.Writable {
+		return &[]geojson.Feature{}, false, ErrQueryReadOnly
+	}
+
+	if id == "" {
+		return &[]geojson.Feature{}, false, ErrQueryMissingID
+	}
+
+	if f.Properties == nil {
+		f.Properties = geojson.Properties{}
+	}
+	if _, ok := f.Properties[l.DataID]; !ok {
+		f.Properties[l.DataID] = id
+	}
+	if fid(f, l.DataID) != id {
+		return &[]geojson.Feature{}, false, ErrQueryInvalidID
+	}
+
+	created := false
+	err = l.write(id, f, false, func(prev []orb.Bound) {
+		created = prev == nil
+		if created {
+			q.publish(l.Name, ChangeInsert, id, rects(f.Geometry))
+		} else {
+			q.publish(l.Name, ChangeUpdate, id, prev, rects(f.Geometry))
+		}
+	})
+	if err != nil {
+		return &[]geojson.Feature{}, false, err
+	}
+	if created {
+		q.setStatus(l.Name, func(s *LayerStatus) { s.Features++ })
+	}
+
+	return &[]geojson.Feature{*f}, created, nil
+}
+
+// Create adds a new feature to a layer, with the id in its id property
+func (q *Query) Create(layer string, f *geojson.Feature) (*[]geojson.Feature, error) {
+
+	if layer == "" {
+		return &[]geojson.Feature{}, ErrQueryMissingLayer
+	}
+
+	l, err := q.acquire(layer)
+	if err != nil {
+		return &[]geojson.Feature{}, err
+	}
+	defer l.release()
+
+	if !l.Writable {
+		return &[]geojson.Feature{}, ErrQueryReadOnly
+	}
+
+	id := fid(f, l.DataID)
+	if id == "" {
+		return &[]geojson.Feature{}, ErrQueryMissingID
+	}
+
+	err = l.write(id, f, true, func(prev []orb.Bound) {
+		q.publish(l.Name, ChangeInsert, id, rects(f.Geometry))
+	})
+	if err != nil {
+		return &[]geojson.Feature{}, err
+	}
+	q.setStatus(l.Name, func(s *LayerStatus) { s.Features++ })
+
+	return &[]geojson.Feature{*f}, nil
+}
+
+// Delete removes a feature from a layer's index and deletes its data file
+func (q *Query) Delete(layer, id string) error {
+
+	if layer == "" {
+		return ErrQueryMissingLayer
+	}
+
+	l, err := q.acquire(layer)
+	if err != nil {
+		return err
+	}
+	defer l.release()
+
+	if !l.Writable {
+		return ErrQueryReadOnly
+	}
+
+	if id == "" {
+		return ErrQueryMissingID
+	}
+
+	err = l.delete(id, func(prev []orb.Bound) {
+		q.publish(l.Name, ChangeDelete, id, prev)
+	})
+	if err != nil {
+		return err
+	}
+	q.setStatus(l.Name, func(s *LayerStatus) { s.Features-- })
+
+	return nil
+}
+
+///////////////////////////////////////////////////////////////////////////////////////
+
+// write repairs and validates a WGS84 feature, writes it to its data file
+// (in the layer's crs) and puts it in the index. Once it's written, changed is called
+// with the rects of the feature it replaced, or nil if the feature is new, before
+// another write to the layer can start, so that changes are published in the order of the writes.
+// With create, it fails if the id is already indexed.
+func (l *Layer) write(id string, f *geojson.Feature, create bool, changed func(prev []orb.Bound)) error {
+
+	if f.Geometry == nil {
+		return ErrQueryInvalidFeature
+	}
+	if g, repaired := repairGeometry(f.Geometry); repaired {
+		if g == nil {
+			return ErrQueryInvalidFeature
+		}
+		f.Geometry = g
+	}
+	if issues := validateGeometry(f.Geometry); len(issues) > 0 {
+		return ErrQueryInvalidFeature
+	}
+	f.BBox = nil
+
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+
+	if l.frozen {
+		return ErrQueryLayerBusy
+	}
+
+	if err := l.unpack(); err != nil {
+		logger.Error("unable to index layer for writes", logger.Fields{"layer": l.Name, "error": err})
+		return ErrQueryRequest
+	}
+
+	file, err := l.store.Get(id)
+	exists := err == nil
+	if err != nil && err != errNotIndexed {
+		return ErrQueryRequest
+	}
+	if exists && create {
+		return ErrQueryFeatureExists
+	}
+
+	var prev []orb.Bound
+	if exists {
+		prev = []orb.Bound{}
+		if old, err := l.feature(id, file); err == nil {
+			prev = rects(old.Geometry)
+		}
+	}
+	if !exists && filepath.Base(id) != id {
+		// new data files are named after their id
+		return ErrQueryInvalidID
+	}
+
+	fp, err := dataPath(l.DataDir, file, id, l.DataExt)
+	if err != nil {
+		return ErrQueryInvalidID
+	}
+	rel, err := filepath.Rel(l.DataDir, fp)
+	if err != nil {
+		return ErrQueryInvalidID
+	}
+
+	if !exists {
+		// the data file of a new feature must not belong to another feature
+		if err := createFile(fp); err != nil {
+			if os.IsExist(err) {
+				return ErrQueryFeatureExists
+			}
+			logger.Error("unable to create data file", logger.Fields{"layer": l.Name, "file": fp, "error": err})
+			return ErrQueryRequest
+		}
+	}
+
+	if err := writeFeature(fp, l.crs.fromWGS84Feature(f)); err != nil {
+		logger.Error("unable to write feature", logger.Fields{"layer": l.Name, "id": id, "file": fp, "error": err})
+		if !exists {
+			os.Remove(fp)
+		}
+		return ErrQueryRequest
+	}
+	l.uncache(id)
+	if err := l.store.Put(id, rects(f.Geometry), rel); err != nil {
+		logger.Error("unable to index feature", logger.Fields{"layer": l.Name, "id": id, "error": err})
+		if !exists {
+			os.Remove(fp)
+		}
+		return ErrQueryRequest
+	}
+	if err := l.reindex(id, f); err != nil {
+		logger.Error("unable to index search terms of feature", logger.Fields{"layer": l.Name, "id": id, "error": err})
+	}
+
+	l.restamp()
+	changed(prev)
+
+	return nil
+}
+
+// delete deletes a feature, then calls changed with its rects like write
+func (l *Layer) delete(id string, changed func(prev []orb.Bound)) error {
+
+	l.writeMu.Lock()
+	defer l.writeMu.Unlock()
+
+	if l.frozen {
+		return ErrQueryLayerBusy
+	}
+
+	if err := l.unpack(); err != nil {
+		logger.Error("unable to index layer for writes", logger.Fields{"layer": l.Name, "error": err})
+		return ErrQueryRequest
+	}
+
+	file, err := l.store.Get(id)
+	if err == errNotIndexed {
+		return ErrQueryNotFound
+	}
+	if err != nil {
+		return ErrQueryRequest
+	}
+
+	prev := []orb.Bound{}
+	if old, err := l.feature(id, file); err == nil {
+		prev = rects(old.Geometry)
+	}
+
+	if err := l.store.Delete(id); err != nil {
+		logger.Error("unable to delete feature", logger.Fields{"layer": l.Name, "id": id, "error": err})
+		return ErrQueryRequest
+	}
+
+	l.uncache(id)
+	l.restamp()
+	changed(prev)
+
+	fp, err := dataPath(l.DataDir, file, id, l.DataExt)
+	if err != nil {
+		return nil
+	}
+	if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+		logger.Error("unable to remove data file", logger.Fields{"layer": l.Name, "id": id, "file": fp, "error": err})
+	}
+
+	return nil
+}
+
+// freeze makes writes to a layer fail with ErrQueryLayerBusy, once the writes
+// in progress are done, so that its database file doesn't change while it's reloaded
+func (l *Layer) freeze() {
+	l.writeMu.Lock()
+	l.frozen = true
+	l.writeMu.Unlock()
+}
+
+// thaw allows writes to a layer again, if it wasn't replaced after all
+func (l *Layer) thaw() {
+	l.writeMu.Lock()
+	l.frozen = false
+	l.writeMu.Unlock()
+}
+
+// unpack builds the store's own spatial index the first time a layer
+// using a packed R-tree file is written to, since the file can't be updated.
+// The file is then out of date with the database, and isn't used until recreated.
+func (l *Layer) unpack() error {
+	if l.rtree == nil || l.isUnpacked() {
+		return nil
+	}
+	log.Printf("indexing db of layer %s for writes...", l.Name)
+	if err := l.store.Index(); err != nil {
+		return err
+	}
+	log.Println("done")
+	l.mu.Lock()
+	l.unpacked = true
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *Layer) isUnpacked() bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.unpacked
+}
+
+// packedIndex returns the layer's packed R-tree, or nil if the store's index is used
+func (l *Layer) packedIndex() *packedRTree {
+	if l.isUnpacked() {
+		return nil
+	}
+	return l.rtree
+}
+
+// uncache drops a feature that was written or deleted from the feature cache
+func (l *Layer) uncache(id string) {
+	if l.features != nil {
+		l.features.remove(id)
+	}
+}
+
+// restamp records that the database files on disk were changed by the layer
+// itself, so that a reload doesn't reopen them
+func (l *Layer) restamp() {
+	l.mu.Lock()
+	l.stamp = dbStamp(l.DBFilepath)
+	l.modified = time.Now()
+	l.mu.Unlock()
+}
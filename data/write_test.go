@@ -0,0 +1,119 @@
+package data
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/paulmach/orb/geojson"
+)
+
+func parseTestFeature(t *testing.T, s string) *geojson.Feature {
+	t.Helper()
+	f, err := geojson.UnmarshalFeature([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestCreateDoesNotOverwriteDataFile(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend, func(t *testing.T) {
+			q := newTestQuery()
+			// the data file named b backs the feature with id x
+			l := loadTestLayer(t, q, testConfLayer(t, backend, map[string]string{
+				"b": testFeature("x", square0),
+			}))
+			path := filepath.Join(l.DataDir, "b.geojson")
+			before, _ := ioutil.ReadFile(path)
+
+			if _, err := q.Create("test", parseTestFeature(t, testFeature("b", square5))); err != ErrQueryFeatureExists {
+				t.Fatalf("create returned %v, want %v", err, ErrQueryFeatureExists)
+			}
+			if _, _, err := q.Put("test", "b", parseTestFeature(t, testFeature("b", square5))); err != ErrQueryFeatureExists {
+				t.Fatalf("put returned %v, want %v", err, ErrQueryFeatureExists)
+			}
+
+			after, _ := ioutil.ReadFile(path)
+			if string(before) != string(after) {
+				t.Errorf("data file of feature x was overwritten: %s", after)
+			}
+			if _, err := q.ID(context.Background(), "test", "b"); err != ErrQueryNotFound {
+				t.Errorf("id query of b returned %v, want %v", err, ErrQueryNotFound)
+			}
+		})
+	}
+}
+
+func TestPutCreatesAndReplaces(t *testing.T) {
+	q := newTestQuery()
+	l := loadTestLayer(t, q, testConfLayer(t, BackendBuntDB, map[string]string{
+		"a": testFeature("a", square0),
+	}))
+
+	_, created, err := q.Put("test", "c", parseTestFeature(t, testFeature("c", square5)))
+	if err != nil || !created {
+		t.Fatalf("put of a new feature returned %v, %v", created, err)
+	}
+	_, created, err = q.Put("test", "a", parseTestFeature(t, testFeature("a", square5)))
+	if err != nil || created {
+		t.Fatalf("put of an existing feature returned %v, %v", created, err)
+	}
+
+	features, err := q.BBox(context.Background(), "test", "4,4,7,7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*features) != 2 {
+		t.Errorf("bbox query returned %d features, want 2", len(*features))
+	}
+
+	// only the data files are left in the data dir, without temp files
+	files, err := ioutil.ReadDir(l.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".geojson") || strings.HasPrefix(fi.Name(), ".") {
+			t.Errorf("unexpected file in data dir: %s", fi.Name())
+		}
+		if fi.Mode().Perm() != 0644 {
+			t.Errorf("data file %s has mode %v", fi.Name(), fi.Mode().Perm())
+		}
+	}
+}
+
+func TestWriteFeatureFailureKeepsFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.geojson")
+	if err := ioutil.WriteFile(path, []byte(testFeature("a", square0)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a feature that can't be encoded isn't written
+	f := parseTestFeature(t, testFeature("a", square5))
+	f.Properties["bad"] = make(chan int)
+	if err := writeFeature(path, f); err == nil {
+		t.Fatal("write of an invalid feature succeeded")
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != testFeature("a", square0) {
+		t.Errorf("data file changed: %s", b)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("data dir has %d files, want 1", len(files))
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error(err)
+	}
+}
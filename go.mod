@@ -3,7 +3,7 @@ module github.com/engelsjk/rtyq
 go 1.15
 
 require (
-	github.com/fsnotify/fsnotify v1.4.9 // indirect
+	github.com/fsnotify/fsnotify v1.4.9
 	github.com/go-chi/chi v4.1.2+incompatible
 	github.com/go-chi/cors v1.1.1
 	github.com/json-iterator/go v1.1.10
@@ -12,6 +12,7 @@ require (
 	github.com/mitchellh/mapstructure v1.3.3 // indirect
 	github.com/paulmach/orb v0.1.6
 	github.com/pelletier/go-toml v1.8.1 // indirect
+	github.com/prometheus/client_golang v1.8.0
 	github.com/schollz/progressbar/v3 v3.7.0
 	github.com/spf13/afero v1.4.1 // indirect
 	github.com/spf13/cast v1.3.1 // indirect
@@ -19,13 +20,14 @@ require (
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/spf13/viper v1.7.1
 	github.com/stretchr/testify v1.6.1 // indirect
-	github.com/tidwall/btree v0.3.0 // indirect
+	github.com/tidwall/btree v0.3.0
 	github.com/tidwall/buntdb v1.1.4
 	github.com/tidwall/gjson v1.6.3 // indirect
 	github.com/tidwall/match v1.0.2 // indirect
+	github.com/tidwall/rtree v0.0.0-20201027154624-32188eeb08a8
+	go.etcd.io/bbolt v1.3.5
 	golang.org/x/net v0.0.0-20201021035429-f5854403a974 // indirect
 	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68 // indirect
 	golang.org/x/text v0.3.4 // indirect
 	gopkg.in/ini.v1 v1.62.0 // indirect
-	gopkg.in/yaml.v2 v2.3.0 // indirect
 )
@@ -0,0 +1,131 @@
+package logger
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+	LevelOff
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+	LevelOff:   "off",
+}
+
+// Fields are the structured values of a log entry
+type Fields map[string]interface{}
+
+var (
+	mu  sync.Mutex // guards out
+	out io.Writer  = os.Stderr
+
+	level = int32(LevelInfo) // accessed atomically, so that Enabled doesn't contend on mu
+)
+
+// ParseLevel parses debug, info, warn, error or off
+func ParseLevel(s string) (Level, error) {
+	for l, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return l, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %s", s)
+}
+
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// Enabled reports whether entries of a level are written
+func Enabled(l Level) bool {
+	return l >= Level(atomic.LoadInt32(&level)) && l < LevelOff
+}
+
+func Debug(msg string, fields Fields) {
+	write(LevelDebug, msg, fields)
+}
+
+func Info(msg string, fields Fields) {
+	write(LevelInfo, msg, fields)
+}
+
+func Warn(msg string, fields Fields) {
+	write(LevelWarn, msg, fields)
+}
+
+func Error(msg string, fields Fields) {
+	write(LevelError, msg, fields)
+}
+
+// write encodes an entry as a single line of JSON, with its
+// time, level and msg followed by its fields in key order
+func write(l Level, msg string, fields Fields) {
+
+	if !Enabled(l) {
+		return
+	}
+
+	entry := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		entry[k] = v
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = levelNames[l]
+	entry["msg"] = msg
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"level": levelNames[LevelError], "msg": "unable to encode log entry", "error": err.Error()})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	out.Write(append(b, '\n'))
+}
+
+// Writer returns a writer that logs each line written to it as an info entry.
+// It lets progress output of the standard log package be structured, with log.SetOutput(logger.Writer()).
+// Warnings and errors are logged with Warn and Error instead, with their fields.
+func Writer() io.Writer {
+	return lineWriter{}
+}
+
+type lineWriter struct{}
+
+func (lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		write(LevelInfo, line, nil)
+	}
+	return len(p), nil
+}
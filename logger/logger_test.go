@@ -0,0 +1,126 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func captureOutput(t *testing.T, l Level) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetLevel(l)
+	t.Cleanup(func() {
+		SetOutput(os.Stderr)
+		SetLevel(LevelInfo)
+	})
+	return &buf
+}
+
+func entries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var es []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("log line isn't JSON: %s", line)
+		}
+		es = append(es, e)
+	}
+	return es
+}
+
+func TestParseLevel(t *testing.T) {
+	for s, want := range map[string]Level{"debug": LevelDebug, "INFO": LevelInfo, "Warn": LevelWarn, "error": LevelError, "off": LevelOff} {
+		l, err := ParseLevel(s)
+		if err != nil || l != want {
+			t.Errorf("level %s: %v, %v, want %v", s, l, err, want)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("unknown level was parsed")
+	}
+}
+
+func TestLevels(t *testing.T) {
+	buf := captureOutput(t, LevelWarn)
+
+	Info("skipped", nil)
+	Warn("written", Fields{"layer": "parcels", "count": 2})
+	Error("failed", Fields{"error": os.ErrNotExist})
+
+	es := entries(t, buf)
+	if len(es) != 2 {
+		t.Fatalf("%d entries written, want 2", len(es))
+	}
+	if es[0]["level"] != "warn" || es[0]["msg"] != "written" || es[0]["layer"] != "parcels" || es[0]["count"] != float64(2) {
+		t.Errorf("unexpected entry %v", es[0])
+	}
+	if es[1]["error"] != os.ErrNotExist.Error() {
+		t.Errorf("error field %v, want %q", es[1]["error"], os.ErrNotExist.Error())
+	}
+	if _, ok := es[0]["time"]; !ok {
+		t.Error("entry has no time")
+	}
+
+	SetLevel(LevelOff)
+	Error("skipped", nil)
+	if Enabled(LevelError) {
+		t.Error("error level enabled with logging off")
+	}
+	if len(entries(t, buf)) != 2 {
+		t.Error("entry written with logging off")
+	}
+}
+
+func TestWriter(t *testing.T) {
+	buf := captureOutput(t, LevelInfo)
+
+	Writer().Write([]byte("loading layer\nwarning: no features\n\nunable to open database\n"))
+
+	// the level isn't guessed from the text
+	es := entries(t, buf)
+	want := []struct{ level, msg string }{
+		{"info", "loading layer"},
+		{"info", "warning: no features"},
+		{"info", "unable to open database"},
+	}
+	if len(es) != len(want) {
+		t.Fatalf("%d entries written, want %d", len(es), len(want))
+	}
+	for i, w := range want {
+		if es[i]["level"] != w.level || es[i]["msg"] != w.msg {
+			t.Errorf("entry %d: %v, want %s %q", i, es[i], w.level, w.msg)
+		}
+	}
+}
+
+func TestConcurrentLevel(t *testing.T) {
+	captureOutput(t, LevelInfo)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				SetLevel(Level(j % 4))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				Enabled(LevelInfo)
+				Debug("entry", Fields{"j": j})
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -2,16 +2,20 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/engelsjk/rtyq/conf"
 	"github.com/engelsjk/rtyq/data"
+	"github.com/engelsjk/rtyq/logger"
 	"github.com/engelsjk/rtyq/server"
 )
 
@@ -19,9 +23,12 @@ func main() {
 
 	checkCmd := flag.NewFlagSet("check", flag.ExitOnError)
 	checkFlagConfigFilename := checkCmd.String("config", "config.json", "config file")
+	checkFlagReportFilename := checkCmd.String("report", "", "write a json report of the checked data to this file")
 
 	createCmd := flag.NewFlagSet("create", flag.ExitOnError)
 	createFlagConfigFilename := createCmd.String("config", "config.json", "config file")
+	createFlagRepair := createCmd.Bool("repair", false, "index geometries with repaired ring closure and orientation and without degenerate parts")
+	createFlagRewrite := createCmd.Bool("rewrite", false, "with -repair, replace the data files of repaired features with the repaired features")
 
 	startCmd := flag.NewFlagSet("start", flag.ExitOnError)
 	startFlagConfigFilename := startCmd.String("config", "config.json", "config file")
@@ -35,11 +42,18 @@ func main() {
 	case "check":
 		checkCmd.Parse(os.Args[2:])
 		conf.InitConfig(*checkFlagConfigFilename)
-		check()
+		check(*checkFlagReportFilename)
 	case "create":
 		createCmd.Parse(os.Args[2:])
 		conf.InitConfig(*createFlagConfigFilename)
-		create()
+		repair := data.RepairNone
+		if *createFlagRepair {
+			repair = data.RepairIndex
+			if *createFlagRewrite {
+				repair = data.RepairRewrite
+			}
+		}
+		create(repair)
 	case "start":
 		startCmd.Parse(os.Args[2:])
 		conf.InitConfig(*startFlagConfigFilename)
@@ -50,18 +64,34 @@ func main() {
 	}
 }
 
-func check() {
+func check(reportFilename string) {
+	reports := []*data.DataReport{}
 	for _, confLayer := range conf.Configuration.Layers {
 		layer := data.NewLayer(confLayer)
 		log.Printf("checking layer: %s\n", layer.Name)
-		if err := layer.CheckData(); err != nil {
+		report, err := layer.CheckData()
+		if err != nil {
 			log.Println(err)
 			continue
 		}
+		reports = append(reports, report)
+	}
+	if reportFilename == "" {
+		return
+	}
+	b, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		log.Println(err)
+		return
 	}
+	if err := ioutil.WriteFile(reportFilename, b, 0644); err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("report written to %s\n", reportFilename)
 }
 
-func create() {
+func create(repair data.Repair) {
 	for _, confLayer := range conf.Configuration.Layers {
 		layer := data.NewLayer(confLayer)
 		log.Printf("creating layer: %s\n", layer.Name)
@@ -73,58 +103,111 @@ func create() {
 			log.Println(err)
 			continue
 		}
-		if err := layer.AddDataToDatabase(); err != nil {
+		if err := layer.AddDataToDatabase(repair); err != nil {
 			log.Println(err)
 			continue
 		}
+		if err := layer.CreateIndexFile(); err != nil {
+			log.Println(err)
+		}
+		if err := layer.CloseDatabase(); err != nil {
+			log.Println(err)
+		}
 	}
 }
 
 func start() {
+	level, err := logger.ParseLevel(conf.Configuration.Server.LogLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logger.SetLevel(level)
+	log.SetFlags(0)
+	log.SetOutput(logger.Writer())
+
 	load()
 	serve()
 }
 
+// load loads the configured layers in the background,
+// so that the server can report on them while they load
 func load() {
-	for _, confLayer := range conf.Configuration.Layers {
-		layer := data.NewLayer(confLayer)
-
-		log.Printf("loading layer: %s\n", layer.Name)
+	go data.QueryHandler.Reload(conf.Layers(), false)
+}
 
-		if err := layer.OpenDatabase(); err != nil {
-			log.Println(err)
-			continue
-		}
-		if err := layer.IndexDatabase(); err != nil {
-			log.Println(err)
-			continue
-		}
-		data.AddLayerToQueryHandler(layer)
+func reload() {
+	log.Println("reloading config")
+	if err := conf.ReloadConfig(); err != nil {
+		logger.Error("unable to reload config", logger.Fields{"error": err})
+		return
 	}
+	data.QueryHandler.Reload(conf.Layers(), false)
 }
 
 func serve() {
 
-	srv := server.Create()
+	srv, err := server.Create()
+	if err != nil {
+		logger.Error("unable to create server", logger.Fields{"error": err})
+		os.Exit(1)
+	}
+
+	confServer := conf.Configuration.Server
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Println(err)
+		var err error
+		if server.TLSEnabled() {
+			err = srv.ListenAndServeTLS(confServer.TLSCert, confServer.TLSKey)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("unable to serve", logger.Fields{"error": err})
+			os.Exit(1)
 		}
 	}()
 
-	log.Printf("listening at http://%s\n", srv.Addr)
+	logger.Info("listening", logger.Fields{"addr": srv.Addr, "tls": server.TLSEnabled()})
+
+	redirectSrv := server.CreateRedirect()
+	if redirectSrv != nil {
+		go func() {
+			if err := redirectSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.Error("unable to serve redirect", logger.Fields{"error": err})
+				os.Exit(1)
+			}
+		}()
+		logger.Info("redirecting to https", logger.Fields{"addr": redirectSrv.Addr})
+	}
+
+	conf.WatchConfig(reload)
 
 	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, os.Interrupt)
-	<-sig
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer cancel()
-	srv.Shutdown(ctx)
+	signal.Notify(sig, os.Interrupt, syscall.SIGHUP)
+	for s := range sig {
+		if s != syscall.SIGHUP {
+			logger.Info("shutting down", logger.Fields{"signal": s.String()})
+			break
+		}
+		go reload()
+	}
 
-	abortTimeoutSec := conf.Configuration.Server.WriteTimeoutSec + 10
+	// in-flight requests get up to the write timeout to finish,
+	// and the process is aborted if shutdown hangs past that
+	shutdownTimeoutSec := conf.Configuration.Server.WriteTimeoutSec
+	abortTimeoutSec := shutdownTimeoutSec + 10
 	chanCancelFatal := server.FatalAfter(abortTimeoutSec, "timeout on shutdown - aborting")
 
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(shutdownTimeoutSec)*time.Second)
+	defer cancel()
+	if redirectSrv != nil {
+		redirectSrv.Shutdown(ctx)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("shutdown incomplete", logger.Fields{"error": err})
+	} else {
+		logger.Info("shutdown complete", nil)
+	}
+
 	close(chanCancelFatal)
 }
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/data"
+	"github.com/go-chi/chi"
+)
+
+const (
+	queryParamForce = "force"
+)
+
+var (
+	ErrUnauthorized       error = fmt.Errorf("unauthorized")
+	ErrLayerExists        error = fmt.Errorf("layer already exists")
+	ErrInvalidLayerConfig error = fmt.Errorf("invalid layer config")
+)
+
+// addAdminRoutes adds the /admin routes if an admin key is configured.
+// Requests must send the key as a bearer token.
+func addAdminRoutes(router *chi.Mux) {
+
+	if conf.Configuration.Server.AdminKey == "" {
+		return
+	}
+
+	router.Route("/admin", func(r chi.Router) {
+		r.Use(adminAuth)
+
+		r.Method(http.MethodPost, "/reload", serverHandler(handleAdminReload))
+
+		r.Method(http.MethodGet, "/layers", serverHandler(handleAdminLayers))
+		r.Method(http.MethodPost, "/layers", serverHandler(handleAdminAddLayer))
+
+		for _, path := range []string{"/layers/{layer}", "/layers/{layer}/{sublayer}"} {
+			r.Method(http.MethodGet, path, serverHandler(handleAdminLayer))
+			r.Method(http.MethodDelete, path, serverHandler(handleAdminRemoveLayer))
+			r.Method(http.MethodPost, path+"/reload", serverHandler(handleAdminReloadLayer))
+			r.Method(http.MethodPost, path+"/rebuild", serverHandler(handleAdminRebuildLayer))
+		}
+	})
+}
+
+func adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		key := conf.Configuration.Server.AdminKey
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) != 1 {
+			writeError(w, http.StatusUnauthorized, ErrUnauthorized.Error())
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type adminAccepted struct {
+	Status string `json:"status"`
+	Layer  string `json:"layer,omitempty"`
+}
+
+////////////////////////////////////////////////////////////////////////
+
+func handleAdminReload(w http.ResponseWriter, r *http.Request) *serverError {
+
+	force := getRequestParam(queryParamForce, r) == "true"
+
+	if err := conf.ReloadConfig(); err != nil {
+		return serverErrorInternal(err, fmt.Sprintf("unable to reload config: %v", err))
+	}
+
+	go data.QueryHandler.Reload(conf.Layers(), force)
+
+	return writeJSONStatus(w, ContentTypeJSON, http.StatusAccepted, adminAccepted{Status: "reloading"})
+}
+
+func handleAdminLayers(w http.ResponseWriter, r *http.Request) *serverError {
+	return writeJSON(w, ContentTypeJSON, data.QueryHandler.LayerStatuses())
+}
+
+func handleAdminLayer(w http.ResponseWriter, r *http.Request) *serverError {
+
+	layer := getAdminLayer(r)
+
+	status, ok := data.QueryHandler.LayerStatus(layer)
+	if !ok {
+		return serverErrorNotFound(ErrNotFound, ErrNotFound.Error())
+	}
+
+	return writeJSON(w, ContentTypeJSON, status)
+}
+
+// handleAdminAddLayer adds a layer from a layer config in the request body, e.g.
+// {"name": "states", "data": {"dir": ..., "ext": ..., "id": ...}, "database": {"filepath": ..., "index": ...}}
+func handleAdminAddLayer(w http.ResponseWriter, r *http.Request) *serverError {
+
+	var confLayer conf.Layer
+	if err := json.NewDecoder(r.Body).Decode(&confLayer); err != nil {
+		return serverErrorBadRequest(err, ErrInvalidLayerConfig.Error())
+	}
+
+	if confLayer.Name == "" || confLayer.Data.Dir == "" || confLayer.Data.ID == "" ||
+		confLayer.Database.Index == "" ||
+		(confLayer.Database.Filepath == "" && confLayer.Database.Backend != data.BackendMemory) {
+		return serverErrorBadRequest(ErrInvalidLayerConfig, ErrInvalidLayerConfig.Error())
+	}
+
+	if !conf.AddLayer(confLayer) {
+		return serverErrorConflict(ErrLayerExists, ErrLayerExists.Error())
+	}
+
+	go data.QueryHandler.ReloadLayer(confLayer)
+
+	return writeJSONStatus(w, ContentTypeJSON, http.StatusAccepted, adminAccepted{Status: "loading", Layer: confLayer.Name})
+}
+
+func handleAdminRemoveLayer(w http.ResponseWriter, r *http.Request) *serverError {
+
+	layer := getAdminLayer(r)
+
+	configured := conf.RemoveLayer(layer)
+	if err := data.QueryHandler.RemoveLayer(layer); err != nil && !configured {
+		return serverErrorNotFound(ErrNotFound, ErrNotFound.Error())
+	}
+
+	return writeJSON(w, ContentTypeJSON, adminAccepted{Status: "removed", Layer: layer})
+}
+
+func handleAdminReloadLayer(w http.ResponseWriter, r *http.Request) *serverError {
+
+	layer := getAdminLayer(r)
+
+	confLayer, ok := conf.GetLayer(layer)
+	if !ok {
+		return serverErrorNotFound(ErrNotFound, ErrNotFound.Error())
+	}
+
+	go data.QueryHandler.ReloadLayer(confLayer)
+
+	return writeJSONStatus(w, ContentTypeJSON, http.StatusAccepted, adminAccepted{Status: "loading", Layer: layer})
+}
+
+func handleAdminRebuildLayer(w http.ResponseWriter, r *http.Request) *serverError {
+
+	layer := getAdminLayer(r)
+
+	confLayer, ok := conf.GetLayer(layer)
+	if !ok {
+		return serverErrorNotFound(ErrNotFound, ErrNotFound.Error())
+	}
+
+	go data.QueryHandler.RebuildLayer(confLayer)
+
+	return writeJSONStatus(w, ContentTypeJSON, http.StatusAccepted, adminAccepted{Status: "building", Layer: layer})
+}
+
+func getAdminLayer(r *http.Request) string {
+	layer := getRequestVar(routeVarLayer, r)
+	if sublayer := getRequestVar(routeVarSubLayer, r); sublayer != "" {
+		layer = fmt.Sprintf("%s/%s", layer, sublayer)
+	}
+	return layer
+}
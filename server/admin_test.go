@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/data"
+)
+
+// waitForLayer waits for the layer status to satisfy ok, since admin requests load layers in the background
+func waitForLayer(t *testing.T, name string, ok func(s data.LayerStatus, found bool) bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s, found := data.QueryHandler.LayerStatus(name)
+		if ok(s, found) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("layer %s: %+v", name, s)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func layerReadyAfter(since time.Time) func(s data.LayerStatus, found bool) bool {
+	return func(s data.LayerStatus, found bool) bool {
+		return found && s.State == data.StatusReady && s.Serving && !s.UpdatedAt.Before(since)
+	}
+}
+
+func serveAdmin(router http.Handler, method, target, body string) int {
+	r, _ := http.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestAdminLayers(t *testing.T) {
+	parcels := testLayer(t, conf.Layer{Name: "parcels"}, map[string]string{
+		"a": testFeature("a", square0),
+	})
+	router := testRouter(t, conf.Server{AdminKey: "secret"}, parcels)
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret")
+	w := serve(router, "GET", "/admin/layers", header)
+	var statuses []data.LayerStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("layers: %s", w.Body.String())
+	}
+	if len(statuses) != 1 || statuses[0].Name != "parcels" || !statuses[0].Serving || statuses[0].Features != 1 {
+		t.Errorf("layers: %+v", statuses)
+	}
+
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.geojson"), []byte(testFeature("b", square5)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	added := `{"name":"added","data":{"dir":"` + filepath.ToSlash(dir) + `","ext":".geojson","id":"ID"},"database":{"backend":"memory","index":"added"}}`
+
+	tests := []struct {
+		method, target, body string
+		code                 int
+	}{
+		{"GET", "/admin/layers/parcels", "", http.StatusOK},
+		{"GET", "/admin/layers/missing", "", http.StatusNotFound},
+		{"POST", "/admin/layers", "{", http.StatusBadRequest},
+		{"POST", "/admin/layers", `{"name":"other"}`, http.StatusBadRequest},
+		{"POST", "/admin/layers", strings.Replace(added, `"added"`, `"parcels"`, 1), http.StatusConflict},
+		{"POST", "/admin/layers/missing/reload", "", http.StatusNotFound},
+		{"POST", "/admin/layers/missing/rebuild", "", http.StatusNotFound},
+		{"DELETE", "/admin/layers/missing", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code := serveAdmin(router, tt.method, tt.target, tt.body); code != tt.code {
+			t.Errorf("%s %s: %d, want %d", tt.method, tt.target, code, tt.code)
+		}
+	}
+
+	// a layer is added, reloaded and rebuilt in the background, then serves queries
+	since := time.Now()
+	if code := serveAdmin(router, "POST", "/admin/layers", added); code != http.StatusAccepted {
+		t.Fatalf("add layer: %d, want %d", code, http.StatusAccepted)
+	}
+	t.Cleanup(func() {
+		conf.RemoveLayer("added")
+		data.QueryHandler.RemoveLayer("added")
+	})
+	waitForLayer(t, "added", layerReadyAfter(since))
+	if w := serve(router, "GET", "/added/id/b", nil); w.Code != http.StatusOK {
+		t.Errorf("id query of an added layer: %d", w.Code)
+	}
+
+	for _, action := range []string{"reload", "rebuild"} {
+		since = time.Now()
+		if code := serveAdmin(router, "POST", "/admin/layers/added/"+action, ""); code != http.StatusAccepted {
+			t.Fatalf("%s layer: %d, want %d", action, code, http.StatusAccepted)
+		}
+		waitForLayer(t, "added", layerReadyAfter(since))
+	}
+
+	if code := serveAdmin(router, "DELETE", "/admin/layers/added", ""); code != http.StatusOK {
+		t.Fatalf("remove layer: %d, want %d", code, http.StatusOK)
+	}
+	if _, ok := conf.GetLayer("added"); ok {
+		t.Error("removed layer is still configured")
+	}
+	if w := serve(router, "GET", "/added/id/b", nil); w.Code == http.StatusOK {
+		t.Error("removed layer still serves queries")
+	}
+	if code := serveAdmin(router, "DELETE", "/admin/layers/added", ""); code != http.StatusNotFound {
+		t.Errorf("remove a removed layer: %d, want %d", code, http.StatusNotFound)
+	}
+}
+
+func TestAdminReload(t *testing.T) {
+	parcels := testLayer(t, conf.Layer{Name: "parcels"}, map[string]string{
+		"a": testFeature("a", square0),
+	})
+	router := testRouter(t, conf.Server{AdminKey: "secret"}, parcels)
+
+	before, _ := data.QueryHandler.LayerStatus("parcels")
+	since := time.Now()
+	if code := serveAdmin(router, "POST", "/admin/reload?force=true", ""); code != http.StatusAccepted {
+		t.Fatalf("forced reload: %d, want %d", code, http.StatusAccepted)
+	}
+	waitForLayer(t, "parcels", layerReadyAfter(since))
+
+	after, _ := data.QueryHandler.LayerStatus("parcels")
+	if !after.UpdatedAt.After(before.UpdatedAt) {
+		t.Error("forced reload didn't reload the layer")
+	}
+	if w := serve(router, "GET", "/parcels/id/a", nil); w.Code != http.StatusOK {
+		t.Errorf("id query after a reload: %d", w.Code)
+	}
+}
@@ -0,0 +1,378 @@
+package server
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/go-chi/chi"
+)
+
+const (
+	queryParamAPIKey      = "api_key"
+	queryParamAccessToken = "access_token"
+	// allLayers grants access to every layer
+	allLayers = "*"
+	// jwtLeeway allows for clock skew when checking exp and nbf
+	jwtLeeway = time.Minute
+)
+
+var (
+	ErrForbidden    error = fmt.Errorf("forbidden")
+	ErrInvalidToken error = fmt.Errorf("invalid token")
+)
+
+// auth grants access to layers by API key or by the claims of a JWT.
+// It's only enabled if keys or a JWKS file are configured, and then every
+// layer that isn't public requires credentials.
+type auth struct {
+	conf conf.Auth
+	keys []jwk
+}
+
+// jwk is a key of a JWKS file, either an RSA public key for RS256
+// or a symmetric (oct) key for HS256
+type jwk struct {
+	kid    string
+	alg    string
+	rsa    *rsa.PublicKey
+	secret []byte
+}
+
+var authorizer *auth
+
+func newAuth(c conf.Auth) (*auth, error) {
+
+	if len(c.Keys) == 0 && c.JWKSFile == "" {
+		return nil, nil
+	}
+
+	a := &auth{conf: c}
+
+	if c.JWKSFile != "" {
+		keys, err := readJWKS(c.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		a.keys = keys
+	}
+	if a.conf.LayersClaim == "" {
+		a.conf.LayersClaim = "layers"
+	}
+	if a.conf.WriteLayersClaim == "" {
+		a.conf.WriteLayersClaim = "write_layers"
+	}
+
+	return a, nil
+}
+
+// authorize checks that a request may access the layer it's for, and may write to it
+// if it's a write. Requests that aren't for a layer, and requests for the admin routes
+// (which check the admin key), are let through.
+func authorize(r *http.Request) *serverError {
+
+	if authorizer == nil {
+		return nil
+	}
+	if isAdminRoute(r) {
+		return nil
+	}
+
+	layer := getRequestVar(routeVarLayer, r)
+	if layer == "" {
+		return nil
+	}
+	if sublayer := getRequestVar(routeVarSubLayer, r); sublayer != "" {
+		layer = fmt.Sprintf("%s/%s", layer, sublayer)
+	}
+
+	write := isWrite(r)
+
+	confLayer, ok := conf.GetLayer(layer)
+	if !ok || (confLayer.Public && !write) {
+		return nil
+	}
+
+	read, writable, err := authorizer.layers(r)
+	if err != nil {
+		return &serverError{Error: err, Message: err.Error(), Code: http.StatusUnauthorized}
+	}
+	allowed := writable
+	if !write {
+		allowed = append(append([]string{}, read...), writable...)
+	}
+	for _, l := range allowed {
+		if l == layer || l == allLayers {
+			return nil
+		}
+	}
+	return &serverError{Error: ErrForbidden, Message: ErrForbidden.Error(), Code: http.StatusForbidden}
+}
+
+// isAdminRoute reports whether a request was routed to the admin routes,
+// which are only there if an admin key is configured
+func isAdminRoute(r *http.Request) bool {
+	rctx := chi.RouteContext(r.Context())
+	return rctx != nil && strings.HasPrefix(rctx.RoutePattern(), "/admin/")
+}
+
+func isWrite(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// layers returns the layers the credentials of a request give access to,
+// and those they may write to
+func (a *auth) layers(r *http.Request) ([]string, []string, error) {
+
+	if key := requestAPIKey(r); key != "" {
+		k := a.key(key)
+		if k == nil {
+			return nil, nil, ErrUnauthorized
+		}
+		if k.Write {
+			return k.Layers, k.Layers, nil
+		}
+		return k.Layers, nil, nil
+	}
+
+	token := requestToken(r)
+	if token == "" || len(a.keys) == 0 {
+		return nil, nil, ErrUnauthorized
+	}
+
+	claims, err := a.verify(token)
+	if err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+
+	read := claimValues(claims[a.conf.LayersClaim])
+	write := claimValues(claims[a.conf.WriteLayersClaim])
+	for _, c := range a.conf.Claims {
+		for _, v := range claimValues(claims[c.Claim]) {
+			if v == c.Value {
+				read = append(read, c.Layers...)
+				if c.Write {
+					write = append(write, c.Layers...)
+				}
+				break
+			}
+		}
+	}
+
+	return read, write, nil
+}
+
+// key returns the configured API key matching a key, if any
+func (a *auth) key(key string) *conf.AuthKey {
+	for i, k := range a.conf.Keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+			return &a.conf.Keys[i]
+		}
+	}
+	return nil
+}
+
+// requestAPIKey is sent in the X-API-Key header, or in the api_key
+// query param by clients that can't set headers (e.g. EventSource)
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get(headerAPIKey); key != "" {
+		return key
+	}
+	return getRequestParam(queryParamAPIKey, r)
+}
+
+func requestToken(r *http.Request) string {
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return getRequestParam(queryParamAccessToken, r)
+}
+
+/////////////////////////////////////////////////////////////////////
+
+// verify checks the signature of a compact JWT with the key of its kid
+// (or each key, if it has none) and its exp, nbf, iss and aud claims,
+// and returns its claims. Only HS256 and RS256 are accepted, and the
+// alg of the token must match the type of the key.
+func (a *auth) verify(token string) (map[string]interface{}, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+
+	verified := false
+	for _, k := range a.keys {
+		if header.Kid != "" && k.kid != header.Kid {
+			continue
+		}
+		if k.alg != "" && k.alg != header.Alg {
+			continue
+		}
+		if k.verify(header.Alg, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, ErrInvalidToken
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, ErrInvalidToken
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, ErrInvalidToken
+	}
+	if a.conf.Issuer != "" && claims["iss"] != a.conf.Issuer {
+		return nil, ErrInvalidToken
+	}
+	if a.conf.Audience != "" && !containsString(claimValues(claims["aud"]), a.conf.Audience) {
+		return nil, ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+func (k jwk) verify(alg string, signed, sig []byte) bool {
+	switch {
+	case alg == "HS256" && k.secret != nil:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(signed)
+		return hmac.Equal(mac.Sum(nil), sig)
+	case alg == "RS256" && k.rsa != nil:
+		h := sha256.Sum256(signed)
+		return rsa.VerifyPKCS1v15(k.rsa, crypto.SHA256, h[:], sig) == nil
+	default:
+		return false
+	}
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrInvalidToken
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// claimValues returns a string claim, or the strings of an array claim
+func claimValues(v interface{}) []string {
+	switch c := v.(type) {
+	case string:
+		return []string{c}
+	case []interface{}:
+		values := []string{}
+		for _, e := range c {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// readJWKS reads the RSA and oct keys of a JWKS file, skipping keys of other types
+func readJWKS(path string) ([]jwk, error) {
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("invalid jwks file: %v", err)
+	}
+
+	keys := []jwk{}
+	for _, k := range set.Keys {
+		key := jwk{kid: k.Kid, alg: k.Alg}
+		switch k.Kty {
+		case "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("invalid jwks key %s: %v", k.Kid, err)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				return nil, fmt.Errorf("invalid jwks key %s: %v", k.Kid, err)
+			}
+			key.rsa = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "oct":
+			secret, err := base64.RawURLEncoding.DecodeString(k.K)
+			if err != nil {
+				return nil, fmt.Errorf("invalid jwks key %s: %v", k.Kid, err)
+			}
+			key.secret = secret
+		default:
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no RSA or oct keys in jwks file")
+	}
+
+	return keys, nil
+}
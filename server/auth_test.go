@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/engelsjk/rtyq/conf"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func writeTestJWKS(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	jwks := `{"keys":[{"kty":"oct","kid":"k1","alg":"HS256","k":"` + base64.RawURLEncoding.EncodeToString(testSecret) + `"}]}`
+	if err := ioutil.WriteFile(path, []byte(jwks), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func signTestToken(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "kid": "k1", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, testSecret)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func denied(code int) bool {
+	return code == http.StatusUnauthorized || code == http.StatusForbidden
+}
+
+func TestAuthorizeKeys(t *testing.T) {
+	router := testRouter(t, conf.Server{Auth: conf.Auth{Keys: []conf.AuthKey{
+		{Key: "reader", Layers: []string{"parcels", "public"}},
+		{Key: "writer", Layers: []string{"parcels"}, Write: true},
+		{Key: "all", Layers: []string{"*"}},
+	}}}, conf.Layer{Name: "parcels"}, conf.Layer{Name: "public", Public: true})
+
+	tests := []struct {
+		method, target, key string
+		code                int // 0 if the request is let through
+	}{
+		{"GET", "/parcels/id/1", "", http.StatusUnauthorized},
+		{"GET", "/parcels/id/1", "wrong", http.StatusUnauthorized},
+		{"GET", "/parcels/id/1", "reader", 0},
+		{"GET", "/parcels/id/1?api_key=reader", "", 0},
+		{"GET", "/parcels/id/1", "all", 0},
+		{"GET", "/parcels/id/1", "writer", 0},
+		{"PUT", "/parcels/id/1", "reader", http.StatusForbidden},
+		{"DELETE", "/parcels/id/1", "reader", http.StatusForbidden},
+		{"POST", "/parcels", "all", http.StatusForbidden},
+		{"PUT", "/parcels/id/1", "writer", 0},
+		{"DELETE", "/parcels/id/1", "writer", 0},
+		{"GET", "/public/id/1", "", 0},
+		{"PUT", "/public/id/1", "", http.StatusUnauthorized},
+		{"PUT", "/public/id/1", "reader", http.StatusForbidden},
+		{"GET", "/unknown/id/1", "", 0},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.key != "" {
+			header.Set(headerAPIKey, tt.key)
+		}
+		w := serve(router, tt.method, tt.target, header)
+		if tt.code == 0 && denied(w.Code) {
+			t.Errorf("%s %s with key %q: %d, want it let through", tt.method, tt.target, tt.key, w.Code)
+		}
+		if tt.code != 0 && w.Code != tt.code {
+			t.Errorf("%s %s with key %q: %d, want %d", tt.method, tt.target, tt.key, w.Code, tt.code)
+		}
+	}
+}
+
+func TestAuthorizeJWT(t *testing.T) {
+	router := testRouter(t, conf.Server{Auth: conf.Auth{
+		JWKSFile: writeTestJWKS(t),
+		Audience: "rtyq",
+		Claims: []conf.AuthClaim{
+			{Claim: "role", Value: "assessor", Layers: []string{"parcels"}, Write: true},
+		},
+	}}, conf.Layer{Name: "parcels"}, conf.Layer{Name: "roads"})
+
+	exp := float64(time.Now().Add(time.Hour).Unix())
+	reader := signTestToken(t, map[string]interface{}{"aud": "rtyq", "exp": exp, "layers": []string{"parcels", "roads"}})
+	writer := signTestToken(t, map[string]interface{}{"aud": "rtyq", "exp": exp, "write_layers": "roads"})
+	assessor := signTestToken(t, map[string]interface{}{"aud": "rtyq", "exp": exp, "role": []string{"viewer", "assessor"}})
+	expired := signTestToken(t, map[string]interface{}{"aud": "rtyq", "exp": float64(time.Now().Add(-time.Hour).Unix()), "layers": "*"})
+	otherAudience := signTestToken(t, map[string]interface{}{"aud": "other", "exp": exp, "layers": "*"})
+
+	tests := []struct {
+		method, target, token string
+		code                  int
+	}{
+		{"GET", "/parcels/id/1", reader, 0},
+		{"GET", "/roads/id/1", reader, 0},
+		{"PUT", "/roads/id/1", reader, http.StatusForbidden},
+		{"GET", "/roads/id/1", writer, 0},
+		{"PUT", "/roads/id/1", writer, 0},
+		{"PUT", "/parcels/id/1", writer, http.StatusForbidden},
+		{"PUT", "/parcels/id/1", assessor, 0},
+		{"GET", "/roads/id/1", assessor, http.StatusForbidden},
+		{"GET", "/parcels/id/1", expired, http.StatusUnauthorized},
+		{"GET", "/parcels/id/1", otherAudience, http.StatusUnauthorized},
+		{"GET", "/parcels/id/1", reader[:len(reader)-2], http.StatusUnauthorized},
+	}
+
+	for i, tt := range tests {
+		header := http.Header{}
+		header.Set("Authorization", "Bearer "+tt.token)
+		w := serve(router, tt.method, tt.target, header)
+		if tt.code == 0 && denied(w.Code) {
+			t.Errorf("test %d: %s %s: %d, want it let through", i, tt.method, tt.target, w.Code)
+		}
+		if tt.code != 0 && w.Code != tt.code {
+			t.Errorf("test %d: %s %s: %d, want %d", i, tt.method, tt.target, w.Code, tt.code)
+		}
+	}
+}
+
+func TestAuthorizeAdminPaths(t *testing.T) {
+	keys := conf.Auth{Keys: []conf.AuthKey{{Key: "reader", Layers: []string{"*"}}}}
+
+	// without an admin key, /admin is a layer like any other
+	router := testRouter(t, conf.Server{Auth: keys}, conf.Layer{Name: "admin"})
+	if w := serve(router, "GET", "/admin/id/1", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("layer admin without credentials: %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := serve(router, "POST", "/admin", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("write to layer admin without credentials: %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// with an admin key, the admin routes check it instead of layer credentials
+	router = testRouter(t, conf.Server{Auth: keys, AdminKey: "secret"}, conf.Layer{Name: "parcels"})
+	header := http.Header{}
+	header.Set("Authorization", "Bearer secret")
+	if w := serve(router, "GET", "/admin/layers", header); w.Code != http.StatusOK {
+		t.Errorf("admin layers with the admin key: %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := serve(router, "GET", "/admin/layers", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("admin layers without the admin key: %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
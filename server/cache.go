@@ -0,0 +1,273 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/data"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/paulmach/orb/geojson"
+)
+
+// validator holds the caching headers of a layer query response. Layer data
+// only changes when it's reloaded or written to, so responses are tagged with
+// the layer's version and the query and can be revalidated with If-None-Match.
+type validator struct {
+	layer    string
+	version  string
+	key      string
+	etag     string
+	modified time.Time
+	control  string
+}
+
+// newValidator returns the validator for a GET query of a layer answered in
+// format f, or nil for other methods. Responses are keyed on the format rather than
+// the Accept header, so that Accept headers negotiating the same format share them.
+func newValidator(r *http.Request, layer string, f *format) (*validator, *serverError) {
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil, nil
+	}
+
+	version, modified, err := data.QueryHandler.Version(layer)
+	if err != nil {
+		return nil, errorQueryToServer(err)
+	}
+
+	key := fmt.Sprintf("%s\n%s\n%s", r.URL.Path, cacheQuery(r), f.name)
+
+	h := sha1.New()
+	fmt.Fprintf(h, "%s\n%s", version, key)
+
+	return &validator{
+		layer:    layer,
+		version:  version,
+		key:      key,
+		etag:     fmt.Sprintf(`W/"%s"`, hex.EncodeToString(h.Sum(nil))),
+		modified: modified.UTC().Truncate(time.Second),
+		control:  cacheControl(layer),
+	}, nil
+}
+
+// notModified reports whether the client's cached response is still current
+func (v *validator) notModified(r *http.Request) bool {
+	if v == nil {
+		return false
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, etag := range strings.Split(inm, ",") {
+			etag = strings.TrimSpace(etag)
+			if etag == "*" || strings.TrimPrefix(etag, "W/") == strings.TrimPrefix(v.etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" && !v.modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !v.modified.After(t)
+	}
+	return false
+}
+
+func (v *validator) setHeaders(w http.ResponseWriter) {
+	if v == nil {
+		return
+	}
+	w.Header().Set("ETag", v.etag)
+	w.Header().Add("Vary", "Accept")
+	w.Header().Set("Cache-Control", v.control)
+	if !v.modified.IsZero() {
+		w.Header().Set("Last-Modified", v.modified.Format(http.TimeFormat))
+	}
+}
+
+func (v *validator) writeNotModified(w http.ResponseWriter) {
+	v.setHeaders(w)
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// writeCached writes the response of the query from the layer's response
+// cache, if it's there
+func (v *validator) writeCached(w http.ResponseWriter, r *http.Request) bool {
+	if v == nil {
+		return false
+	}
+	resp, ok := responses.get(v.layer, v.version, v.key)
+	if !ok {
+		return false
+	}
+	setResults(r, resp.results)
+	v.setHeaders(w)
+	writeResponse(w, resp.contype, resp.body)
+	return true
+}
+
+// writeFeatures writes the response of a query in a format and adds it
+// to the layer's response cache
+func (v *validator) writeFeatures(w http.ResponseWriter, r *http.Request, f *format, layer string, features []geojson.Feature) *serverError {
+	setResults(r, len(features))
+	body, err := f.encode(features, idKey(layer))
+	if err != nil {
+		return serverErrorInternal(err, ErrMsgEncoding)
+	}
+	v.writeBody(w, f.contype, body, len(features))
+	return nil
+}
+
+// writeJSON writes a JSON response of a layer that isn't a list of features
+// (results aren't counted) and adds it to the layer's response cache
+func (v *validator) writeJSON(w http.ResponseWriter, content interface{}) *serverError {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	body, err := json.Marshal(content)
+	if err != nil {
+		return serverErrorInternal(err, ErrMsgEncoding)
+	}
+	v.writeBody(w, ContentTypeJSON, body, -1)
+	return nil
+}
+
+func (v *validator) writeBody(w http.ResponseWriter, contype string, body []byte, results int) {
+	if v != nil {
+		responses.put(v.layer, v.version, v.key, &response{contype: contype, body: body, results: results})
+		v.setHeaders(w)
+	}
+	writeResponse(w, contype, body)
+}
+
+// cacheQuery normalizes the query parameters of a request, leaving out credentials
+func cacheQuery(r *http.Request) string {
+	params := r.URL.Query()
+	params.Del(queryParamAPIKey)
+	params.Del(queryParamAccessToken)
+	return params.Encode()
+}
+
+// cacheControl is public with the layer's max-age, or private for layers
+// that need credentials. Without a max-age, clients have to revalidate.
+func cacheControl(layer string) string {
+	confLayer, _ := conf.GetLayer(layer)
+	scope := "public"
+	if authorizer != nil && !confLayer.Public {
+		scope = "private"
+	}
+	if confLayer.CacheMaxAgeSec <= 0 {
+		return fmt.Sprintf("%s, no-cache", scope)
+	}
+	return fmt.Sprintf("%s, max-age=%d", scope, confLayer.CacheMaxAgeSec)
+}
+
+/////////////////////////////////////////////////////////////
+
+// responseCache holds the serialized responses of layer queries in an LRU
+// cache per layer, bounded by the layer's cachesizemb. A layer's cache is
+// only valid for one version of it, so it's cleared whenever the layer is
+// reloaded or written to.
+type responseCache struct {
+	mu     sync.Mutex
+	layers map[string]*layerCache
+}
+
+type layerCache struct {
+	version  string
+	maxBytes int
+	size     int
+	entries  *list.List
+	items    map[string]*list.Element
+}
+
+type response struct {
+	key     string
+	contype string
+	body    []byte
+	results int
+}
+
+var responses = &responseCache{layers: make(map[string]*layerCache)}
+
+func (c *responseCache) get(layer, version, key string) (*response, bool) {
+
+	if cacheSize(layer) <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lc, ok := c.layers[layer]
+	if !ok || lc.version != version {
+		metricResponseCache.WithLabelValues(layer, "miss").Inc()
+		return nil, false
+	}
+	e, ok := lc.items[key]
+	if !ok {
+		metricResponseCache.WithLabelValues(layer, "miss").Inc()
+		return nil, false
+	}
+	lc.entries.MoveToFront(e)
+	metricResponseCache.WithLabelValues(layer, "hit").Inc()
+	return e.Value.(*response), true
+}
+
+func (c *responseCache) put(layer, version, key string, resp *response) {
+
+	maxBytes := cacheSize(layer)
+	if maxBytes <= 0 || len(resp.body) > maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lc, ok := c.layers[layer]
+	if !ok || lc.version != version || lc.maxBytes != maxBytes {
+		c.sweep()
+		lc = &layerCache{
+			version:  version,
+			maxBytes: maxBytes,
+			entries:  list.New(),
+			items:    make(map[string]*list.Element),
+		}
+		c.layers[layer] = lc
+	}
+
+	if e, ok := lc.items[key]; ok {
+		lc.size -= len(e.Value.(*response).body)
+		lc.entries.Remove(e)
+	}
+
+	resp.key = key
+	lc.items[key] = lc.entries.PushFront(resp)
+	lc.size += len(resp.body)
+
+	for lc.size > lc.maxBytes {
+		e := lc.entries.Back()
+		old := e.Value.(*response)
+		lc.entries.Remove(e)
+		delete(lc.items, old.key)
+		lc.size -= len(old.body)
+	}
+}
+
+// sweep drops the caches of layers that are no longer served
+func (c *responseCache) sweep() {
+	for layer := range c.layers {
+		if !data.QueryHandler.HasLayer(layer) {
+			delete(c.layers, layer)
+		}
+	}
+}
+
+// cacheSize is the response cache size of a layer in bytes
+func cacheSize(layer string) int {
+	confLayer, _ := conf.GetLayer(layer)
+	return confLayer.CacheSizeMB << 20
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/data"
+	"github.com/paulmach/orb/geojson"
+)
+
+func putTestFeature(t *testing.T, layer, id, coords string) {
+	t.Helper()
+	f, err := geojson.UnmarshalFeature([]byte(testFeature(id, coords)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := data.QueryHandler.Put(layer, id, f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func withHeader(key, value string) http.Header {
+	header := http.Header{}
+	header.Set(key, value)
+	return header
+}
+
+func TestETag(t *testing.T) {
+	parcels := testLayer(t, conf.Layer{Name: "parcels"}, map[string]string{
+		"a": testFeature("a", square0),
+	})
+	router := testRouter(t, conf.Server{}, parcels)
+
+	w := serve(router, "GET", "/parcels/id/a", nil)
+	etag := w.Header().Get("ETag")
+	modified := w.Header().Get("Last-Modified")
+	if w.Code != http.StatusOK || etag == "" || modified == "" {
+		t.Fatalf("id query: %d, etag %q, last modified %q", w.Code, etag, modified)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "public, no-cache" {
+		t.Errorf("cache control: %q", got)
+	}
+
+	lastModified, _ := http.ParseTime(modified)
+	earlier := lastModified.Add(-time.Minute).Format(http.TimeFormat)
+
+	tests := []struct {
+		name   string
+		target string
+		header http.Header
+		code   int
+	}{
+		{"etag", "/parcels/id/a", withHeader("If-None-Match", etag), http.StatusNotModified},
+		{"strong etag", "/parcels/id/a", withHeader("If-None-Match", etag[2:]), http.StatusNotModified},
+		{"etag list", "/parcels/id/a", withHeader("If-None-Match", `"x", `+etag), http.StatusNotModified},
+		{"any etag", "/parcels/id/a", withHeader("If-None-Match", "*"), http.StatusNotModified},
+		{"other etag", "/parcels/id/a", withHeader("If-None-Match", `W/"x"`), http.StatusOK},
+		{"credentials", "/parcels/id/a?api_key=x", withHeader("If-None-Match", etag), http.StatusNotModified},
+		{"other query", "/parcels/id/a?f=csv", withHeader("If-None-Match", etag), http.StatusOK},
+		{"other path", "/parcels/bbox/-1,-1,2,2", withHeader("If-None-Match", etag), http.StatusOK},
+		{"modified since", "/parcels/id/a", withHeader("If-Modified-Since", modified), http.StatusNotModified},
+		{"modified earlier", "/parcels/id/a", withHeader("If-Modified-Since", earlier), http.StatusOK},
+	}
+	for _, tt := range tests {
+		w := serve(router, "GET", tt.target, tt.header)
+		if w.Code != tt.code {
+			t.Errorf("%s: %d, want %d", tt.name, w.Code, tt.code)
+		}
+		if w.Code == http.StatusNotModified && w.Body.Len() != 0 {
+			t.Errorf("%s: not modified response has a body", tt.name)
+		}
+	}
+
+	// the accept header selects the format, so it's part of the etag
+	header := withHeader("If-None-Match", etag)
+	header.Set("Accept", "text/csv")
+	if w := serve(router, "GET", "/parcels/id/a", header); w.Code != http.StatusOK {
+		t.Errorf("other accept header: %d, want %d", w.Code, http.StatusOK)
+	}
+	// but accept headers negotiating the same format share it
+	header.Set("Accept", "text/html, application/json;q=0.9, */*;q=0.8")
+	if w := serve(router, "GET", "/parcels/id/a", header); w.Code != http.StatusNotModified {
+		t.Errorf("accept header of the same format: %d, want %d", w.Code, http.StatusNotModified)
+	}
+
+	// a write changes the version of the layer
+	putTestFeature(t, "parcels", "b", square5)
+	w = serve(router, "GET", "/parcels/id/a", withHeader("If-None-Match", etag))
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("after a write: %d, etag %q", w.Code, w.Header().Get("ETag"))
+	}
+}
+
+func TestETagInvalidQuery(t *testing.T) {
+	parcels := testLayer(t, conf.Layer{Name: "parcels", ZoomLimit: 4, Search: []string{"ID"}}, map[string]string{
+		"a": testFeature("a", square0),
+	})
+	router := testRouter(t, conf.Server{}, parcels)
+
+	// a matching etag doesn't turn the error of an invalid query into a 304
+	for _, target := range []string{
+		"/parcels/point/x,1",
+		"/parcels/point/x,1?count=true",
+		"/parcels/bbox/0,1,1,0",
+		"/parcels/bbox/0,0,1?count=true",
+		"/parcels/tile/1/0/0",
+		"/parcels/tile/x/0/0",
+		"/parcels/id/a?crs=EPSG:1",
+		"/parcels/search",
+		"/parcels/search?NAME=a",
+	} {
+		w := serve(router, "GET", target, withHeader("If-None-Match", "*"))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	features := map[string]string{"a": testFeature("a", square0)}
+	parcels := testLayer(t, conf.Layer{Name: "parcels", CacheMaxAgeSec: 60}, features)
+	public := testLayer(t, conf.Layer{Name: "public", Public: true}, features)
+
+	auth := conf.Auth{Keys: []conf.AuthKey{{Key: "reader", Layers: []string{"*"}}}}
+	tests := []struct {
+		server conf.Server
+		target string
+		want   string
+	}{
+		{conf.Server{}, "/parcels/id/a", "public, max-age=60"},
+		{conf.Server{Auth: auth}, "/parcels/id/a?api_key=reader", "private, max-age=60"},
+		{conf.Server{Auth: auth}, "/public/id/a", "public, no-cache"},
+	}
+	for _, tt := range tests {
+		router := testRouter(t, tt.server, parcels, public)
+		w := serve(router, "GET", tt.target, nil)
+		if got := w.Header().Get("Cache-Control"); w.Code != http.StatusOK || got != tt.want {
+			t.Errorf("%s: %d, cache control %q, want %q", tt.target, w.Code, got, tt.want)
+		}
+	}
+}
+
+func resetResponses(t *testing.T) {
+	t.Helper()
+	saved := responses
+	responses = &responseCache{layers: make(map[string]*layerCache)}
+	t.Cleanup(func() {
+		responses = saved
+	})
+}
+
+func TestResponseCache(t *testing.T) {
+	resetResponses(t)
+	features := map[string]string{"a": testFeature("a", square0)}
+	cached := testLayer(t, conf.Layer{Name: "cached", CacheSizeMB: 1}, features)
+	uncached := testLayer(t, conf.Layer{Name: "uncached"}, features)
+	router := testRouter(t, conf.Server{}, cached, uncached)
+
+	before := map[string]string{}
+	for _, layer := range []string{"cached", "uncached"} {
+		before[layer] = serve(router, "GET", "/"+layer+"/id/a", nil).Body.String()
+	}
+
+	// the data files change behind the layers' back, which only the uncached layer sees
+	changed := `{"type":"Feature","properties":{"ID":"a","v":2},"geometry":{"type":"Polygon","coordinates":[` + square0 + `]}}`
+	for _, l := range []conf.Layer{cached, uncached} {
+		if err := ioutil.WriteFile(filepath.Join(l.Data.Dir, "a.geojson"), []byte(changed), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := serve(router, "GET", "/cached/id/a", nil)
+	if w.Body.String() != before["cached"] || w.Header().Get("ETag") == "" {
+		t.Errorf("cached response: %s", w.Body.String())
+	}
+	if w := serve(router, "GET", "/uncached/id/a", nil); w.Body.String() == before["uncached"] {
+		t.Error("layer without a response cache served a cached response")
+	}
+	if w := serve(router, "GET", "/cached/id/a?f=csv", nil); !strings.Contains(w.Body.String(), "2") {
+		t.Errorf("other query was served from the cache: %s", w.Body.String())
+	}
+	if w := serve(router, "GET", "/cached/id/a", withHeader("Accept", "*/*")); w.Body.String() != before["cached"] {
+		t.Errorf("accept header of the same format wasn't served from the cache: %s", w.Body.String())
+	}
+	if w := serve(router, "GET", "/cached/id/a", withHeader("Accept", "text/csv")); !strings.Contains(w.Body.String(), "2") {
+		t.Errorf("accept header of another format was served from the cache: %s", w.Body.String())
+	}
+
+	// a write clears the layer's cache
+	putTestFeature(t, "cached", "b", square5)
+	if w := serve(router, "GET", "/cached/id/a", nil); w.Body.String() == before["cached"] {
+		t.Error("cached response served after a write")
+	}
+}
+
+func TestResponseCacheEviction(t *testing.T) {
+	resetResponses(t)
+	cached := testLayer(t, conf.Layer{Name: "cached", CacheSizeMB: 1}, nil)
+	testRouter(t, conf.Server{}, cached)
+
+	body := func(kb int) []byte {
+		return make([]byte, kb<<10)
+	}
+	has := func(version, key string) bool {
+		_, ok := responses.get("cached", version, key)
+		return ok
+	}
+
+	responses.put("cached", "v1", "a", &response{body: body(400)})
+	responses.put("cached", "v1", "b", &response{body: body(400)})
+	has("v1", "a") // a is used, so b is evicted first
+	responses.put("cached", "v1", "c", &response{body: body(400)})
+
+	if !has("v1", "a") || has("v1", "b") || !has("v1", "c") {
+		t.Error("least recently used response wasn't evicted")
+	}
+	if size := responses.layers["cached"].size; size != 800<<10 {
+		t.Errorf("cache size %d, want %d", size, 800<<10)
+	}
+
+	responses.put("cached", "v1", "big", &response{body: body(1025)})
+	if has("v1", "big") {
+		t.Error("response larger than the cache was cached")
+	}
+
+	if has("v2", "a") {
+		t.Error("response of another version served")
+	}
+	responses.put("cached", "v2", "d", &response{body: body(1)})
+	if has("v1", "a") || !has("v2", "d") {
+		t.Error("responses of the previous version kept")
+	}
+
+	// a layer without a cache size doesn't cache
+	responses.put("other", "v1", "a", &response{body: body(1)})
+	if _, ok := responses.get("other", "v1", "a"); ok {
+		t.Error("layer without a cache size cached a response")
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/engelsjk/rtyq/data"
+	"github.com/engelsjk/rtyq/logger"
+	"github.com/paulmach/orb"
+)
+
+const (
+	ContentTypeEventStream = "text/event-stream"
+)
+
+const (
+	queryParamBBox = "bbox"
+)
+
+// changesHeartbeat keeps idle streams open through proxies
+const changesHeartbeat = 15 * time.Second
+
+var (
+	ErrStreamingUnsupported error = fmt.Errorf("streaming unsupported")
+)
+
+// responseWriterKey keys the server's own ResponseWriter in a request's context,
+// since the writers wrapping it (e.g. to compress responses) hide its write deadline
+const responseWriterKey contextKey = "responseWriter"
+
+// keepResponseWriter lets handlers reach the server's ResponseWriter,
+// so it must be the first middleware of the router
+func keepResponseWriter(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), responseWriterKey, w)))
+	})
+}
+
+// clearWriteDeadline lets a response outlive the server's write timeout
+func clearWriteDeadline(w http.ResponseWriter, r *http.Request) error {
+	if rw, ok := r.Context().Value(responseWriterKey).(http.ResponseWriter); ok {
+		w = rw
+	}
+	return http.NewResponseController(w).SetWriteDeadline(time.Time{})
+}
+
+// handleChanges streams the changes made to a layer as server-sent events,
+// optionally only those intersecting ?bbox=minX,minY,maxX,maxY.
+// The stream isn't subject to the server's write timeout, and ends when the client
+// goes away, falls too far behind or the server shuts down.
+func handleChanges(w http.ResponseWriter, r *http.Request) *serverError {
+
+	layer := getRequestVar(routeVarLayer, r)
+	sublayer := getRequestVar(routeVarSubLayer, r)
+
+	if sublayer != "" {
+		layer = fmt.Sprintf("%s/%s", layer, sublayer)
+	}
+
+	var bbox *orb.Bound
+	if bb := getRequestParam(queryParamBBox, r); bb != "" {
+		var err error
+		if bbox, err = data.ParseBBox(bb); err != nil {
+			return errorQueryToServer(err)
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return serverErrorInternal(ErrStreamingUnsupported, ErrStreamingUnsupported.Error())
+	}
+
+	changes, cancel, err := data.QueryHandler.Subscribe(layer, bbox)
+	if err != nil {
+		return errorQueryToServer(err)
+	}
+	defer cancel()
+
+	if err := clearWriteDeadline(w, r); err != nil {
+		logger.Warn("changes stream ends at the write timeout", logger.Fields{"layer": layer, "error": err})
+	}
+
+	w.Header().Set("Content-Type", ContentTypeEventStream)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	fmt.Fprintf(w, "retry: %d\n\n", time.Second.Milliseconds())
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(changesHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-shutdown:
+			return nil
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case c, ok := <-changes:
+			if !ok {
+				return nil
+			}
+			b, err := json.Marshal(c)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", c.Seq, c.Op, b)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/data"
+	"github.com/go-chi/chi/middleware"
+)
+
+func TestChangesOutliveWriteTimeout(t *testing.T) {
+	layer := testLayer(t, conf.Layer{Name: "test"}, map[string]string{"a": testFeature("a", square0)})
+	router := testRouter(t, conf.Server{}, layer)
+
+	// the stream's writer is wrapped like it is by the server
+	srv := httptest.NewUnstartedServer(keepResponseWriter(middleware.Compress(5, "gzip")(router)))
+	srv.Config.WriteTimeout = 200 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/test/changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("changes: %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	events := make(chan string)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "event: ") {
+				events <- strings.TrimPrefix(scanner.Text(), "event: ")
+			}
+		}
+	}()
+
+	// a change made after the write timeout still reaches the stream
+	time.Sleep(400 * time.Millisecond)
+
+	req, _ := http.NewRequest("PUT", srv.URL+"/test/id/a", strings.NewReader(testFeature("a", square5)))
+	put, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put.Body.Close()
+	if put.StatusCode != http.StatusOK {
+		t.Fatalf("put: %d, want %d", put.StatusCode, http.StatusOK)
+	}
+
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatal("stream ended before the change")
+		}
+		if event != "update" {
+			t.Errorf("event %q, want update", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+}
+
+func TestChangesEvents(t *testing.T) {
+	layer := testLayer(t, conf.Layer{Name: "test"}, map[string]string{"a": testFeature("a", square0)})
+	router := testRouter(t, conf.Server{}, layer)
+
+	if w := serve(router, "GET", "/test/changes?bbox=0,1,1,0", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("changes with an invalid bbox: %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := serve(router, "GET", "/missing/changes", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("changes of a missing layer: %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/test/changes?bbox=4,4,7,7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != ContentTypeEventStream {
+		t.Errorf("content type %s", resp.Header.Get("Content-Type"))
+	}
+
+	// only the change intersecting the bbox is sent
+	putTestFeature(t, "test", "far", `[[20,20],[21,20],[21,21],[20,20]]`)
+	putTestFeature(t, "test", "near", square5)
+
+	scanner := bufio.NewScanner(resp.Body)
+	lines := []string{}
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "retry: ") {
+			continue
+		}
+		if scanner.Text() == "" && len(lines) > 0 {
+			break
+		}
+		if scanner.Text() != "" {
+			lines = append(lines, scanner.Text())
+		}
+	}
+
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "id: ") || lines[1] != "event: insert" || !strings.HasPrefix(lines[2], "data: ") {
+		t.Fatalf("event %q", lines)
+	}
+	var c data.Change
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.ID != "near" || c.Layer != "test" || lines[0] != fmt.Sprintf("id: %d", c.Seq) {
+		t.Errorf("event %q", lines)
+	}
+}
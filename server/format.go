@@ -0,0 +1,445 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/data"
+	jsoniter "github.com/json-iterator/go"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/encoding/wkt"
+	"github.com/paulmach/orb/geojson"
+)
+
+const (
+	ContentTypeGeoJSONSeq = "application/geo+json-seq"
+	ContentTypeCSV        = "text/csv"
+	ContentTypeKML        = "application/vnd.google-earth.kml+xml"
+	ContentTypeText       = "text/plain"
+)
+
+const (
+	queryParamFormat = "f"
+)
+
+var (
+	ErrInvalidFormat error = fmt.Errorf("invalid format")
+	ErrNotAcceptable error = fmt.Errorf("not acceptable")
+	ErrFormatCRS     error = fmt.Errorf("kml is always in lon/lat")
+)
+
+// format encodes the features of a query response
+type format struct {
+	name    string
+	contype string
+	// aliases are other media types negotiated to the format
+	aliases []string
+	// stream encodes features one at a time, for formats that can be streamed
+	stream *streamer
+	// marshal encodes all the features at once, for formats that can't
+	marshal func(features []geojson.Feature, idKey string) ([]byte, error)
+}
+
+var formatJSON = &format{
+	name:    "json",
+	contype: ContentTypeJSON,
+	aliases: []string{"application/*", "*/*"},
+	stream:  &streamer{header: "[", separator: ",", footer: "]", feature: marshalFeature},
+}
+
+// formats are negotiated with ?f= or the Accept header, JSON is the default
+var formats = []*format{
+	formatJSON,
+	{
+		name:    "geojson",
+		contype: ContentTypeGeoJSON,
+		stream:  &streamer{header: `{"type":"FeatureCollection","features":[`, separator: ",", footer: "]}", feature: marshalFeature},
+	},
+	{
+		name:    "geojsonseq",
+		contype: ContentTypeGeoJSONSeq,
+		stream:  &streamer{feature: marshalSeqFeature},
+	},
+	{
+		name:    "csv",
+		contype: ContentTypeCSV,
+		marshal: marshalCSV,
+	},
+	{
+		name:    "kml",
+		contype: ContentTypeKML,
+		stream: &streamer{
+			header:  xml.Header + `<kml xmlns="http://www.opengis.net/kml/2.2"><Document>`,
+			footer:  "</Document></kml>\n",
+			feature: marshalPlacemark,
+		},
+	},
+	{
+		name:    "ids",
+		contype: ContentTypeText,
+		stream:  &streamer{feature: marshalID},
+	},
+}
+
+// negotiateFormat returns the format of a query response, by name with ?f=
+// or else the format of the most preferred media type in the Accept header.
+// It also rejects an invalid ?crs=, before the response can be answered from a cache.
+func negotiateFormat(r *http.Request) (*format, *serverError) {
+	f, serr := requestFormat(r)
+	if serr != nil {
+		return nil, serr
+	}
+	if f.name == "kml" && getRequestParam(queryParamCRS, r) != "" {
+		return nil, serverErrorBadRequest(ErrFormatCRS, ErrFormatCRS.Error())
+	}
+	if _, err := data.FeatureProjection(getRequestParam(queryParamCRS, r)); err != nil {
+		return nil, errorQueryToServer(err)
+	}
+	return f, nil
+}
+
+func requestFormat(r *http.Request) (*format, *serverError) {
+
+	if name := getRequestParam(queryParamFormat, r); name != "" {
+		for _, f := range formats {
+			if f.name == name {
+				return f, nil
+			}
+		}
+		return nil, serverErrorBadRequest(ErrInvalidFormat, ErrInvalidFormat.Error())
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return formatJSON, nil
+	}
+
+	var best *format
+	bestQ := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, q := parseAccept(part)
+		if q <= bestQ {
+			continue
+		}
+		if f := formatOf(mediaType); f != nil {
+			best, bestQ = f, q
+		}
+	}
+	if best == nil {
+		return nil, &serverError{Error: ErrNotAcceptable, Message: ErrNotAcceptable.Error(), Code: http.StatusNotAcceptable}
+	}
+	return best, nil
+}
+
+// parseAccept returns the media type and quality of an Accept header entry
+func parseAccept(s string) (string, float64) {
+	params := strings.Split(s, ";")
+	q := 1.0
+	for _, p := range params[1:] {
+		p = strings.TrimSpace(p)
+		if strings.HasPrefix(p, "q=") {
+			if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+				q = v
+			}
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(params[0])), q
+}
+
+func formatOf(mediaType string) *format {
+	for _, f := range formats {
+		if f.contype == mediaType {
+			return f
+		}
+		for _, alias := range f.aliases {
+			if alias == mediaType {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// writeFeatures writes the features of a query response in a format
+func writeFeatures(w http.ResponseWriter, f *format, layer string, features []geojson.Feature) *serverError {
+	body, err := f.encode(features, idKey(layer))
+	if err != nil {
+		return serverErrorInternal(err, ErrMsgEncoding)
+	}
+	writeResponse(w, f.contype, body)
+	return nil
+}
+
+func idKey(layer string) string {
+	confLayer, _ := conf.GetLayer(layer)
+	return confLayer.Data.ID
+}
+
+/////////////////////////////////////////////////////////////
+
+// streamer encodes features one at a time, so that they can be written
+// as a query finds them
+type streamer struct {
+	header    string
+	separator string
+	footer    string
+	feature   func(f *geojson.Feature, idKey string) ([]byte, error)
+}
+
+// featureWriter writes the features of a response to w with a streamer,
+// starting with the header
+type featureWriter struct {
+	w     io.Writer
+	s     *streamer
+	idKey string
+	n     int
+}
+
+func (s *streamer) writer(w io.Writer, idKey string) *featureWriter {
+	return &featureWriter{w: w, s: s, idKey: idKey}
+}
+
+func (fw *featureWriter) write(f *geojson.Feature) error {
+	b, err := fw.s.feature(f, fw.idKey)
+	if err != nil {
+		return err
+	}
+	prefix := fw.s.separator
+	if fw.n == 0 {
+		prefix = fw.s.header
+	}
+	if _, err := io.WriteString(fw.w, prefix); err != nil {
+		return err
+	}
+	if _, err := fw.w.Write(b); err != nil {
+		return err
+	}
+	fw.n++
+	return nil
+}
+
+// close writes the footer, and the header if there were no features
+func (fw *featureWriter) close() error {
+	footer := fw.s.footer
+	if fw.n == 0 {
+		footer = fw.s.header + footer
+	}
+	_, err := io.WriteString(fw.w, footer)
+	return err
+}
+
+// encode encodes all the features of a response
+func (f *format) encode(features []geojson.Feature, idKey string) ([]byte, error) {
+	if f.stream == nil {
+		return f.marshal(features, idKey)
+	}
+	var buf bytes.Buffer
+	fw := f.stream.writer(&buf, idKey)
+	for i := range features {
+		if err := fw.write(&features[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := fw.close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+/////////////////////////////////////////////////////////////
+
+func marshalFeature(f *geojson.Feature, idKey string) ([]byte, error) {
+	var json = jsoniter.ConfigCompatibleWithStandardLibrary
+	return json.Marshal(f)
+}
+
+// marshalSeqFeature encodes a feature as a record of a GeoJSON text sequence (RFC 8142)
+func marshalSeqFeature(f *geojson.Feature, idKey string) ([]byte, error) {
+	b, err := marshalFeature(f, idKey)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{0x1e}, b...), '\n'), nil
+}
+
+// marshalPlacemark encodes a feature as a KML placemark named after its id
+func marshalPlacemark(f *geojson.Feature, idKey string) ([]byte, error) {
+
+	var buf bytes.Buffer
+
+	buf.WriteString("<Placemark><name>")
+	xml.EscapeText(&buf, []byte(data.FeatureID(f, idKey)))
+	buf.WriteString("</name>")
+
+	if len(f.Properties) > 0 {
+		keys := make([]string, 0, len(f.Properties))
+		for k := range f.Properties {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString("<ExtendedData>")
+		for _, k := range keys {
+			buf.WriteString(`<Data name="`)
+			xml.EscapeText(&buf, []byte(k))
+			buf.WriteString(`"><value>`)
+			xml.EscapeText(&buf, []byte(propertyString(f.Properties[k])))
+			buf.WriteString("</value></Data>")
+		}
+		buf.WriteString("</ExtendedData>")
+	}
+
+	writeKMLGeometry(&buf, f.Geometry)
+	buf.WriteString("</Placemark>")
+
+	return buf.Bytes(), nil
+}
+
+// marshalID encodes the id of a feature on a line
+func marshalID(f *geojson.Feature, idKey string) ([]byte, error) {
+	return []byte(data.FeatureID(f, idKey) + "\n"), nil
+}
+
+// marshalCSV writes a row of properties and the WKT geometry of each feature,
+// with a column for every property of any feature
+func marshalCSV(features []geojson.Feature, idKey string) ([]byte, error) {
+
+	keys := []string{}
+	seen := make(map[string]bool)
+	for _, f := range features {
+		for k := range f.Properties {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+
+	if err := cw.Write(append(keys, "wkt")); err != nil {
+		return nil, err
+	}
+
+	for _, f := range features {
+		row := make([]string, 0, len(keys)+1)
+		for _, k := range keys {
+			row = append(row, propertyString(f.Properties[k]))
+		}
+		row = append(row, geometryWKT(f.Geometry))
+		if err := cw.Write(row); err != nil {
+			return nil, err
+		}
+	}
+
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+/////////////////////////////////////////////////////////////
+
+func propertyString(v interface{}) string {
+	switch p := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return p
+	case float64:
+		return strconv.FormatFloat(p, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(p)
+	default:
+		var json = jsoniter.ConfigCompatibleWithStandardLibrary
+		b, err := json.Marshal(p)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
+
+func geometryWKT(g orb.Geometry) string {
+	if g == nil {
+		return ""
+	}
+	return wkt.MarshalString(g)
+}
+
+func writeKMLGeometry(buf *bytes.Buffer, g orb.Geometry) {
+	switch v := g.(type) {
+	case orb.Point:
+		buf.WriteString("<Point><coordinates>")
+		writeKMLCoordinates(buf, []orb.Point{v})
+		buf.WriteString("</coordinates></Point>")
+	case orb.MultiPoint:
+		buf.WriteString("<MultiGeometry>")
+		for _, p := range v {
+			writeKMLGeometry(buf, p)
+		}
+		buf.WriteString("</MultiGeometry>")
+	case orb.LineString:
+		buf.WriteString("<LineString><coordinates>")
+		writeKMLCoordinates(buf, v)
+		buf.WriteString("</coordinates></LineString>")
+	case orb.MultiLineString:
+		buf.WriteString("<MultiGeometry>")
+		for _, ls := range v {
+			writeKMLGeometry(buf, ls)
+		}
+		buf.WriteString("</MultiGeometry>")
+	case orb.Ring:
+		writeKMLGeometry(buf, orb.Polygon{v})
+	case orb.Polygon:
+		buf.WriteString("<Polygon>")
+		for i, ring := range v {
+			if i == 0 {
+				buf.WriteString("<outerBoundaryIs>")
+			} else {
+				buf.WriteString("<innerBoundaryIs>")
+			}
+			buf.WriteString("<LinearRing><coordinates>")
+			writeKMLCoordinates(buf, ring)
+			buf.WriteString("</coordinates></LinearRing>")
+			if i == 0 {
+				buf.WriteString("</outerBoundaryIs>")
+			} else {
+				buf.WriteString("</innerBoundaryIs>")
+			}
+		}
+		buf.WriteString("</Polygon>")
+	case orb.MultiPolygon:
+		buf.WriteString("<MultiGeometry>")
+		for _, p := range v {
+			writeKMLGeometry(buf, p)
+		}
+		buf.WriteString("</MultiGeometry>")
+	case orb.Collection:
+		buf.WriteString("<MultiGeometry>")
+		for _, g := range v {
+			writeKMLGeometry(buf, g)
+		}
+		buf.WriteString("</MultiGeometry>")
+	case orb.Bound:
+		writeKMLGeometry(buf, v.ToPolygon())
+	}
+}
+
+func writeKMLCoordinates(buf *bytes.Buffer, points []orb.Point) {
+	for i, p := range points {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(strconv.FormatFloat(p[0], 'f', -1, 64))
+		buf.WriteByte(',')
+		buf.WriteString(strconv.FormatFloat(p[1], 'f', -1, 64))
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		target, accept string
+		want           string
+		code           int
+	}{
+		{"/x", "", "json", 0},
+		{"/x?f=csv", "", "csv", 0},
+		{"/x?f=csv", ContentTypeKML, "csv", 0},
+		{"/x", "text/csv", "csv", 0},
+		{"/x", "text/csv;q=0.5, " + ContentTypeKML, "kml", 0},
+		{"/x", "text/csv; q=0.9, application/geo+json;q=0.1", "csv", 0},
+		{"/x", "TEXT/CSV", "csv", 0},
+		{"/x", "text/html,application/xhtml+xml,*/*;q=0.8", "json", 0},
+		{"/x", "image/png, application/*;q=0.1", "json", 0},
+		{"/x", "text/csv;q=0, */*;q=0.1", "json", 0},
+		{"/x", "image/png", "", http.StatusNotAcceptable},
+		{"/x?f=shp", "", "", http.StatusBadRequest},
+		{"/x?f=kml&crs=EPSG:3857", "", "", http.StatusBadRequest},
+		{"/x?crs=EPSG:3857", ContentTypeKML, "", http.StatusBadRequest},
+		{"/x?f=csv&crs=EPSG:3857", "", "csv", 0},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		f, serr := negotiateFormat(r)
+		if tt.code != 0 {
+			if serr == nil || serr.Code != tt.code {
+				t.Errorf("%s accepting %q: %v, want %d", tt.target, tt.accept, serr, tt.code)
+			}
+			continue
+		}
+		if serr != nil || f.name != tt.want {
+			t.Errorf("%s accepting %q: %v, want %s", tt.target, tt.accept, serr, tt.want)
+		}
+	}
+}
+
+func TestMarshalCSV(t *testing.T) {
+	a := geojson.NewFeature(orb.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}})
+	a.Properties = geojson.Properties{"ID": "a", "n": 1.5, "ok": true, "tags": []interface{}{"x", "y"}}
+	b := geojson.NewFeature(orb.Point{2, 3})
+	b.Properties = geojson.Properties{"ID": "b", "name": "x, y \"z\"\nw"}
+	c := geojson.NewFeature(nil)
+	c.Properties = geojson.Properties{"ID": "c"}
+
+	body, err := marshalCSV([]geojson.Feature{*a, *b, *c}, "ID")
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatalf("%v: %s", err, body)
+	}
+
+	want := [][]string{
+		{"ID", "n", "name", "ok", "tags", "wkt"},
+		{"a", "1.5", "", "true", `["x","y"]`, "POLYGON((0 0,1 0,1 1,0 0))"},
+		{"b", "", "x, y \"z\"\nw", "", "", "POINT(2 3)"},
+		{"c", "", "", "", "", ""},
+	}
+	if len(records) != len(want) {
+		t.Fatalf("%d records, want %d: %s", len(records), len(want), body)
+	}
+	for i := range want {
+		if !equalRecord(records[i], want[i]) {
+			t.Errorf("record %d: %q, want %q", i, records[i], want[i])
+		}
+	}
+
+	// without features, only the header is written
+	body, err = marshalCSV(nil, "ID")
+	if err != nil || string(body) != "wkt\n" {
+		t.Errorf("csv without features: %q, %v", body, err)
+	}
+}
+
+func equalRecord(a, b []string) bool {
+	return strings.Join(a, "\x00") == strings.Join(b, "\x00")
+}
+
+func TestMarshalPlacemark(t *testing.T) {
+	polygon := orb.Polygon{
+		{{0, 0}, {10, 0}, {10, 10}, {0, 0}},
+		{{1, 1}, {2, 1}, {2, 2}, {1, 1}},
+	}
+	tests := []struct {
+		geom orb.Geometry
+		// want lists the coordinates of each element of the placemark's geometry
+		want map[string][]string
+	}{
+		{orb.Point{1.5, -2}, map[string][]string{"Point": {"1.5,-2"}}},
+		{orb.LineString{{0, 0}, {1, 1}}, map[string][]string{"LineString": {"0,0 1,1"}}},
+		{polygon, map[string][]string{
+			"outerBoundaryIs": {"0,0 10,0 10,10 0,0"},
+			"innerBoundaryIs": {"1,1 2,1 2,2 1,1"},
+		}},
+		{orb.MultiPolygon{polygon[:1], {{{5, 5}, {6, 5}, {6, 6}, {5, 5}}}}, map[string][]string{
+			"outerBoundaryIs": {"0,0 10,0 10,10 0,0", "5,5 6,5 6,6 5,5"},
+		}},
+	}
+
+	for _, tt := range tests {
+		f := geojson.NewFeature(tt.geom)
+		f.Properties = geojson.Properties{"ID": "<a&b>", "n": 1.0}
+		b, err := marshalPlacemark(f, "ID")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var placemark struct {
+			Name string `xml:"name"`
+			Data []struct {
+				Name  string `xml:"name,attr"`
+				Value string `xml:"value"`
+			} `xml:"ExtendedData>Data"`
+		}
+		if err := xml.Unmarshal(b, &placemark); err != nil {
+			t.Fatalf("%v: %s", err, b)
+		}
+		if placemark.Name != "<a&b>" || len(placemark.Data) != 2 || placemark.Data[1].Value != "1" {
+			t.Errorf("placemark %+v", placemark)
+		}
+
+		got := kmlCoordinates(t, b)
+		for element, coords := range tt.want {
+			if !equalRecord(got[element], coords) {
+				t.Errorf("%T: %s coordinates %q, want %q", tt.geom, element, got[element], coords)
+			}
+		}
+	}
+}
+
+// kmlCoordinates returns the coordinates in a KML document by the element
+// they're under, the nearest of Point, LineString, outerBoundaryIs or innerBoundaryIs
+func kmlCoordinates(t *testing.T, b []byte) map[string][]string {
+	t.Helper()
+	coords := make(map[string][]string)
+	d := xml.NewDecoder(bytes.NewReader(b))
+	var stack []string
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch e := tok.(type) {
+		case xml.StartElement:
+			stack = append(stack, e.Name.Local)
+		case xml.EndElement:
+			stack = stack[:len(stack)-1]
+		case xml.CharData:
+			if len(stack) == 0 || stack[len(stack)-1] != "coordinates" {
+				continue
+			}
+		parents:
+			for i := len(stack) - 1; i >= 0; i-- {
+				switch stack[i] {
+				case "Point", "LineString", "outerBoundaryIs", "innerBoundaryIs":
+					coords[stack[i]] = append(coords[stack[i]], string(e))
+					break parents
+				}
+			}
+		}
+	}
+	return coords
+}
+
+func TestCSVQuery(t *testing.T) {
+	layer := testLayer(t, conf.Layer{Name: "test"}, map[string]string{
+		"a": testFeature("a", square0),
+		"b": testFeature("b", square5),
+	})
+	router := testRouter(t, conf.Server{}, layer)
+
+	w := serve(router, "GET", "/test/bbox/-1,-1,7,7?f=csv", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ContentTypeCSV {
+		t.Fatalf("csv query: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil || len(records) != 3 || records[0][0] != "ID" {
+		t.Errorf("csv query returned %q, %v", records, err)
+	}
+}
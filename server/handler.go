@@ -1,8 +1,10 @@
 package server
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/engelsjk/rtyq/conf"
 	"github.com/engelsjk/rtyq/data"
@@ -21,6 +23,10 @@ const (
 	routeVarTileZ    = "z"
 )
 
+const (
+	queryParamCRS = "crs"
+)
+
 var (
 	ErrNotFound error = fmt.Errorf("not found")
 )
@@ -63,13 +69,42 @@ func addRoutes(router *chi.Mux) {
 	addRoute(router, "/{layer}/id/{id}", handleID)
 	addRoute(router, "/{layer}/{sublayer}/id/{id}", handleID)
 
+	addRoute(router, "/{layer}/search", handleSearch)
+	addRoute(router, "/{layer}/{sublayer}/search", handleSearch)
+
+	addRoute(router, "/{layer}/stats", handleStats)
+	addRoute(router, "/{layer}/{sublayer}/stats", handleStats)
+
+	addRoute(router, "/{layer}/changes", handleChanges)
+	addRoute(router, "/{layer}/{sublayer}/changes", handleChanges)
+
+	addMethodRoute(router, http.MethodPost, "/{layer}", handleCreate)
+	addMethodRoute(router, http.MethodPost, "/{layer}/{sublayer}", handleCreate)
+	addMethodRoute(router, http.MethodPut, "/{layer}/id/{id}", handlePut)
+	addMethodRoute(router, http.MethodPut, "/{layer}/{sublayer}/id/{id}", handlePut)
+	addMethodRoute(router, http.MethodDelete, "/{layer}/id/{id}", handleDelete)
+	addMethodRoute(router, http.MethodDelete, "/{layer}/{sublayer}/id/{id}", handleDelete)
+
 	addRoute(router, "/config", handleConfig)
+	addRoute(router, "/healthz", handleHealth)
+	addRoute(router, "/readyz", handleReady)
+
+	addAdminRoutes(router)
+
+	if conf.Configuration.Server.Metrics {
+		addMetricsRoute(router)
+	}
 }
 
 func addRoute(router *chi.Mux, path string, handler func(http.ResponseWriter, *http.Request) *serverError) {
 	router.Handle(path, serverHandler(handler))
 }
 
+// addMethodRoute overrides a route added by addRoute for one method
+func addMethodRoute(router *chi.Mux, method, path string, handler func(http.ResponseWriter, *http.Request) *serverError) {
+	router.Method(method, path, serverHandler(handler))
+}
+
 ////////////////////////////////////////////////////////////////////////
 
 func handleRoot(w http.ResponseWriter, r *http.Request) *serverError {
@@ -126,12 +161,54 @@ func handlePoint(w http.ResponseWriter, r *http.Request) *serverError {
 		layer = fmt.Sprintf("%s/%s", layer, sublayer)
 	}
 
-	features, err := data.QueryHandler.Point(layer, point)
-	if err != nil {
+	// invalid queries aren't answered from caches
+	if err := data.ValidatePoint(point); err != nil {
+		return errorQueryToServer(err)
+	}
+
+	if isCount(r) {
+		return handleCount(w, r, layer, func(ctx context.Context) (int, error) {
+			return data.QueryHandler.PointCount(ctx, layer, point)
+		})
+	}
+
+	f, serr := negotiateFormat(r)
+	if serr != nil {
+		return serr
+	}
+
+	v, serr := newValidator(r, layer, f)
+	if serr != nil {
+		return serr
+	}
+	if v.notModified(r) {
+		v.writeNotModified(w)
+		return nil
+	}
+	if v.writeCached(w, r) {
+		return nil
+	}
+
+	if f.stream != nil {
+		return v.streamFeatures(w, r, f, layer, func(fn data.FeatureFunc) error {
+			return data.QueryHandler.PointEach(r.Context(), layer, point, fn)
+		})
+	}
+
+	features, err := data.QueryHandler.Point(r.Context(), layer, point)
+	partial, serr := queryResult(err, layer)
+	if serr != nil {
+		return serr
+	}
+
+	if err := data.ProjectFeatures(features, getRequestParam(queryParamCRS, r)); err != nil {
 		return errorQueryToServer(err)
 	}
 
-	return writeJSON(w, ContentTypeJSON, features)
+	if partial {
+		return writePartial(w, r, f, layer, *features)
+	}
+	return v.writeFeatures(w, r, f, layer, *features)
 }
 
 func handleBBox(w http.ResponseWriter, r *http.Request) *serverError {
@@ -144,12 +221,54 @@ func handleBBox(w http.ResponseWriter, r *http.Request) *serverError {
 		layer = fmt.Sprintf("%s/%s", layer, sublayer)
 	}
 
-	features, err := data.QueryHandler.BBox(layer, bbox)
-	if err != nil {
+	// invalid queries aren't answered from caches
+	if err := data.ValidateBBox(bbox); err != nil {
 		return errorQueryToServer(err)
 	}
 
-	return writeJSON(w, ContentTypeJSON, features)
+	if isCount(r) {
+		return handleCount(w, r, layer, func(ctx context.Context) (int, error) {
+			return data.QueryHandler.BBoxCount(ctx, layer, bbox)
+		})
+	}
+
+	f, serr := negotiateFormat(r)
+	if serr != nil {
+		return serr
+	}
+
+	v, serr := newValidator(r, layer, f)
+	if serr != nil {
+		return serr
+	}
+	if v.notModified(r) {
+		v.writeNotModified(w)
+		return nil
+	}
+	if v.writeCached(w, r) {
+		return nil
+	}
+
+	if f.stream != nil {
+		return v.streamFeatures(w, r, f, layer, func(fn data.FeatureFunc) error {
+			return data.QueryHandler.BBoxEach(r.Context(), layer, bbox, fn)
+		})
+	}
+
+	features, err := data.QueryHandler.BBox(r.Context(), layer, bbox)
+	partial, serr := queryResult(err, layer)
+	if serr != nil {
+		return serr
+	}
+
+	if err := data.ProjectFeatures(features, getRequestParam(queryParamCRS, r)); err != nil {
+		return errorQueryToServer(err)
+	}
+
+	if partial {
+		return writePartial(w, r, f, layer, *features)
+	}
+	return v.writeFeatures(w, r, f, layer, *features)
 }
 
 func handleTile(w http.ResponseWriter, r *http.Request) *serverError {
@@ -164,12 +283,54 @@ func handleTile(w http.ResponseWriter, r *http.Request) *serverError {
 		layer = fmt.Sprintf("%s/%s", layer, sublayer)
 	}
 
-	features, err := data.QueryHandler.Tile(layer, tileX, tileY, tileZ)
-	if err != nil {
+	// invalid queries aren't answered from caches
+	if err := data.QueryHandler.ValidateTile(layer, tileX, tileY, tileZ); err != nil {
 		return errorQueryToServer(err)
 	}
 
-	return writeJSON(w, ContentTypeJSON, features)
+	if isCount(r) {
+		return handleCount(w, r, layer, func(ctx context.Context) (int, error) {
+			return data.QueryHandler.TileCount(ctx, layer, tileX, tileY, tileZ)
+		})
+	}
+
+	f, serr := negotiateFormat(r)
+	if serr != nil {
+		return serr
+	}
+
+	v, serr := newValidator(r, layer, f)
+	if serr != nil {
+		return serr
+	}
+	if v.notModified(r) {
+		v.writeNotModified(w)
+		return nil
+	}
+	if v.writeCached(w, r) {
+		return nil
+	}
+
+	if f.stream != nil {
+		return v.streamFeatures(w, r, f, layer, func(fn data.FeatureFunc) error {
+			return data.QueryHandler.TileEach(r.Context(), layer, tileX, tileY, tileZ, fn)
+		})
+	}
+
+	features, err := data.QueryHandler.Tile(r.Context(), layer, tileX, tileY, tileZ)
+	partial, serr := queryResult(err, layer)
+	if serr != nil {
+		return serr
+	}
+
+	if err := data.ProjectFeatures(features, getRequestParam(queryParamCRS, r)); err != nil {
+		return errorQueryToServer(err)
+	}
+
+	if partial {
+		return writePartial(w, r, f, layer, *features)
+	}
+	return v.writeFeatures(w, r, f, layer, *features)
 }
 
 func handleID(w http.ResponseWriter, r *http.Request) *serverError {
@@ -182,12 +343,113 @@ func handleID(w http.ResponseWriter, r *http.Request) *serverError {
 		layer = fmt.Sprintf("%s/%s", layer, sublayer)
 	}
 
-	features, err := data.QueryHandler.ID(layer, id)
+	if id == "" {
+		return errorQueryToServer(data.ErrQueryMissingID)
+	}
+
+	f, serr := negotiateFormat(r)
+	if serr != nil {
+		return serr
+	}
+
+	v, serr := newValidator(r, layer, f)
+	if serr != nil {
+		return serr
+	}
+	if v.notModified(r) {
+		v.writeNotModified(w)
+		return nil
+	}
+	if v.writeCached(w, r) {
+		return nil
+	}
+
+	features, err := data.QueryHandler.ID(r.Context(), layer, id)
+	if err != nil {
+		return errorQueryToServer(err)
+	}
+
+	if err := data.ProjectFeatures(features, getRequestParam(queryParamCRS, r)); err != nil {
+		return errorQueryToServer(err)
+	}
+
+	return v.writeFeatures(w, r, f, layer, *features)
+}
+
+func handlePut(w http.ResponseWriter, r *http.Request) *serverError {
+
+	layer := getRequestVar(routeVarLayer, r)
+	sublayer := getRequestVar(routeVarSubLayer, r)
+	id := getRequestVar(routeVarID, r)
+
+	if sublayer != "" {
+		layer = fmt.Sprintf("%s/%s", layer, sublayer)
+	}
+
+	f, e := readFeature(w, r)
+	if e != nil {
+		return e
+	}
+
+	features, created, err := data.QueryHandler.Put(layer, id, f)
 	if err != nil {
 		return errorQueryToServer(err)
 	}
 
-	return writeJSON(w, ContentTypeJSON, features)
+	if err := data.ProjectFeatures(features, getRequestParam(queryParamCRS, r)); err != nil {
+		return errorQueryToServer(err)
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	return writeJSONStatus(w, ContentTypeJSON, status, features)
+}
+
+func handleCreate(w http.ResponseWriter, r *http.Request) *serverError {
+
+	layer := getRequestVar(routeVarLayer, r)
+	sublayer := getRequestVar(routeVarSubLayer, r)
+
+	if sublayer != "" {
+		layer = fmt.Sprintf("%s/%s", layer, sublayer)
+	}
+
+	f, e := readFeature(w, r)
+	if e != nil {
+		return e
+	}
+
+	features, err := data.QueryHandler.Create(layer, f)
+	if err != nil {
+		return errorQueryToServer(err)
+	}
+
+	if err := data.ProjectFeatures(features, getRequestParam(queryParamCRS, r)); err != nil {
+		return errorQueryToServer(err)
+	}
+
+	return writeJSONStatus(w, ContentTypeJSON, http.StatusCreated, features)
+}
+
+func handleDelete(w http.ResponseWriter, r *http.Request) *serverError {
+
+	layer := getRequestVar(routeVarLayer, r)
+	sublayer := getRequestVar(routeVarSubLayer, r)
+	id := getRequestVar(routeVarID, r)
+
+	if sublayer != "" {
+		layer = fmt.Sprintf("%s/%s", layer, sublayer)
+	}
+
+	if err := data.QueryHandler.Delete(layer, id); err != nil {
+		return errorQueryToServer(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
 }
 
 func handleConfig(w http.ResponseWriter, r *http.Request) *serverError {
@@ -201,9 +463,16 @@ func handleConfig(w http.ResponseWriter, r *http.Request) *serverError {
 
 	queries := []string{
 		"/{layer}/point/{point}",
+		"/{layer}/point/{point}?count=true",
 		"/{layer}/tile/{z}/{x}/{y}",
+		"/{layer}/tile/{z}/{x}/{y}?count=true",
 		"/{layer}/bbox/{bbox}",
+		"/{layer}/bbox/{bbox}?count=true",
 		"/{layer}/id/{id}",
+		"/{layer}/search?{field}={value}&q={text}",
+		"/{layer}/search?{field}={value}&q={text}&count=true",
+		"/{layer}/stats",
+		"/{layer}/changes",
 	}
 
 	config := Config{Layers: layers, Queries: queries}
@@ -227,6 +496,8 @@ func errorQueryToServer(err error) *serverError {
 		return serverErrorBadRequest(err, err.Error())
 	case data.ErrQueryInvalidID:
 		return serverErrorBadRequest(err, err.Error())
+	case data.ErrQueryNotFound:
+		return serverErrorNotFound(err, err.Error())
 	case data.ErrQueryMissingPoint:
 		return serverErrorBadRequest(err, err.Error())
 	case data.ErrQueryInvalidPoint:
@@ -239,8 +510,26 @@ func errorQueryToServer(err error) *serverError {
 		return serverErrorBadRequest(err, err.Error())
 	case data.ErrQueryInvalidBBox:
 		return serverErrorBadRequest(err, err.Error())
+	case data.ErrQueryMissingSearch:
+		return serverErrorBadRequest(err, err.Error())
+	case data.ErrQueryInvalidSearch:
+		return serverErrorBadRequest(err, err.Error())
 	case data.ErrQueryExceededTileZoomLimit:
 		return serverErrorBadRequest(err, err.Error())
+	case data.ErrQueryInvalidCRS:
+		return serverErrorBadRequest(err, err.Error())
+	case data.ErrQueryInvalidFeature:
+		return serverErrorBadRequest(err, err.Error())
+	case data.ErrQueryFeatureExists:
+		return serverErrorConflict(err, err.Error())
+	case data.ErrQueryReadOnly:
+		return serverErrorForbidden(err, err.Error())
+	case data.ErrQueryLayerBusy:
+		return serverErrorUnavailable(err, err.Error(), time.Second)
+	case data.ErrQueryTimeout:
+		return serverErrorGatewayTimeout(err, err.Error())
+	case data.ErrQueryCanceled:
+		return &serverError{Error: err, Message: err.Error(), Code: statusClientClosedRequest}
 	case data.ErrQueryRequest:
 		return serverErrorInternal(err, err.Error())
 	default:
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/data"
+)
+
+const statusPending = "pending"
+
+type layerReadiness struct {
+	data.LayerStatus
+	Required bool `json:"required"`
+}
+
+// handleHealth reports that the process is up
+func handleHealth(w http.ResponseWriter, r *http.Request) *serverError {
+	type Health struct {
+		Status string `json:"status"`
+	}
+	return writeJSON(w, ContentTypeJSON, Health{Status: "ok"})
+}
+
+// handleReady reports whether every required layer is serving queries,
+// with the status of each configured layer. Layers are required unless
+// they are configured as optional.
+func handleReady(w http.ResponseWriter, r *http.Request) *serverError {
+
+	type Ready struct {
+		Status string           `json:"status"`
+		Layers []layerReadiness `json:"layers"`
+	}
+
+	ready := Ready{Status: "ready", Layers: []layerReadiness{}}
+
+	for _, confLayer := range conf.Layers() {
+		status, ok := data.QueryHandler.LayerStatus(confLayer.Name)
+		if !ok {
+			status = data.LayerStatus{Name: confLayer.Name, State: statusPending}
+		}
+		required := !confLayer.Optional
+		if required && !status.Serving {
+			ready.Status = "not ready"
+		}
+		ready.Layers = append(ready.Layers, layerReadiness{LayerStatus: status, Required: required})
+	}
+
+	code := http.StatusOK
+	if ready.Status != "ready" {
+		code = http.StatusServiceUnavailable
+	}
+
+	return writeJSONStatus(w, ContentTypeJSON, code, ready)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/data"
+)
+
+func TestHealth(t *testing.T) {
+	auth := conf.Auth{Keys: []conf.AuthKey{{Key: "reader", Layers: []string{"*"}}}}
+	router := testRouter(t, conf.Server{Auth: auth}, conf.Layer{Name: "pending"})
+
+	// probes don't need credentials, even while layers aren't ready
+	if w := serve(router, "GET", "/healthz", nil); w.Code != http.StatusOK {
+		t.Errorf("healthz: %d, want %d", w.Code, http.StatusOK)
+	}
+	if w := serve(router, "GET", "/readyz", nil); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz: %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestReady(t *testing.T) {
+	parcels := testLayer(t, conf.Layer{Name: "parcels"}, map[string]string{
+		"a": testFeature("a", square0),
+	})
+
+	// a layer whose data dir doesn't exist fails to load
+	failed := conf.Layer{
+		Name:     "failed",
+		Data:     conf.LayerData{Dir: filepath.Join(t.TempDir(), "missing"), Ext: ".geojson", ID: "ID"},
+		Database: conf.LayerDatabase{Backend: data.BackendMemory, Index: "failed"},
+	}
+	if err := data.QueryHandler.ReloadLayer(failed); err == nil {
+		t.Fatal("layer without a data dir loaded")
+	}
+	t.Cleanup(func() {
+		data.QueryHandler.RemoveLayer("failed")
+	})
+
+	optional := func(l conf.Layer) conf.Layer {
+		l.Optional = true
+		return l
+	}
+
+	tests := []struct {
+		name   string
+		layers []conf.Layer
+		code   int
+		states map[string]string
+	}{
+		{"ready", []conf.Layer{parcels}, http.StatusOK, map[string]string{"parcels": data.StatusReady}},
+		{"pending", []conf.Layer{parcels, {Name: "pending"}}, http.StatusServiceUnavailable, map[string]string{"pending": statusPending}},
+		{"failed", []conf.Layer{parcels, failed}, http.StatusServiceUnavailable, map[string]string{"failed": data.StatusFailed}},
+		{"optional", []conf.Layer{parcels, optional(failed), optional(conf.Layer{Name: "pending"})}, http.StatusOK, map[string]string{"failed": data.StatusFailed}},
+		{"none", nil, http.StatusOK, nil},
+	}
+
+	for _, tt := range tests {
+		router := testRouter(t, conf.Server{}, tt.layers...)
+		w := serve(router, "GET", "/readyz", nil)
+		if w.Code != tt.code {
+			t.Errorf("%s: %d, want %d", tt.name, w.Code, tt.code)
+		}
+
+		var ready struct {
+			Status string           `json:"status"`
+			Layers []layerReadiness `json:"layers"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &ready); err != nil {
+			t.Fatalf("%s: %s", tt.name, w.Body.String())
+		}
+		if len(ready.Layers) != len(tt.layers) {
+			t.Errorf("%s: %d layers, want %d", tt.name, len(ready.Layers), len(tt.layers))
+		}
+		for _, l := range ready.Layers {
+			if state, ok := tt.states[l.Name]; ok && l.State != state {
+				t.Errorf("%s: layer %s is %s, want %s", tt.name, l.Name, l.State, state)
+			}
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/data"
+	"github.com/engelsjk/rtyq/logger"
+	"github.com/go-chi/chi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "rtyq"
+
+var (
+	metricRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Requests by layer, query type, method and status code.",
+	}, []string{"layer", "query", "method", "code"})
+
+	metricRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Request latency by layer, query type and method.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+	}, []string{"layer", "query", "method"})
+
+	metricResultFeatures = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "result_features",
+		Help:      "Features returned by layer and query type.",
+		Buckets:   prometheus.ExponentialBuckets(1, 4, 9),
+	}, []string{"layer", "query"})
+
+	metricErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "errors_total",
+		Help:      "Errors by layer, query type and error.",
+	}, []string{"layer", "query", "error"})
+
+	metricRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_rejected_total",
+		Help:      "Requests rejected by throttling (capacity, timeout) or rate limiting (rate).",
+	}, []string{"reason"})
+
+	metricResponseCache = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "response_cache_requests_total",
+		Help:      "Response cache lookups by layer and result (hit, miss).",
+	}, []string{"layer", "result"})
+
+	metricInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_in_flight",
+		Help:      "Requests being served.",
+	})
+)
+
+// queryErrors are used as error labels, any other error is counted as "other"
+var queryErrors = []error{
+	data.ErrQueryMissingLayer,
+	data.ErrQueryInvalidLayer,
+	data.ErrQueryMissingQuery,
+	data.ErrQueryInvalidQuery,
+	data.ErrQueryMissingID,
+	data.ErrQueryInvalidID,
+	data.ErrQueryNotFound,
+	data.ErrQueryMissingPoint,
+	data.ErrQueryInvalidPoint,
+	data.ErrQueryMissingTile,
+	data.ErrQueryInvalidTile,
+	data.ErrQueryMissingBBox,
+	data.ErrQueryInvalidBBox,
+	data.ErrQueryMissingSearch,
+	data.ErrQueryInvalidSearch,
+	data.ErrQueryExceededTileZoomLimit,
+	data.ErrQueryInvalidCRS,
+	data.ErrQueryInvalidFeature,
+	data.ErrQueryFeatureExists,
+	data.ErrQueryReadOnly,
+	data.ErrQueryLayerBusy,
+	data.ErrQueryTimeout,
+	data.ErrQueryCanceled,
+	data.ErrQueryRequest,
+	ErrNotFound,
+	ErrUnauthorized,
+	ErrForbidden,
+	ErrInvalidToken,
+}
+
+var metricsRegistry = prometheus.NewRegistry()
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		metricRequests,
+		metricRequestDuration,
+		metricResultFeatures,
+		metricErrors,
+		metricRejected,
+		metricResponseCache,
+		metricInFlight,
+		layerCollector{},
+	)
+}
+
+// addMetricsRoute adds /metrics, behind the admin key if one is configured.
+// Without one, metrics aren't served if layers require auth, since they'd expose
+// the names and sizes of private layers.
+func addMetricsRoute(router *chi.Mux) {
+
+	handler := promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+
+	if conf.Configuration.Server.AdminKey != "" {
+		router.With(adminAuth).Handle("/metrics", handler)
+		return
+	}
+	if authorizer != nil {
+		logger.Warn("/metrics isn't served since auth is configured without an admin key", nil)
+		return
+	}
+	router.Handle("/metrics", handler)
+}
+
+// observeRequest records a request once it's served
+func observeRequest(r *http.Request, info *requestInfo, code int, e *serverError) {
+
+	layer, query := requestLabels(r)
+
+	metricRequests.WithLabelValues(layer, query, r.Method, strconv.Itoa(code)).Inc()
+	metricRequestDuration.WithLabelValues(layer, query, r.Method).Observe(info.duration().Seconds())
+
+	if n := info.resultCount(); n >= 0 {
+		metricResultFeatures.WithLabelValues(layer, query).Observe(float64(n))
+	}
+
+	if e != nil {
+		metricErrors.WithLabelValues(layer, query, errorLabel(e.Error)).Inc()
+	}
+}
+
+// requestLabels returns the layer of a request, if it is a loaded layer,
+// and its query type, ie. the first static segment of its route after the layer
+func requestLabels(r *http.Request) (string, string) {
+
+	layer := getRequestVar(routeVarLayer, r)
+	if sublayer := getRequestVar(routeVarSubLayer, r); sublayer != "" {
+		layer = layer + "/" + sublayer
+	}
+	if !data.QueryHandler.HasLayer(layer) {
+		layer = ""
+	}
+
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil {
+		return layer, ""
+	}
+	pattern := rctx.RoutePattern()
+
+	query := ""
+	for _, seg := range strings.Split(pattern, "/") {
+		if seg == "" || seg == routeVarWildcard || strings.HasPrefix(seg, "{") {
+			continue
+		}
+		query = seg
+		break
+	}
+	if query == "" {
+		switch {
+		case strings.Contains(pattern, "{"+routeVarLayer+"}"):
+			query = "layer"
+		case pattern == "/":
+			query = "root"
+		default:
+			query = "unknown"
+		}
+	}
+
+	return layer, query
+}
+
+func errorLabel(err error) string {
+	for _, qe := range queryErrors {
+		if err == qe {
+			return qe.Error()
+		}
+	}
+	return "other"
+}
+
+/////////////////////////////////////////////////////////////////////
+
+// layerCollector reports the status of each layer when metrics are scraped
+type layerCollector struct{}
+
+var (
+	descLayerFeatures = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "layer", "features"),
+		"Features indexed by layer.",
+		[]string{"layer"}, nil)
+	descLayerReady = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "layer", "ready"),
+		"Whether the last load of a layer succeeded.",
+		[]string{"layer"}, nil)
+	descLayerLoadDuration = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "layer", "load_duration_seconds"),
+		"Duration of the last load of a layer by stage (build, open, index).",
+		[]string{"layer", "stage"}, nil)
+)
+
+func (layerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- descLayerFeatures
+	ch <- descLayerReady
+	ch <- descLayerLoadDuration
+}
+
+func (layerCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range data.QueryHandler.LayerStatuses() {
+		ready := 0.0
+		if s.State == data.StatusReady {
+			ready = 1
+		}
+		ch <- prometheus.MustNewConstMetric(descLayerFeatures, prometheus.GaugeValue, float64(s.Features), s.Name)
+		ch <- prometheus.MustNewConstMetric(descLayerReady, prometheus.GaugeValue, ready, s.Name)
+		ch <- prometheus.MustNewConstMetric(descLayerLoadDuration, prometheus.GaugeValue, float64(s.BuildMs)/1000, s.Name, "build")
+		ch <- prometheus.MustNewConstMetric(descLayerLoadDuration, prometheus.GaugeValue, float64(s.OpenMs)/1000, s.Name, "open")
+		ch <- prometheus.MustNewConstMetric(descLayerLoadDuration, prometheus.GaugeValue, float64(s.IndexMs)/1000, s.Name, "index")
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/engelsjk/rtyq/conf"
+)
+
+func TestMetrics(t *testing.T) {
+	router := testRouter(t, conf.Server{Metrics: true})
+
+	serve(router, "GET", "/unknown/bbox/0,0,1,1", nil)
+
+	w := serve(router, "GET", "/metrics", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics: %d, want %d", w.Code, http.StatusOK)
+	}
+	for _, name := range []string{"rtyq_requests_total", "rtyq_request_duration_seconds", "rtyq_requests_in_flight"} {
+		if !strings.Contains(w.Body.String(), name) {
+			t.Errorf("metrics don't include %s", name)
+		}
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	keys := conf.Auth{Keys: []conf.AuthKey{{Key: "reader", Layers: []string{"*"}}}}
+	admin := http.Header{}
+	admin.Set("Authorization", "Bearer secret")
+
+	// behind the admin key if there's one
+	router := testRouter(t, conf.Server{Metrics: true, AdminKey: "secret", Auth: keys})
+	if w := serve(router, "GET", "/metrics", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("metrics without the admin key: %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	reader := http.Header{}
+	reader.Set(headerAPIKey, "reader")
+	if w := serve(router, "GET", "/metrics", reader); w.Code != http.StatusUnauthorized {
+		t.Errorf("metrics with an api key: %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if w := serve(router, "GET", "/metrics", admin); w.Code != http.StatusOK {
+		t.Errorf("metrics with the admin key: %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// not served with auth but no admin key
+	router = testRouter(t, conf.Server{Metrics: true, Auth: keys})
+	if w := serve(router, "GET", "/metrics", reader); w.Code == http.StatusOK || strings.Contains(w.Body.String(), "rtyq_requests_total") {
+		t.Errorf("metrics served with auth and no admin key: %d", w.Code)
+	}
+}
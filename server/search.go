@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/engelsjk/rtyq/data"
+)
+
+// reservedParams are the query params that don't name a search field
+var reservedParams = []string{queryParamFormat, queryParamCRS, queryParamCount, queryParamAPIKey, queryParamAccessToken}
+
+// handleSearch finds the features of a layer by the values of its search fields,
+// given as params named after them, and the words of ?q=
+func handleSearch(w http.ResponseWriter, r *http.Request) *serverError {
+
+	layer := getRequestVar(routeVarLayer, r)
+	sublayer := getRequestVar(routeVarSubLayer, r)
+	params := searchParams(r)
+
+	if sublayer != "" {
+		layer = fmt.Sprintf("%s/%s", layer, sublayer)
+	}
+
+	// invalid queries aren't answered from caches
+	if err := data.QueryHandler.ValidateSearch(layer, params); err != nil {
+		return errorQueryToServer(err)
+	}
+
+	if isCount(r) {
+		return handleCount(w, r, layer, func(ctx context.Context) (int, error) {
+			return data.QueryHandler.SearchCount(ctx, layer, params)
+		})
+	}
+
+	f, serr := negotiateFormat(r)
+	if serr != nil {
+		return serr
+	}
+
+	v, serr := newValidator(r, layer, f)
+	if serr != nil {
+		return serr
+	}
+	if v.notModified(r) {
+		v.writeNotModified(w)
+		return nil
+	}
+	if v.writeCached(w, r) {
+		return nil
+	}
+
+	if f.stream != nil {
+		return v.streamFeatures(w, r, f, layer, func(fn data.FeatureFunc) error {
+			return data.QueryHandler.SearchEach(r.Context(), layer, params, fn)
+		})
+	}
+
+	features, err := data.QueryHandler.Search(r.Context(), layer, params)
+	partial, serr := queryResult(err, layer)
+	if serr != nil {
+		return serr
+	}
+
+	if err := data.ProjectFeatures(features, getRequestParam(queryParamCRS, r)); err != nil {
+		return errorQueryToServer(err)
+	}
+
+	if partial {
+		return writePartial(w, r, f, layer, *features)
+	}
+	return v.writeFeatures(w, r, f, layer, *features)
+}
+
+// searchParams are the params of a search, without the reserved params
+func searchParams(r *http.Request) url.Values {
+	params := r.URL.Query()
+	for _, p := range reservedParams {
+		params.Del(p)
+	}
+	return params
+}
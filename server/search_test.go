@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/engelsjk/rtyq/conf"
+)
+
+func TestSearchParams(t *testing.T) {
+	feature := func(id, name string) string {
+		return `{"type":"Feature","properties":{"ID":"` + id + `","NAME":"` + name + `","f":"x"},"geometry":{"type":"Polygon","coordinates":[` + square0 + `]}}`
+	}
+	layer := testLayer(t, conf.Layer{Name: "places", Search: []string{"NAME", "f"}}, map[string]string{
+		"1": feature("1", "Springfield"),
+		"2": feature("2", "Springdale"),
+	})
+	router := testRouter(t, conf.Server{}, layer)
+
+	tests := []struct {
+		target string
+		code   int
+		count  int
+	}{
+		{"/places/search?NAME=springfield", http.StatusOK, 1},
+		{"/places/search?NAME=spring*&f=json&crs=EPSG:4326&api_key=x&access_token=x", http.StatusOK, 2},
+		{"/places/search?q=springdale", http.StatusOK, 1},
+		{"/places/search?q=x", http.StatusOK, 2},
+		{"/places/search?NAME=spring*&count=true", http.StatusOK, 2},
+		{"/places/search?f=json", http.StatusBadRequest, 0},
+		{"/places/search?STATE=IL", http.StatusBadRequest, 0},
+		{"/places/search?NAME=springfield&_=1602201600", http.StatusBadRequest, 0},
+	}
+
+	for _, tt := range tests {
+		w := serve(router, "GET", tt.target, nil)
+		if w.Code != tt.code {
+			t.Errorf("%s: %d, want %d: %s", tt.target, w.Code, tt.code, w.Body.String())
+			continue
+		}
+		if tt.code != http.StatusOK {
+			continue
+		}
+		n, err := countFeatures(w.Body.Bytes())
+		if err != nil {
+			t.Errorf("%s: %v: %s", tt.target, err, w.Body.String())
+			continue
+		}
+		if n != tt.count {
+			t.Errorf("%s: %d features, want %d", tt.target, n, tt.count)
+		}
+	}
+}
+
+// countFeatures counts the features of a JSON array, or returns the numberMatched of a count
+func countFeatures(body []byte) (int, error) {
+	var count struct {
+		NumberMatched int `json:"numberMatched"`
+	}
+	if err := json.Unmarshal(body, &count); err == nil {
+		return count.NumberMatched, nil
+	}
+	var features []json.RawMessage
+	err := json.Unmarshal(body, &features)
+	return len(features), err
+}
@@ -4,9 +4,14 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/logger"
+	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
 	"github.com/go-chi/cors"
 )
@@ -20,28 +25,61 @@ const (
 	ErrMsgEncoding = "error encoding response"
 )
 
+// statusClientClosedRequest is logged for requests the client canceled, as by nginx
+const statusClientClosedRequest = 499
+
+// shutdown is closed when the server shuts down, to end streams
+var shutdown = make(chan struct{})
+
+// slowRequest is the duration above which requests are logged as slow
+var slowRequest time.Duration
+
 type serverError struct {
 	Error   error
 	Message string
 	Code    int
+	// RetryAfter is sent as a Retry-After header if set
+	RetryAfter time.Duration
 }
 
 func serverErrorInternal(err error, msg string) *serverError {
-	return &serverError{err, msg, http.StatusInternalServerError}
+	return &serverError{Error: err, Message: msg, Code: http.StatusInternalServerError}
 }
 
 func serverErrorNotFound(err error, msg string) *serverError {
-	return &serverError{err, msg, http.StatusNotFound}
+	return &serverError{Error: err, Message: msg, Code: http.StatusNotFound}
 }
 
 func serverErrorBadRequest(err error, msg string) *serverError {
-	return &serverError{err, msg, http.StatusBadRequest}
+	return &serverError{Error: err, Message: msg, Code: http.StatusBadRequest}
+}
+
+func serverErrorForbidden(err error, msg string) *serverError {
+	return &serverError{Error: err, Message: msg, Code: http.StatusForbidden}
+}
+
+func serverErrorGatewayTimeout(err error, msg string) *serverError {
+	return &serverError{Error: err, Message: msg, Code: http.StatusGatewayTimeout}
+}
+
+func serverErrorConflict(err error, msg string) *serverError {
+	return &serverError{Error: err, Message: msg, Code: http.StatusConflict}
 }
 
-func Create() *http.Server {
+func serverErrorUnavailable(err error, msg string, retryAfter time.Duration) *serverError {
+	return &serverError{Error: err, Message: msg, Code: http.StatusServiceUnavailable, RetryAfter: retryAfter}
+}
+
+func Create() (*http.Server, error) {
 
 	confServer := conf.Configuration.Server
 
+	a, err := newAuth(confServer.Auth)
+	if err != nil {
+		return nil, err
+	}
+	authorizer = a
+
 	bindAddr := fmt.Sprintf("%v:%v", confServer.Host, confServer.Port)
 	// log host:port and cors origin
 
@@ -56,22 +94,37 @@ func Create() *http.Server {
 
 	corsOpt := cors.Options{
 		AllowedOrigins:   []string{conf.Configuration.Server.CORSOrigin},
-		AllowedMethods:   []string{"GET"},
-		AllowedHeaders:   []string{"Accept", "Content-Type"},
+		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", headerAPIKey},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}
 
+	router.Use(keepResponseWriter)
+
+	if confServer.RealIP {
+		router.Use(middleware.RealIP)
+	}
+
 	router.Use(
 		middleware.StripSlashes,
 		middleware.Recoverer,
+	)
+
+	if confServer.RateLimit > 0 {
+		router.Use(newRateLimiter(confServer.RateLimit, confServer.RateBurst).handler)
+	}
+	if confServer.ThrottleLimit > 0 {
+		backlogTimeout := time.Duration(confServer.ThrottleBacklogTimeoutSec) * time.Second
+		router.Use(newThrottle(confServer.ThrottleLimit, confServer.ThrottleBacklog, backlogTimeout).handler)
+	}
+
+	router.Use(
 		middleware.Compress(5, "gzip"),
 		cors.Handler(corsOpt),
 	)
 
-	if conf.Configuration.Server.Logs {
-		router.Use(middleware.Logger)
-	}
+	slowRequest = time.Duration(conf.Configuration.Server.SlowRequestMs) * time.Millisecond
 
 	addRoutes(router)
 
@@ -82,7 +135,20 @@ func Create() *http.Server {
 		Handler:      router,
 	}
 
-	return server
+	if TLSEnabled() {
+		tlsConf, err := tlsConfig(confServer)
+		if err != nil {
+			return nil, err
+		}
+		server.TLSConfig = tlsConf
+	}
+
+	// streams would otherwise hold the shutdown until they time out
+	server.RegisterOnShutdown(func() {
+		close(shutdown)
+	})
+
+	return server, nil
 }
 
 type serverHandler func(http.ResponseWriter, *http.Request) *serverError
@@ -90,33 +156,154 @@ type serverHandler func(http.ResponseWriter, *http.Request) *serverError
 func (sh serverHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	handlerDone := make(chan struct{})
-	start := time.Now()
-	_ = start
+
+	info := &requestInfo{start: time.Now(), results: -1}
+	r = r.WithContext(context.WithValue(r.Context(), requestInfoKey, info))
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+	metricInFlight.Inc()
+	defer metricInFlight.Dec()
 
 	go func() {
 		select {
 		case <-handlerDone:
-			// log time to complete request
 		case <-r.Context().Done():
-			// log canceled requests
+			// the context is also canceled once the request is served
+			select {
+			case <-handlerDone:
+				return
+			default:
+			}
+			fields := requestFields(r, info)
 			switch r.Context().Err() {
 			case context.DeadlineExceeded:
-				// log request terminated by write timeout
+				logger.Warn("request terminated by timeout", fields)
 			case context.Canceled:
-				// log request canceled by client
+				logger.Info("request canceled by client", fields)
 			}
 		}
 	}()
 
-	e := sh(w, r)
+	e := authorize(r)
+	if e == nil {
+		e = sh(ww, r)
+	}
 
 	if e != nil {
-		// log request processing error
-		writeError(w, e.Code, e.Message)
+		if e.RetryAfter > 0 {
+			setRetryAfter(ww, e.RetryAfter)
+		}
+		if e.Code == http.StatusUnauthorized {
+			ww.Header().Set("WWW-Authenticate", "Bearer")
+		}
+		writeError(ww, e.Code, e.Message)
 	}
 	close(handlerDone)
+
+	code := ww.Status()
+	if code == 0 {
+		code = http.StatusOK
+	}
+	observeRequest(r, info, code, e)
+	logRequest(r, info, code, e)
+}
+
+// logRequest logs a served request, at the warn level if it took longer
+// than the slow request threshold and with the error if it failed
+func logRequest(r *http.Request, info *requestInfo, code int, e *serverError) {
+
+	if e != nil && e.Code >= http.StatusInternalServerError {
+		fields := requestFields(r, info)
+		fields["status"] = code
+		fields["error"] = e.Error
+		logger.Error("request error", fields)
+		return
+	}
+
+	slow := slowRequest > 0 && info.duration() > slowRequest
+
+	if !slow && !logger.Enabled(logger.LevelInfo) {
+		return
+	}
+
+	fields := requestFields(r, info)
+	fields["status"] = code
+	if e != nil {
+		fields["error"] = e.Message
+	}
+
+	if slow {
+		logger.Warn("slow request", fields)
+		return
+	}
+	logger.Info("request", fields)
+}
+
+// requestFields are the log fields of a request: its layer, query type, route
+// and query params, result count and duration so far
+func requestFields(r *http.Request, info *requestInfo) logger.Fields {
+
+	layer, query := requestLabels(r)
+
+	params := make(map[string]string)
+	if rctx := chi.RouteContext(r.Context()); rctx != nil {
+		for i, k := range rctx.URLParams.Keys {
+			if i < len(rctx.URLParams.Values) && k != routeVarLayer && k != routeVarSubLayer {
+				params[k] = rctx.URLParams.Values[i]
+			}
+		}
+	}
+	for k, v := range r.URL.Query() {
+		if k == queryParamAPIKey || k == queryParamAccessToken {
+			params[k] = "redacted"
+			continue
+		}
+		params[k] = strings.Join(v, ",")
+	}
+
+	fields := logger.Fields{
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"layer":       layer,
+		"query":       query,
+		"params":      params,
+		"remote_addr": r.RemoteAddr,
+		"duration_ms": float64(info.duration().Microseconds()) / 1000,
+	}
+	if n := info.resultCount(); n >= 0 {
+		fields["results"] = n
+	}
+	return fields
+}
+
+// requestInfo is shared by a request's handler and serverHandler,
+// and read by the goroutine logging the request if it's canceled
+type requestInfo struct {
+	start   time.Time
+	results int64 // accessed atomically
+}
+
+type contextKey string
+
+const requestInfoKey contextKey = "requestInfo"
+
+func (info *requestInfo) duration() time.Duration {
+	return time.Since(info.start)
+}
+
+// resultCount is the number of features returned by the request, -1 if not known yet
+func (info *requestInfo) resultCount() int {
+	return int(atomic.LoadInt64(&info.results))
+}
+
+// setResults records the number of features returned by a request
+func setResults(r *http.Request, n int) {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+		atomic.StoreInt64(&info.results, int64(n))
+	}
 }
 
+// FatalAfter logs msg and exits unless the returned channel is closed within delaySec
 func FatalAfter(delaySec int, msg string) chan struct{} {
 	chanCancel := make(chan struct{})
 	go func() {
@@ -124,7 +311,8 @@ func FatalAfter(delaySec int, msg string) chan struct{} {
 		case <-chanCancel:
 			return
 		case <-time.After(time.Duration(delaySec) * time.Second):
-			// log msg
+			logger.Error(msg, logger.Fields{"timeout_sec": delaySec})
+			os.Exit(1)
 		}
 	}()
 	return chanCancel
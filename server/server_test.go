@@ -0,0 +1,213 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/data"
+	"github.com/engelsjk/rtyq/logger"
+	"github.com/go-chi/chi"
+)
+
+func TestMain(m *testing.M) {
+	logger.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// testRouter routes requests like the server, with the given config
+func testRouter(t *testing.T, server conf.Server, layers ...conf.Layer) *chi.Mux {
+	t.Helper()
+
+	saved := conf.Configuration
+	savedAuth := authorizer
+	t.Cleanup(func() {
+		conf.Configuration = saved
+		authorizer = savedAuth
+	})
+
+	conf.Configuration = conf.Config{Server: server, Layers: layers}
+	a, err := newAuth(server.Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizer = a
+
+	router := initRouter()
+	addRoutes(router)
+	return router
+}
+
+func serve(router http.Handler, method, target string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(`{}`))
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	return w
+}
+
+func testFeature(id string, coords string) string {
+	return `{"type":"Feature","properties":{"ID":"` + id + `"},"geometry":{"type":"Polygon","coordinates":[` + coords + `]}}`
+}
+
+const (
+	square0 = `[[0,0],[1,0],[1,1],[0,1],[0,0]]`
+	square5 = `[[5,5],[6,5],[6,6],[5,6],[5,5]]`
+)
+
+// testLayer loads a writable layer kept in memory, with a data file per feature
+// named after its key, and removes it once the test is done
+func testLayer(t *testing.T, confLayer conf.Layer, features map[string]string) conf.Layer {
+	t.Helper()
+
+	dir := t.TempDir()
+	for id, f := range features {
+		if err := ioutil.WriteFile(filepath.Join(dir, id+".geojson"), []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	confLayer.Data = conf.LayerData{Dir: dir, Ext: ".geojson", ID: "ID"}
+	confLayer.Database = conf.LayerDatabase{Backend: "memory", Index: confLayer.Name}
+	confLayer.Writable = true
+
+	layer, err := data.LoadLayer(confLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.AddLayerToQueryHandler(layer)
+	t.Cleanup(func() {
+		data.QueryHandler.RemoveLayer(confLayer.Name)
+	})
+
+	return confLayer
+}
+
+// captureLog collects the log entries written during a test
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	logger.SetOutput(&buf)
+	t.Cleanup(func() {
+		logger.SetOutput(ioutil.Discard)
+	})
+	return &buf
+}
+
+func TestLogRequest(t *testing.T) {
+	testRouter(t, conf.Server{})
+	buf := captureLog(t)
+
+	h := serverHandler(func(w http.ResponseWriter, r *http.Request) *serverError {
+		setResults(r, 3)
+		return nil
+	})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/parcels/bbox/0,0,1,1?api_key=secret", nil))
+
+	var entry struct {
+		Msg     string            `json:"msg"`
+		Status  int               `json:"status"`
+		Results int               `json:"results"`
+		Params  map[string]string `json:"params"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("log entry isn't JSON: %s", buf.String())
+	}
+	if entry.Msg != "request" || entry.Status != http.StatusOK || entry.Results != 3 {
+		t.Errorf("unexpected log entry %s", buf.String())
+	}
+	if entry.Params["api_key"] != "redacted" {
+		t.Errorf("api key logged as %q", entry.Params["api_key"])
+	}
+}
+
+// signalWriter signals each write to it
+type signalWriter chan struct{}
+
+func (w signalWriter) Write(p []byte) (int, error) {
+	w <- struct{}{}
+	return len(p), nil
+}
+
+func TestLogCanceledRequest(t *testing.T) {
+	testRouter(t, conf.Server{})
+	logged := make(signalWriter, 1)
+	logger.SetOutput(logged)
+	t.Cleanup(func() {
+		logger.SetOutput(ioutil.Discard)
+	})
+
+	// the canceled request is logged while its handler is still writing results
+	h := serverHandler(func(w http.ResponseWriter, r *http.Request) *serverError {
+		setResults(r, 1)
+		<-logged
+		setResults(r, 2)
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/parcels/bbox/0,0,1,1", nil).WithContext(ctx))
+}
+
+func TestIDNotFound(t *testing.T) {
+	confLayer := testLayer(t, conf.Layer{Name: "test"}, map[string]string{
+		"a": testFeature("a", square0),
+	})
+	router := testRouter(t, conf.Server{}, confLayer)
+
+	// a feature file next to the data dir isn't served by its relative path
+	secret := filepath.Join(filepath.Dir(confLayer.Data.Dir), "secret.geojson")
+	if err := ioutil.WriteFile(secret, []byte(testFeature("secret", square5)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := serve(router, "GET", "/test/id/a", nil); w.Code != http.StatusOK {
+		t.Fatalf("id query of a: %d, want %d", w.Code, http.StatusOK)
+	}
+	for _, target := range []string{"/test/id/missing", "/test/id/..%2Fsecret", "/test/id/..%2F..%2Fetc%2Fpasswd"} {
+		w := serve(router, "GET", target, nil)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s: %d, want %d", target, w.Code, http.StatusNotFound)
+		}
+		if strings.Contains(w.Body.String(), "secret") || strings.Contains(w.Body.String(), "root:") {
+			t.Errorf("%s leaked a file outside of the data dir: %s", target, w.Body.String())
+		}
+	}
+}
+
+func TestConfig(t *testing.T) {
+	router := testRouter(t, conf.Server{}, testLayer(t, conf.Layer{Name: "parcels"}, nil))
+
+	w := serve(router, "GET", "/config", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("config: %d", w.Code)
+	}
+	var config struct {
+		Layers  []string `json:"layers"`
+		Queries []string `json:"queries"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &config); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Layers) != 1 || config.Layers[0] != "parcels" {
+		t.Errorf("layers: %v", config.Layers)
+	}
+
+	// every query route is listed
+	queries := strings.Join(config.Queries, " ")
+	for _, route := range []string{"/point/", "/tile/", "/bbox/", "/id/", "/search?", "/stats", "/changes", "count=true"} {
+		if !strings.Contains(queries, route) {
+			t.Errorf("queries don't list %s: %v", route, config.Queries)
+		}
+	}
+}
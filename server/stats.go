@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/engelsjk/rtyq/data"
+)
+
+const (
+	queryParamCount = "count"
+)
+
+// countResult is the response of a count query
+type countResult struct {
+	NumberMatched int `json:"numberMatched"`
+}
+
+// isCount reports whether a request is for the number of features of a query only
+func isCount(r *http.Request) bool {
+	count, _ := strconv.ParseBool(getRequestParam(queryParamCount, r))
+	return count
+}
+
+// handleCount writes the number of features of a point, bbox, tile or search query
+func handleCount(w http.ResponseWriter, r *http.Request, layer string, count func(ctx context.Context) (int, error)) *serverError {
+
+	v, serr := newValidator(r, layer, formatJSON)
+	if serr != nil {
+		return serr
+	}
+	if v.notModified(r) {
+		v.writeNotModified(w)
+		return nil
+	}
+	if v.writeCached(w, r) {
+		return nil
+	}
+
+	n, err := count(r.Context())
+	partial, serr := queryResult(err, layer)
+	if serr != nil {
+		return serr
+	}
+
+	if partial {
+		w.Header().Set(headerPartialResults, "true")
+		w.Header().Set("Cache-Control", "no-store")
+		return writeJSON(w, ContentTypeJSON, countResult{NumberMatched: n})
+	}
+	return v.writeJSON(w, countResult{NumberMatched: n})
+}
+
+// handleStats summarizes the features of a layer
+func handleStats(w http.ResponseWriter, r *http.Request) *serverError {
+
+	layer := getRequestVar(routeVarLayer, r)
+	sublayer := getRequestVar(routeVarSubLayer, r)
+
+	if sublayer != "" {
+		layer = fmt.Sprintf("%s/%s", layer, sublayer)
+	}
+
+	v, serr := newValidator(r, layer, formatJSON)
+	if serr != nil {
+		return serr
+	}
+	if v.notModified(r) {
+		v.writeNotModified(w)
+		return nil
+	}
+	if v.writeCached(w, r) {
+		return nil
+	}
+
+	stats, err := data.QueryHandler.Stats(r.Context(), layer)
+	if err != nil {
+		return errorQueryToServer(err)
+	}
+
+	return v.writeJSON(w, stats)
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/data"
+)
+
+func TestCountQueries(t *testing.T) {
+	layer := testLayer(t, conf.Layer{Name: "test", Search: []string{"ID"}}, map[string]string{
+		"a": testFeature("a", square0),
+		"b": testFeature("b", square5),
+	})
+	router := testRouter(t, conf.Server{}, layer)
+
+	tests := []struct {
+		target string
+		want   int
+	}{
+		{"/test/bbox/-1,-1,7,7?count=true", 2},
+		{"/test/bbox/4,4,7,7?count=1", 1},
+		{"/test/point/0.5,0.5?count=true", 1},
+		{"/test/point/3,3?count=true", 0},
+		{"/test/tile/0/0/0?count=true", 2},
+		{"/test/search?ID=a&count=true", 1},
+	}
+	for _, tt := range tests {
+		w := serve(router, "GET", tt.target, nil)
+		var result countResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); w.Code != http.StatusOK || err != nil {
+			t.Errorf("%s: %d %s", tt.target, w.Code, w.Body.String())
+			continue
+		}
+		if result.NumberMatched != tt.want {
+			t.Errorf("%s: %d matched, want %d", tt.target, result.NumberMatched, tt.want)
+		}
+	}
+
+	// count=false returns the features
+	var features []json.RawMessage
+	w := serve(router, "GET", "/test/bbox/-1,-1,7,7?count=false", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &features); err != nil || len(features) != 2 {
+		t.Errorf("query with count=false: %s", w.Body.String())
+	}
+	if w := serve(router, "GET", "/test/bbox/1,1,1?count=true", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("count of an invalid bbox: %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// counts are revalidated like other responses
+	w = serve(router, "GET", "/test/bbox/-1,-1,7,7?count=true", nil)
+	if w := serve(router, "GET", "/test/bbox/-1,-1,7,7?count=true", withHeader("If-None-Match", w.Header().Get("ETag"))); w.Code != http.StatusNotModified {
+		t.Errorf("revalidated count: %d, want %d", w.Code, http.StatusNotModified)
+	}
+}
+
+func TestStatsQuery(t *testing.T) {
+	layer := testLayer(t, conf.Layer{Name: "test"}, map[string]string{
+		"a": testFeature("a", square0),
+		"b": testFeature("b", square5),
+	})
+	router := testRouter(t, conf.Server{}, layer)
+
+	w := serve(router, "GET", "/test/stats", nil)
+	var stats data.LayerStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("stats: %d %s", w.Code, w.Body.String())
+	}
+	if stats.Name != "test" || stats.Features != 2 || len(stats.Bounds) != 4 || w.Header().Get("ETag") == "" {
+		t.Errorf("stats: %s", w.Body.String())
+	}
+
+	putTestFeature(t, "test", "c", square5)
+	w = serve(router, "GET", "/test/stats", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || stats.Features != 3 {
+		t.Errorf("stats after a write: %s", w.Body.String())
+	}
+
+	if w := serve(router, "GET", "/missing/stats", nil); w.Code == http.StatusOK {
+		t.Errorf("stats of a missing layer: %d", w.Code)
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/data"
+	"github.com/engelsjk/rtyq/logger"
+	"github.com/paulmach/orb/geojson"
+)
+
+// streamFeatures writes the features of a point, bbox, tile or search query as the
+// query finds them, rather than once it's done, and stops the query when the
+// client goes away. Query errors are returned as usual if no feature was written
+// yet, otherwise the response is cut short without its footer.
+func (v *validator) streamFeatures(w http.ResponseWriter, r *http.Request, f *format, layer string, each func(fn data.FeatureFunc) error) *serverError {
+
+	project, err := data.FeatureProjection(getRequestParam(queryParamCRS, r))
+	if err != nil {
+		return errorQueryToServer(err)
+	}
+
+	out := &streamOutput{w: w, contype: f.contype, v: v}
+	if v != nil {
+		out.limit = cacheSize(layer)
+	}
+	if out.limit > 0 {
+		out.cached = &bytes.Buffer{}
+	}
+
+	// a streamed response may turn out to be partial, so it isn't tagged
+	// for revalidation and the flag is sent as a trailer
+	allowPartial := partialResults(layer)
+	if allowPartial {
+		out.v = nil
+		w.Header().Set("Trailer", headerPartialResults)
+	}
+
+	fw := f.stream.writer(out, idKey(layer))
+	ctx := r.Context()
+
+	var werr error
+	err = each(func(feature *geojson.Feature) bool {
+		if ctx.Err() != nil {
+			return false
+		}
+		p := project(*feature)
+		werr = fw.write(&p)
+		return werr == nil
+	})
+
+	setResults(r, fw.n)
+
+	partial := err == data.ErrQueryTimeout && allowPartial
+	if err != nil && !partial {
+		if fw.n == 0 {
+			return errorQueryToServer(err)
+		}
+		if err == data.ErrQueryCanceled {
+			return nil
+		}
+		if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+			fields := requestFields(r, info)
+			fields["error"] = err
+			logger.Error("response cut short", fields)
+		}
+		return nil
+	}
+	if ctx.Err() != nil || werr != nil {
+		// the client went away
+		return nil
+	}
+
+	if partial {
+		w.Header().Set(headerPartialResults, "true")
+		out.cached = nil
+	}
+
+	if err := fw.close(); err != nil {
+		return nil
+	}
+
+	if out.cached != nil {
+		responses.put(v.layer, v.version, v.key, &response{contype: f.contype, body: out.cached.Bytes(), results: fw.n})
+	}
+
+	return nil
+}
+
+// streamOutput writes the headers of a streamed response with its first bytes,
+// and keeps a copy of the response for the response cache up to limit
+type streamOutput struct {
+	w       http.ResponseWriter
+	contype string
+	v       *validator
+	started bool
+	limit   int
+	cached  *bytes.Buffer
+}
+
+func (o *streamOutput) Write(b []byte) (int, error) {
+	if !o.started {
+		o.started = true
+		o.v.setHeaders(o.w)
+		o.w.Header().Set("Content-Type", o.contype)
+		o.w.WriteHeader(http.StatusOK)
+	}
+	if o.cached != nil {
+		if o.cached.Len()+len(b) > o.limit {
+			o.cached = nil
+		} else {
+			o.cached.Write(b)
+		}
+	}
+	return o.w.Write(b)
+}
+
+/////////////////////////////////////////////////////////////
+
+// headerPartialResults flags the responses of queries that reached
+// their layer's query timeout, if it allows partial results
+const headerPartialResults = "X-Partial-Results"
+
+func partialResults(layer string) bool {
+	confLayer, _ := conf.GetLayer(layer)
+	return confLayer.QueryTimeoutMs > 0 && confLayer.PartialResults
+}
+
+// queryResult reports whether the features of a query are partial,
+// or returns its error
+func queryResult(err error, layer string) (bool, *serverError) {
+	if err == nil {
+		return false, nil
+	}
+	if err == data.ErrQueryTimeout && partialResults(layer) {
+		return true, nil
+	}
+	return false, errorQueryToServer(err)
+}
+
+// writePartial writes the partial features of a query, which aren't cached
+func writePartial(w http.ResponseWriter, r *http.Request, f *format, layer string, features []geojson.Feature) *serverError {
+	setResults(r, len(features))
+	w.Header().Set(headerPartialResults, "true")
+	w.Header().Set("Cache-Control", "no-store")
+	return writeFeatures(w, f, layer, features)
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/data"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+func testFeatures() []geojson.Feature {
+	a := geojson.NewFeature(orb.Point{1, 2})
+	a.Properties["ID"] = "a"
+	a.Properties["NAME"] = "A & B"
+	b := geojson.NewFeature(orb.Polygon{{{0, 0}, {1, 0}, {1, 1}, {0, 0}}})
+	b.Properties["ID"] = "b"
+	return []geojson.Feature{*a, *b}
+}
+
+func formatNamed(t *testing.T, name string) *format {
+	t.Helper()
+	for _, f := range formats {
+		if f.name == name {
+			return f
+		}
+	}
+	t.Fatalf("no format %s", name)
+	return nil
+}
+
+func TestStreamFormats(t *testing.T) {
+	tests := []struct {
+		name  string
+		check func(t *testing.T, body []byte, n int)
+	}{
+		{"json", func(t *testing.T, body []byte, n int) {
+			var features []json.RawMessage
+			if err := json.Unmarshal(body, &features); err != nil || len(features) != n {
+				t.Errorf("json: %d features, %v: %s", len(features), err, body)
+			}
+		}},
+		{"geojson", func(t *testing.T, body []byte, n int) {
+			fc, err := geojson.UnmarshalFeatureCollection(body)
+			if err != nil || len(fc.Features) != n {
+				t.Errorf("geojson: %v: %s", err, body)
+			}
+		}},
+		{"geojsonseq", func(t *testing.T, body []byte, n int) {
+			records := bytes.Split(body, []byte{0x1e})
+			if len(records)-1 != n || len(records[0]) != 0 {
+				t.Errorf("geojsonseq: %d records: %q", len(records)-1, body)
+				return
+			}
+			for _, r := range records[1:] {
+				if !bytes.HasSuffix(r, []byte("\n")) {
+					t.Errorf("geojsonseq: record isn't terminated by a newline: %q", r)
+				}
+				if _, err := geojson.UnmarshalFeature(r); err != nil {
+					t.Errorf("geojsonseq: %v: %q", err, r)
+				}
+			}
+		}},
+		{"kml", func(t *testing.T, body []byte, n int) {
+			var doc struct {
+				Placemarks []struct {
+					Name string `xml:"name"`
+				} `xml:"Document>Placemark"`
+			}
+			if err := xml.Unmarshal(body, &doc); err != nil || len(doc.Placemarks) != n {
+				t.Errorf("kml: %v: %s", err, body)
+				return
+			}
+			if n > 0 && doc.Placemarks[0].Name != "a" {
+				t.Errorf("kml: placemark named %q, want a", doc.Placemarks[0].Name)
+			}
+		}},
+		{"ids", func(t *testing.T, body []byte, n int) {
+			if lines := strings.Fields(string(body)); len(lines) != n {
+				t.Errorf("ids: %q", body)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		f := formatNamed(t, tt.name)
+		for _, features := range [][]geojson.Feature{testFeatures(), {}} {
+			var buf bytes.Buffer
+			fw := f.stream.writer(&buf, "ID")
+			for i := range features {
+				if err := fw.write(&features[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := fw.close(); err != nil {
+				t.Fatal(err)
+			}
+			if fw.n != len(features) {
+				t.Errorf("%s: wrote %d features, want %d", tt.name, fw.n, len(features))
+			}
+			tt.check(t, buf.Bytes(), len(features))
+
+			// streamed responses are encoded like buffered ones
+			encoded, err := f.encode(features, "ID")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(encoded, buf.Bytes()) {
+				t.Errorf("%s: streamed %q, encoded %q", tt.name, buf.Bytes(), encoded)
+			}
+		}
+	}
+}
+
+// streamTest streams features with a query that returns err after them
+func streamTest(t *testing.T, layer string, features []geojson.Feature, err error) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/"+layer+"/bbox/0,0,1,1", nil)
+	serr := (*validator)(nil).streamFeatures(w, r, formatJSON, layer, func(fn data.FeatureFunc) error {
+		for i := range features {
+			if !fn(&features[i]) {
+				return nil
+			}
+		}
+		return err
+	})
+	if serr != nil {
+		writeError(w, serr.Code, serr.Message)
+	}
+	return w
+}
+
+func TestStreamFeatures(t *testing.T) {
+	testRouter(t, conf.Server{}, conf.Layer{Name: "test", Data: conf.LayerData{ID: "ID"}})
+
+	w := streamTest(t, "test", testFeatures(), nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ContentTypeJSON {
+		t.Fatalf("stream: %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	var features []json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &features); err != nil || len(features) != 2 {
+		t.Errorf("stream body: %v: %s", err, w.Body.String())
+	}
+
+	// an error before the first feature is returned as usual
+	w = streamTest(t, "test", nil, data.ErrQueryInvalidBBox)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("error before the first feature: %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	// an error after it cuts the response short
+	w = streamTest(t, "test", testFeatures(), data.ErrQueryRequest)
+	if w.Code != http.StatusOK || strings.HasSuffix(w.Body.String(), "]") {
+		t.Errorf("error after the first feature: %d %s", w.Code, w.Body.String())
+	}
+
+	// a canceled client stops the query
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	n := 0
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/test/bbox/0,0,1,1", nil).WithContext(ctx)
+	(*validator)(nil).streamFeatures(w, r, formatJSON, "test", func(fn data.FeatureFunc) error {
+		for _, f := range testFeatures() {
+			if !fn(&f) {
+				return nil
+			}
+			n++
+		}
+		return nil
+	})
+	if n != 0 {
+		t.Errorf("%d features streamed to a canceled client", n)
+	}
+}
+
+func TestStreamPartialResults(t *testing.T) {
+	testRouter(t, conf.Server{}, conf.Layer{Name: "test", QueryTimeoutMs: 10, PartialResults: true})
+
+	w := streamTest(t, "test", testFeatures(), data.ErrQueryTimeout)
+	if w.Code != http.StatusOK {
+		t.Fatalf("partial stream: %d", w.Code)
+	}
+	var features []json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &features); err != nil || len(features) != 2 {
+		t.Errorf("partial stream body: %v: %s", err, w.Body.String())
+	}
+	if w.Header().Get("Trailer") != headerPartialResults || w.Header().Get(headerPartialResults) != "true" {
+		t.Errorf("partial stream isn't flagged: %v", w.Header())
+	}
+}
+
+func TestStreamQueryFormats(t *testing.T) {
+	layer := testLayer(t, conf.Layer{Name: "test"}, map[string]string{
+		"a": testFeature("a", square0),
+		"b": testFeature("b", square5),
+	})
+	router := testRouter(t, conf.Server{}, layer)
+
+	tests := []struct {
+		target, accept, contype string
+	}{
+		{"/test/bbox/-1,-1,7,7", "", ContentTypeJSON},
+		{"/test/bbox/-1,-1,7,7?f=geojson", "", ContentTypeGeoJSON},
+		{"/test/bbox/-1,-1,7,7?f=geojsonseq", "", ContentTypeGeoJSONSeq},
+		{"/test/bbox/-1,-1,7,7", ContentTypeKML, ContentTypeKML},
+		{"/test/bbox/-1,-1,7,7?f=ids", "", ContentTypeText},
+	}
+
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.accept != "" {
+			header.Set("Accept", tt.accept)
+		}
+		w := serve(router, "GET", tt.target, header)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != tt.contype {
+			t.Errorf("%s accepting %q: %d %s, want %s", tt.target, tt.accept, w.Code, w.Header().Get("Content-Type"), tt.contype)
+			continue
+		}
+		if !strings.Contains(w.Body.String(), "a") || !strings.Contains(w.Body.String(), "b") {
+			t.Errorf("%s: missing features: %s", tt.target, w.Body.String())
+		}
+	}
+
+	if w := serve(router, "GET", "/test/bbox/-1,-1,7,7?f=shp", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: %d, want %d", w.Code, http.StatusBadRequest)
+	}
+	header := http.Header{}
+	header.Set("Accept", "image/png")
+	if w := serve(router, "GET", "/test/bbox/-1,-1,7,7", header); w.Code != http.StatusNotAcceptable {
+		t.Errorf("unacceptable format: %d, want %d", w.Code, http.StatusNotAcceptable)
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const headerAPIKey = "X-API-Key"
+
+var (
+	ErrCapacityExceeded error = fmt.Errorf("server capacity exceeded")
+	ErrThrottleTimeout  error = fmt.Errorf("timed out waiting for capacity")
+	ErrRateLimited      error = fmt.Errorf("rate limit exceeded")
+)
+
+// throttleExempt are served without throttling or rate limiting,
+// so that probes and scrapes still work under load
+var throttleExempt = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// throttle limits the number of requests served at once. Requests over the limit
+// wait in a backlog, until a slot frees up or the backlog timeout is reached.
+type throttle struct {
+	tokens  chan struct{}
+	backlog chan struct{}
+	timeout time.Duration
+}
+
+func newThrottle(limit, backlog int, timeout time.Duration) *throttle {
+	return &throttle{
+		tokens:  make(chan struct{}, limit),
+		backlog: make(chan struct{}, limit+backlog),
+		timeout: timeout,
+	}
+}
+
+// isChangesPath reports whether a path is that of a layer's /changes stream,
+// which holds its request open for as long as the client listens
+func isChangesPath(path string) bool {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	n := len(parts)
+	return (n == 2 || n == 3) && parts[n-1] == "changes" && parts[n-2] != "id"
+}
+
+// handler throttles requests, except those of exempt paths and /changes streams,
+// which would otherwise each hold a slot for as long as they're open
+func (t *throttle) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if throttleExempt[r.URL.Path] || isChangesPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case t.backlog <- struct{}{}:
+			defer func() { <-t.backlog }()
+		default:
+			metricRejected.WithLabelValues("capacity").Inc()
+			writeRetryError(w, http.StatusServiceUnavailable, ErrCapacityExceeded.Error(), time.Second)
+			return
+		}
+
+		timer := time.NewTimer(t.timeout)
+		defer timer.Stop()
+
+		select {
+		case t.tokens <- struct{}{}:
+			defer func() { <-t.tokens }()
+			next.ServeHTTP(w, r)
+		case <-timer.C:
+			metricRejected.WithLabelValues("timeout").Inc()
+			writeRetryError(w, http.StatusServiceUnavailable, ErrThrottleTimeout.Error(), time.Second)
+		case <-r.Context().Done():
+		}
+	})
+}
+
+/////////////////////////////////////////////////////////////////////
+
+// rateLimiter is a token bucket per client, refilled at rate tokens per second
+// up to burst. Clients are identified by their API key if they send a valid one,
+// by their IP otherwise.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	clients   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateSweepInterval is how often the buckets of idle clients are dropped
+const rateSweepInterval = time.Minute
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	b := float64(burst)
+	if b < 1 {
+		b = math.Max(1, math.Ceil(rate))
+	}
+	return &rateLimiter{
+		rate:      rate,
+		burst:     b,
+		clients:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes a token from a client's bucket, or returns how long until one is available
+func (rl *rateLimiter) allow(client string) (bool, time.Duration) {
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.sweep(now)
+
+	b, ok := rl.clients[client]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.clients[client] = b
+	}
+
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops the buckets that are full again, which are the same as new ones
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rateSweepInterval {
+		return
+	}
+	rl.lastSweep = now
+	for client, b := range rl.clients {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.clients, client)
+		}
+	}
+}
+
+func (rl *rateLimiter) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if throttleExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if ok, wait := rl.allow(clientKey(r)); !ok {
+			metricRejected.WithLabelValues("rate").Inc()
+			writeRetryError(w, http.StatusTooManyRequests, ErrRateLimited.Error(), wait)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientKey identifies the client of a request for rate limiting, by its API key
+// if it's a configured one (so that clients can't get a bucket per made up key),
+// by its IP otherwise
+func clientKey(r *http.Request) string {
+	if key := requestAPIKey(r); key != "" && authorizer != nil && authorizer.key(key) != nil {
+		return "key:" + key
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+/////////////////////////////////////////////////////////////////////
+
+// writeRetryError writes an error with a Retry-After header, in whole seconds
+func writeRetryError(w http.ResponseWriter, status int, msg string, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+	writeError(w, status, msg)
+}
+
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	sec := int(math.Ceil(retryAfter.Seconds()))
+	if sec < 1 {
+		sec = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(sec))
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/engelsjk/rtyq/conf"
+)
+
+func TestClientKey(t *testing.T) {
+	testRouter(t, conf.Server{Auth: conf.Auth{Keys: []conf.AuthKey{{Key: "valid", Layers: []string{"*"}}}}})
+
+	tests := []struct {
+		target, header, want string
+	}{
+		{"/a/id/1", "", "ip:192.0.2.1"},
+		{"/a/id/1", "valid", "key:valid"},
+		{"/a/id/1?api_key=valid", "", "key:valid"},
+		{"/a/id/1", "made-up", "ip:192.0.2.1"},
+		{"/a/id/1?api_key=made-up", "", "ip:192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.header != "" {
+			r.Header.Set(headerAPIKey, tt.header)
+		}
+		if got := clientKey(r); got != tt.want {
+			t.Errorf("client key of %s with key %q: %s, want %s", tt.target, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	testRouter(t, conf.Server{Auth: conf.Auth{Keys: []conf.AuthKey{{Key: "valid", Layers: []string{"*"}}}}})
+
+	rl := newRateLimiter(1, 2)
+	handler := rl.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	request := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/a/id/1", nil)
+		if key != "" {
+			r.Header.Set(headerAPIKey, key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// a new made up key per request doesn't get around the limit of the IP
+	for i, key := range []string{"k1", "k2", "k3"} {
+		w := request(key)
+		if i < 2 && w.Code != http.StatusOK {
+			t.Fatalf("request %d: %d, want %d", i, w.Code, http.StatusOK)
+		}
+		if i == 2 {
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("request %d: %d, want %d", i, w.Code, http.StatusTooManyRequests)
+			}
+			if w.Header().Get("Retry-After") != "1" {
+				t.Errorf("Retry-After: %q, want 1", w.Header().Get("Retry-After"))
+			}
+		}
+	}
+
+	// a valid key has its own bucket
+	if w := request("valid"); w.Code != http.StatusOK {
+		t.Errorf("request with a valid key: %d, want %d", w.Code, http.StatusOK)
+	}
+
+	// exempt paths aren't limited
+	r := httptest.NewRequest("GET", "/healthz", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("healthz: %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	rl := newRateLimiter(10, 1)
+	if ok, _ := rl.allow("a"); !ok {
+		t.Fatal("first request was limited")
+	}
+	ok, wait := rl.allow("a")
+	if ok || wait <= 0 || wait > 100*time.Millisecond {
+		t.Fatalf("second request: %v, wait %v", ok, wait)
+	}
+	time.Sleep(wait)
+	if ok, _ := rl.allow("a"); !ok {
+		t.Error("request after waiting was limited")
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	th := newThrottle(1, 0, 10*time.Millisecond)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := th.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			close(started)
+			<-release
+		}
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/slow", nil))
+		close(done)
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/fast", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("request over capacity: %d, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/readyz", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("exempt request over capacity: %d, want %d", w.Code, http.StatusOK)
+	}
+
+	close(release)
+	<-done
+}
+
+func TestIsChangesPath(t *testing.T) {
+	tests := map[string]bool{
+		"/parcels/changes":        true,
+		"/roads/2020/changes":     true,
+		"/parcels/changes/":       true,
+		"/changes":                false,
+		"/parcels/id/changes":     false,
+		"/parcels/bbox/0,0,1,1":   false,
+		"/a/b/c/changes":          false,
+		"/parcels/changes/stream": false,
+	}
+	for path, want := range tests {
+		if got := isChangesPath(path); got != want {
+			t.Errorf("%s: %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestThrottleExemptsChanges(t *testing.T) {
+	th := newThrottle(1, 0, 10*time.Millisecond)
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	handler := th.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/changes") {
+			started <- struct{}{}
+			<-release
+		}
+	}))
+
+	// open streams don't hold the only slot
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/parcels/changes", nil))
+			done <- struct{}{}
+		}()
+		<-started
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/parcels/id/1", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("request with streams open: %d, want %d", w.Code, http.StatusOK)
+	}
+
+	close(release)
+	<-done
+	<-done
+}
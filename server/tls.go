@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/engelsjk/rtyq/conf"
+)
+
+// TLSEnabled reports whether the server is configured to serve HTTPS
+func TLSEnabled() bool {
+	return conf.Configuration.Server.TLSCert != "" || conf.Configuration.Server.TLSKey != ""
+}
+
+// tlsConfig returns the TLS config of the server. With a client CA,
+// clients must present a certificate signed by it (mTLS).
+func tlsConfig(confServer conf.Server) (*tls.Config, error) {
+
+	if confServer.TLSCert == "" || confServer.TLSKey == "" {
+		return nil, fmt.Errorf("tlscert and tlskey must both be set")
+	}
+
+	c := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if confServer.TLSClientCA != "" {
+		pem, err := ioutil.ReadFile(confServer.TLSClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in client ca file %s", confServer.TLSClientCA)
+		}
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return c, nil
+}
+
+// CreateRedirect returns a plain HTTP server that redirects every request
+// to the HTTPS server, or nil if no redirect port is configured
+func CreateRedirect() *http.Server {
+
+	confServer := conf.Configuration.Server
+
+	if !TLSEnabled() || confServer.HTTPRedirectPort == 0 {
+		return nil
+	}
+
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if confServer.Port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(confServer.Port))
+		}
+		target := "https://" + host + r.URL.RequestURI()
+
+		code := http.StatusPermanentRedirect
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			code = http.StatusMovedPermanently
+		}
+		http.Redirect(w, r, target, code)
+	})
+
+	return &http.Server{
+		ReadTimeout:  time.Duration(confServer.ReadTimeoutSec) * time.Second,
+		WriteTimeout: time.Duration(confServer.WriteTimeoutSec) * time.Second,
+		Addr:         fmt.Sprintf("%v:%v", confServer.Host, confServer.HTTPRedirectPort),
+		Handler:      redirect,
+	}
+}
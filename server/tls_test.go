@@ -0,0 +1,181 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/engelsjk/rtyq/conf"
+)
+
+// testCert creates a certificate signed by parent, or a self-signed CA without a parent
+func testCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	_, _, caPEM := testCert(t, "ca", nil, nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(emptyFile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		server     conf.Server
+		err        bool
+		clientAuth tls.ClientAuthType
+	}{
+		{conf.Server{TLSCert: "cert.pem"}, true, tls.NoClientCert},
+		{conf.Server{TLSKey: "key.pem"}, true, tls.NoClientCert},
+		{conf.Server{TLSCert: "cert.pem", TLSKey: "key.pem"}, false, tls.NoClientCert},
+		{conf.Server{TLSCert: "cert.pem", TLSKey: "key.pem", TLSClientCA: caFile}, false, tls.RequireAndVerifyClientCert},
+		{conf.Server{TLSCert: "cert.pem", TLSKey: "key.pem", TLSClientCA: emptyFile}, true, tls.NoClientCert},
+		{conf.Server{TLSCert: "cert.pem", TLSKey: "key.pem", TLSClientCA: filepath.Join(dir, "missing.pem")}, true, tls.NoClientCert},
+	}
+
+	for i, tt := range tests {
+		c, err := tlsConfig(tt.server)
+		if (err != nil) != tt.err {
+			t.Errorf("test %d: error %v, want error: %v", i, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if c.MinVersion != tls.VersionTLS12 {
+			t.Errorf("test %d: min version %x", i, c.MinVersion)
+		}
+		if c.ClientAuth != tt.clientAuth {
+			t.Errorf("test %d: client auth %v, want %v", i, c.ClientAuth, tt.clientAuth)
+		}
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	ca, caKey, caPEM := testCert(t, "ca", nil, nil)
+	client, clientKey, _ := testCert(t, "client", ca, caKey)
+	other, otherKey, _ := testCert(t, "other ca", nil, nil)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := tlsConfig(conf.Server{TLSCert: "cert.pem", TLSKey: "key.pem", TLSClientCA: caFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = c
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(cert *x509.Certificate, key *ecdsa.PrivateKey) error {
+		tlsClient := ts.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		if cert != nil {
+			tlsClient.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: key}}
+		}
+		transport := &http.Transport{TLSClientConfig: tlsClient}
+		defer transport.CloseIdleConnections()
+		resp, err := (&http.Client{Transport: transport}).Get(ts.URL)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if err := get(client, clientKey); err != nil {
+		t.Errorf("request with a client certificate signed by the ca: %v", err)
+	}
+	if err := get(nil, nil); err == nil {
+		t.Error("request without a client certificate succeeded")
+	}
+	if err := get(other, otherKey); err == nil {
+		t.Error("request with a client certificate of another ca succeeded")
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	saved := conf.Configuration
+	defer func() { conf.Configuration = saved }()
+
+	tests := []struct {
+		server         conf.Server
+		method, target string
+		code           int
+		location       string
+	}{
+		{conf.Server{TLSCert: "c", TLSKey: "k", Port: 8443, HTTPRedirectPort: 8080}, "GET", "http://example.com:8080/parcels/id/1?f=csv", http.StatusMovedPermanently, "https://example.com:8443/parcels/id/1?f=csv"},
+		{conf.Server{TLSCert: "c", TLSKey: "k", Port: 443, HTTPRedirectPort: 80}, "HEAD", "http://example.com/parcels", http.StatusMovedPermanently, "https://example.com/parcels"},
+		{conf.Server{TLSCert: "c", TLSKey: "k", Port: 443, HTTPRedirectPort: 80}, "PUT", "http://example.com/parcels/id/1", http.StatusPermanentRedirect, "https://example.com/parcels/id/1"},
+	}
+
+	for _, tt := range tests {
+		conf.Configuration = conf.Config{Server: tt.server}
+		redirect := CreateRedirect()
+		if redirect == nil {
+			t.Fatalf("no redirect server for %+v", tt.server)
+		}
+		w := httptest.NewRecorder()
+		redirect.Handler.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+		if w.Code != tt.code || w.Header().Get("Location") != tt.location {
+			t.Errorf("%s %s: %d %s, want %d %s", tt.method, tt.target, w.Code, w.Header().Get("Location"), tt.code, tt.location)
+		}
+	}
+
+	for _, server := range []conf.Server{
+		{Port: 5500, HTTPRedirectPort: 80},
+		{TLSCert: "c", TLSKey: "k", Port: 443},
+	} {
+		conf.Configuration = conf.Config{Server: server}
+		if CreateRedirect() != nil {
+			t.Errorf("redirect server for %+v", server)
+		}
+	}
+}
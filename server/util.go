@@ -3,31 +3,61 @@ package server
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 
+	"github.com/engelsjk/rtyq/data"
 	"github.com/go-chi/chi"
 	jsoniter "github.com/json-iterator/go"
+	"github.com/paulmach/orb/geojson"
 )
 
+const maxFeatureBytes = 32 << 20
+
 /////////////////////////////////////////////////////////////
 
 func getRequestVar(varname string, r *http.Request) string {
 	return chi.URLParam(r, varname)
 }
 
+func getRequestParam(param string, r *http.Request) string {
+	return r.URL.Query().Get(param)
+}
+
+// readFeature decodes a GeoJSON feature from a request body
+func readFeature(w http.ResponseWriter, r *http.Request) (*geojson.Feature, *serverError) {
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxFeatureBytes))
+	if err != nil {
+		return nil, serverErrorBadRequest(err, data.ErrQueryInvalidFeature.Error())
+	}
+	f, err := geojson.UnmarshalFeature(b)
+	if err != nil {
+		return nil, serverErrorBadRequest(err, data.ErrQueryInvalidFeature.Error())
+	}
+	return f, nil
+}
+
 func writeJSON(w http.ResponseWriter, contype string, content interface{}) *serverError {
+	return writeJSONStatus(w, contype, http.StatusOK, content)
+}
+
+func writeJSONStatus(w http.ResponseWriter, contype string, status int, content interface{}) *serverError {
 	var json = jsoniter.ConfigCompatibleWithStandardLibrary
 	encodedContent, err := json.Marshal(content)
 	if err != nil {
 		return serverErrorInternal(err, ErrMsgEncoding)
 	}
-	writeResponse(w, contype, encodedContent)
+	writeResponseStatus(w, contype, status, encodedContent)
 	return nil
 }
 
 func writeResponse(w http.ResponseWriter, contype string, encodedContent []byte) {
+	writeResponseStatus(w, contype, http.StatusOK, encodedContent)
+}
+
+func writeResponseStatus(w http.ResponseWriter, contype string, status int, encodedContent []byte) {
 	w.Header().Set("Content-Type", contype)
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(status)
 	w.Write(encodedContent)
 }
 
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/engelsjk/rtyq/conf"
+	"github.com/engelsjk/rtyq/data"
+)
+
+func serveBody(router http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+	return w
+}
+
+func TestWrites(t *testing.T) {
+	layer := testLayer(t, conf.Layer{Name: "test"}, map[string]string{
+		"a": testFeature("a", square0),
+	})
+	router := testRouter(t, conf.Server{}, layer)
+
+	tests := []struct {
+		method, target, body string
+		code                 int
+	}{
+		{"PUT", "/test/id/c", testFeature("c", square5), http.StatusCreated},
+		{"PUT", "/test/id/c", testFeature("c", square5), http.StatusOK},
+		{"PUT", "/test/id/c", "{", http.StatusBadRequest},
+		{"PUT", "/test/id/c", `{"type":"Point","coordinates":[0,0]}`, http.StatusBadRequest},
+		// an unclosed ring is repaired, a degenerate one is rejected
+		{"PUT", "/test/id/e", testFeature("e", `[[0,0],[1,0],[1,1],[0,1]]`), http.StatusCreated},
+		{"PUT", "/test/id/f", testFeature("f", `[[0,0],[1,1],[0,0]]`), http.StatusBadRequest},
+		{"POST", "/test", testFeature("d", square5), http.StatusCreated},
+		{"POST", "/test", testFeature("d", square5), http.StatusConflict},
+		{"DELETE", "/test/id/d", "", http.StatusNoContent},
+		{"DELETE", "/test/id/d", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if w := serveBody(router, tt.method, tt.target, tt.body); w.Code != tt.code {
+			t.Errorf("%s %s: %d, want %d: %s", tt.method, tt.target, w.Code, tt.code, w.Body.String())
+		}
+	}
+
+	// written features show up in queries right away
+	var features []json.RawMessage
+	w := serve(router, "GET", "/test/bbox/4,4,7,7", nil)
+	if err := json.Unmarshal(w.Body.Bytes(), &features); err != nil || len(features) != 1 {
+		t.Errorf("bbox query after writes: %s", w.Body.String())
+	}
+	if w := serve(router, "GET", "/test/id/d", nil); w.Code != http.StatusNotFound {
+		t.Errorf("id query of a deleted feature: %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	// the response is projected like query responses
+	w = serveBody(router, "PUT", "/test/id/c?crs=EPSG:3857", testFeature("c", square5))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "556597") {
+		t.Errorf("projected write response: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestWritesToReadOnlyLayer(t *testing.T) {
+	confLayer := testLayer(t, conf.Layer{Name: "test"}, map[string]string{
+		"a": testFeature("a", square0),
+	})
+	confLayer.Writable = false
+	layer, err := data.LoadLayer(confLayer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data.AddLayerToQueryHandler(layer)
+	router := testRouter(t, conf.Server{}, confLayer)
+
+	for _, tt := range []struct{ method, target string }{
+		{"PUT", "/test/id/a"},
+		{"POST", "/test"},
+		{"DELETE", "/test/id/a"},
+	} {
+		if w := serveBody(router, tt.method, tt.target, testFeature("b", square5)); w.Code != http.StatusForbidden {
+			t.Errorf("%s %s: %d, want %d", tt.method, tt.target, w.Code, http.StatusForbidden)
+		}
+	}
+	if w := serve(router, "GET", "/test/id/a", nil); w.Code != http.StatusOK {
+		t.Errorf("id query of a read-only layer: %d", w.Code)
+	}
+}